@@ -0,0 +1,183 @@
+package session
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrBindingMismatch session绑定的客户端信息与请求不一致
+var ErrBindingMismatch = errors.New("scs: session binding mismatch")
+
+// 绑定信息在data中的键
+const (
+	bindIPKey = internalKeyPrefix + "bind_ip"
+	bindUAKey = internalKeyPrefix + "bind_ua"
+)
+
+// MismatchMode 绑定信息不一致时的处理方式
+type MismatchMode int
+
+const (
+	// MismatchReject 拒绝，Load返回ErrBindingMismatch
+	MismatchReject MismatchMode = iota
+	// MismatchRegenerate 丢弃请求中的session，重新生成一个
+	MismatchRegenerate
+)
+
+// ClientIP 获取请求的客户端ip
+// 只有当RemoteAddr属于可信代理时，才会使用X-Forwarded-For和X-Real-IP
+func (m *Manager) ClientIP(r *http.Request) string {
+	ip := m.clientIP(r)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+func (m *Manager) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !m.opts.isTrustedProxy(ip) {
+		return ip
+	}
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		// 从右往左，取第一个不是可信代理的地址
+		parts := strings.Split(xff, ",")
+		for i := len(parts) - 1; i >= 0; i-- {
+			p := net.ParseIP(strings.TrimSpace(parts[i]))
+			if p == nil {
+				break
+			}
+			ip = p
+			if !m.opts.isTrustedProxy(p) {
+				break
+			}
+		}
+		return ip
+	}
+	if xr := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); xr != nil {
+		return xr
+	}
+	return ip
+}
+
+// bindingIP 按照设置的位数截取ip网段，未开启ip绑定时返回空
+func (m *Manager) bindingIP(r *http.Request) string {
+	if m.opts.bindIPv4Bits <= 0 && m.opts.bindIPv6Bits <= 0 {
+		return ""
+	}
+	ip := m.clientIP(r)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		if m.opts.bindIPv4Bits <= 0 {
+			return ""
+		}
+		mask := net.CIDRMask(m.opts.bindIPv4Bits, 32)
+		return ip4.Mask(mask).String() + "/" + strconv.Itoa(m.opts.bindIPv4Bits)
+	}
+	if m.opts.bindIPv6Bits <= 0 {
+		return ""
+	}
+	mask := net.CIDRMask(m.opts.bindIPv6Bits, 128)
+	return ip.Mask(mask).String() + "/" + strconv.Itoa(m.opts.bindIPv6Bits)
+}
+
+// bindingUA User-Agent指纹，未开启User-Agent绑定时返回空
+func (m *Manager) bindingUA(r *http.Request) string {
+	if !m.opts.bindUA {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(r.UserAgent()))
+	return hex.EncodeToString(sum[:16])
+}
+
+// bind 将请求的客户端信息绑定到session
+func (m *Manager) bind(r *http.Request, s *Session) {
+	ip, ua := m.bindingIP(r), m.bindingUA(r)
+	if ip == "" && ua == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ip != "" {
+		s.data[bindIPKey] = ip
+	}
+	if ua != "" {
+		s.data[bindUAKey] = ua
+	}
+}
+
+// checkBinding 检查session绑定的客户端信息是否与请求一致
+// 没有绑定信息的session(如NewSession创建的、开启绑定之前创建的)，在这里进行绑定，bound表示是否新增了绑定信息
+func (m *Manager) checkBinding(r *http.Request, s *Session) (ok, bound bool) {
+	ip, ua := m.bindingIP(r), m.bindingUA(r)
+	if ip == "" && ua == "" {
+		return true, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ip != "" {
+		v, ok := s.data[bindIPKey].(string)
+		if ok && v != ip {
+			return false, false
+		}
+		bound = bound || !ok
+		s.data[bindIPKey] = ip
+	}
+	if ua != "" {
+		v, ok := s.data[bindUAKey].(string)
+		if ok && v != ua {
+			return false, false
+		}
+		bound = bound || !ok
+		s.data[bindUAKey] = ua
+	}
+	return true, bound
+}
+
+// isTrustedProxy ip是否为可信代理
+func (o *Options) isTrustedProxy(ip net.IP) bool {
+	for _, n := range o.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies 解析可信代理，支持CIDR和单个ip
+func parseTrustedProxies(proxies []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				log.Printf("scs: invalid trusted proxy %q", p)
+				continue
+			}
+			if ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			log.Printf("scs: invalid trusted proxy %q: %v", p, err)
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
@@ -0,0 +1,114 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ipiao/session/stores/memstore"
+)
+
+func TestClientIP(t *testing.T) {
+	m := NewManager(memstore.New(0), TrustedProxies("10.0.0.0/8", "::1"))
+
+	tests := []struct {
+		remoteAddr string
+		xff        string
+		xRealIP    string
+		expected   string
+	}{
+		{"1.2.3.4:1234", "", "", "1.2.3.4"},
+		{"1.2.3.4:1234", "5.6.7.8", "", "1.2.3.4"},
+		{"10.0.0.1:1234", "5.6.7.8", "", "5.6.7.8"},
+		{"10.0.0.1:1234", "9.9.9.9, 5.6.7.8, 10.0.0.2", "", "5.6.7.8"},
+		{"10.0.0.1:1234", "", "5.6.7.8", "5.6.7.8"},
+		{"[::1]:1234", "2001:db8::1", "", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if tt.xRealIP != "" {
+			r.Header.Set("X-Real-IP", tt.xRealIP)
+		}
+		if ip := m.ClientIP(r); ip != tt.expected {
+			t.Fatalf("%v: got %q: expected %q", tt, ip, tt.expected)
+		}
+	}
+}
+
+func TestBinding(t *testing.T) {
+	m := NewManager(memstore.New(0), BindIP(24, 64), BindUserAgent(true))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "1.2.3.4:1234"
+	r.Header.Set("User-Agent", "agent")
+	s, err := m.Load(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	if err = s.WriteToResponseWriter(w); err != nil {
+		t.Fatal(err)
+	}
+	cookie := w.Result().Cookies()[0]
+
+	load := func(remoteAddr, ua string) (*Session, error) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("User-Agent", ua)
+		r.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+		return m.LoadIM(r)
+	}
+
+	if s2, err := load("1.2.3.99:4321", "agent"); err != nil || s2.GetID() != s.GetID() {
+		t.Fatalf("got %v: expected the same session in the same /24", err)
+	}
+	if _, err := load("1.2.4.4:1234", "agent"); err != ErrBindingMismatch {
+		t.Fatalf("got %v: expected %v", err, ErrBindingMismatch)
+	}
+	if _, err := load("1.2.3.4:1234", "other agent"); err != ErrBindingMismatch {
+		t.Fatalf("got %v: expected %v", err, ErrBindingMismatch)
+	}
+
+	m.Option(BindMismatch(MismatchRegenerate))
+	s3, err := load("1.2.4.4:1234", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s3.GetID() == s.GetID() {
+		t.Fatal("expected a regenerated session")
+	}
+}
+
+// TestBindingLegacy 开启绑定之前创建的session，第一次加载时写入绑定信息
+func TestBindingLegacy(t *testing.T) {
+	store := memstore.New(0)
+	s, _ := NewManager(store).NewSession()
+	if err := s.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, deferWrite := range []bool{true, false} {
+		m := NewManager(store, BindUserAgent(true), DeferWrite(deferWrite))
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("User-Agent", "agent")
+		r.AddCookie(&http.Cookie{Name: defaultName, Value: s.GetToken()})
+		ls, err := m.LoadIM(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deferWrite {
+			if !ls.Dirty() {
+				t.Fatal("expected the binding to be committed with the session")
+			}
+			continue
+		}
+		b, _, _ := store.Find(s.GetToken())
+		if _, data, _, _ := m.opts.codec.Decode(b); data[bindUAKey] == nil {
+			t.Fatal("expected the binding to be saved")
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"time"
+)
+
+// ErrConflict session在读取之后被其它请求修改，保存失败
+var ErrConflict = errors.New("scs: session was modified by another request")
+
+// CASStore 支持乐观并发控制的存储器
+// 每次保存成功后版本号加1，不存在的session版本号为0
+type CASStore interface {
+	// FindVersion 返回数据和版本号
+	FindVersion(ctx context.Context, token string) (b []byte, version int64, found bool, err error)
+	// SaveIfVersion 存储器中的版本号等于version时保存，返回新的版本号
+	// 版本号不一致时ok为false，不返回错误
+	SaveIfVersion(ctx context.Context, token string, b []byte, expiry time.Time, version int64) (newVersion int64, ok bool, err error)
+}
+
+// ConflictMode 使用CASStore时，保存冲突的处理方式
+type ConflictMode int
+
+const (
+	// ConflictOff 不使用乐观锁，后写入的覆盖先写入的，默认方式
+	ConflictOff ConflictMode = iota
+	// ConflictFail 返回ErrConflict
+	ConflictFail
+	// ConflictMerge 重新读取存储器中的数据，应用本次请求的修改之后重试
+	// 同一个键被同时修改时，本次请求的值覆盖其它请求的值
+	ConflictMerge
+)
+
+// maxMergeRetries ConflictMerge的最大重试次数，超过之后返回ErrConflict
+const maxMergeRetries = 3
+
+// casStore 返回乐观锁使用的存储器，未开启或者存储器不支持时返回false
+// 装饰器包装的存储器不支持时，FindVersion和SaveIfVersion返回errors.ErrUnsupported，按不支持处理
+func (o *Options) casStore(store Store) (CASStore, bool) {
+	if o.conflictMode == ConflictOff {
+		return nil, false
+	}
+	cs, ok := store.(CASStore)
+	return cs, ok
+}
+
+// saveCAS 按版本号保存，调用时需要持有s.mu
+func (s *Session) saveCAS(cs CASStore, j []byte, expiry time.Time) error {
+	ctx := s.getContext()
+	for i := 0; ; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		start := time.Now()
+		version, ok, err := cs.SaveIfVersion(ctx, s.token, j, expiry, s.version)
+		if errors.Is(err, errors.ErrUnsupported) {
+			return s.storeCtx().SaveCtx(ctx, s.token, j, expiry)
+		}
+		s.stats.observe(OpSave, start, err)
+		if err != nil {
+			return err
+		}
+		if ok {
+			s.version = version
+			s.base = copyData(s.data)
+			return nil
+		}
+		if s.opts.conflictMode != ConflictMerge || i >= maxMergeRetries {
+			return ErrConflict
+		}
+		err = s.merge(ctx, cs)
+		if err != nil {
+			return err
+		}
+		j, err = s.opts.codec.Encode(s.id, s.data, s.deadline)
+		if err != nil {
+			return err
+		}
+		expiry = s.expiry()
+	}
+}
+
+// merge 读取存储器中最新的数据，重新应用本次请求的修改，调用时需要持有s.mu
+// 本次请求的修改为data相对于base(上次读取或保存时的data)的变化
+func (s *Session) merge(ctx context.Context, cs CASStore) error {
+	start := time.Now()
+	b, version, found, err := cs.FindVersion(ctx, s.token)
+	s.stats.observe(OpFind, start, err)
+	if err != nil {
+		return err
+	}
+	// 已经被其它请求销毁，不能复活
+	if !found {
+		return ErrConflict
+	}
+	_, latest, _, err := s.opts.codec.Decode(b)
+	if err != nil {
+		return err
+	}
+	base := copyData(latest)
+	s.applyChanges(latest)
+	s.replaceData(latest)
+	s.base = base
+	s.version = version
+	return nil
+}
+
+// refresh 存储器中的版本比内存中的新时，使用存储器中的数据，调用时需要持有s.mu
+// 延迟写入模式下有未提交的修改时，在存储器的数据上重新应用这些修改，并保留本地的过期时间
+func (s *Session) refresh(data map[string]interface{}, deadline time.Time, version int64) {
+	if version == s.version {
+		return
+	}
+	base := copyData(data)
+	if s.dirty {
+		s.applyChanges(data)
+	} else {
+		s.deadline = deadline
+	}
+	s.replaceData(data)
+	s.base = base
+	s.version = version
+}
+
+// applyChanges 将本次请求的修改(data相对于base的变化)应用到latest上，调用时需要持有s.mu
+func (s *Session) applyChanges(latest map[string]interface{}) {
+	for k, v := range s.data {
+		if bv, ok := s.base[k]; !ok || !reflect.DeepEqual(bv, v) {
+			latest[k] = v
+		}
+	}
+	for k := range s.base {
+		if _, ok := s.data[k]; !ok {
+			delete(latest, k)
+		}
+	}
+}
+
+// replaceData 原地替换data，与s共享sessionState的session都能看到，调用时需要持有s.mu
+func (s *Session) replaceData(data map[string]interface{}) {
+	for k := range s.data {
+		delete(s.data, k)
+	}
+	for k, v := range data {
+		s.data[k] = v
+	}
+}
+
+func copyData(data map[string]interface{}) map[string]interface{} {
+	ret := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		ret[k] = v
+	}
+	return ret
+}
@@ -0,0 +1,227 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipiao/session/stores/memstore"
+)
+
+// versionStore 在memstore上实现CASStore
+type versionStore struct {
+	*memstore.MemStore
+	mu       sync.Mutex
+	versions map[string]int64
+}
+
+func newVersionStore() *versionStore {
+	return &versionStore{MemStore: memstore.New(0), versions: make(map[string]int64)}
+}
+
+func (s *versionStore) FindVersion(ctx context.Context, token string) ([]byte, int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, found, err := s.FindCtx(ctx, token)
+	if err != nil || !found {
+		return nil, 0, false, err
+	}
+	return b, s.versions[token], true, nil
+}
+
+func (s *versionStore) SaveIfVersion(ctx context.Context, token string, b []byte, expiry time.Time, version int64) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, found, err := s.FindCtx(ctx, token)
+	if err != nil {
+		return 0, false, err
+	}
+	var current int64
+	if found {
+		current = s.versions[token]
+	}
+	if current != version {
+		return 0, false, nil
+	}
+	if err = s.SaveCtx(ctx, token, b, expiry); err != nil {
+		return 0, false, err
+	}
+	s.versions[token] = version + 1
+	return version + 1, true, nil
+}
+
+func (s *versionStore) DeleteCtx(ctx context.Context, token string) error {
+	s.mu.Lock()
+	delete(s.versions, token)
+	s.mu.Unlock()
+	return s.MemStore.DeleteCtx(ctx, token)
+}
+
+// loadWith 模拟另一个实例，不从manager中查找
+func loadWith(t *testing.T, m *Manager, token string) *Session {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: defaultName, Value: token})
+	s, err := m.LoadIM(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestOptimisticLockFail(t *testing.T) {
+	m := NewManager(newVersionStore(), OptimisticLock(ConflictFail))
+	s, _ := m.NewSession()
+	if err := s.Put("a", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	s1 := loadWith(t, m, s.GetToken())
+	s2 := loadWith(t, m, s.GetToken())
+	if err := s1.Put("b", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.Put("c", 3); !errors.Is(err, ErrConflict) {
+		t.Fatalf("got %v: expected %v", err, ErrConflict)
+	}
+
+	s3 := loadWith(t, m, s.GetToken())
+	if v, _ := s3.GetInt("b"); v != 2 {
+		t.Fatalf("got %d: expected the first write to be kept", v)
+	}
+	if ok, _ := s3.Exists("c"); ok {
+		t.Fatal("expected the conflicting write to be rejected")
+	}
+}
+
+func TestOptimisticLockMerge(t *testing.T) {
+	m := NewManager(newVersionStore(), OptimisticLock(ConflictMerge))
+	s, _ := m.NewSession()
+	if err := s.Put("a", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("shared", "old"); err != nil {
+		t.Fatal(err)
+	}
+
+	s1 := loadWith(t, m, s.GetToken())
+	s2 := loadWith(t, m, s.GetToken())
+	if err := s1.Put("b", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s1.Put("shared", "first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s1.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.Put("c", 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.Put("shared", "second"); err != nil {
+		t.Fatal(err)
+	}
+
+	s3 := loadWith(t, m, s.GetToken())
+	if ok, _ := s3.Exists("a"); ok {
+		t.Fatal("expected the removal by the other request to be kept")
+	}
+	if v, _ := s3.GetInt("b"); v != 2 {
+		t.Fatalf("got %d: expected the write of the other request to be kept", v)
+	}
+	if v, _ := s3.GetInt("c"); v != 3 {
+		t.Fatalf("got %d: expected the merged write", v)
+	}
+	if v, _ := s3.GetString("shared"); v != "second" {
+		t.Fatalf("got %q: expected the last write to win", v)
+	}
+}
+
+// TestOptimisticLockRefresh manager中已经加载的session在存储器中的版本更新后重新读取
+func TestOptimisticLockRefresh(t *testing.T) {
+	store := newVersionStore()
+	m1 := NewManager(store, OptimisticLock(ConflictFail))
+	m2 := NewManager(store, OptimisticLock(ConflictFail))
+	s, _ := m1.NewSession()
+	if err := s.Put("n", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loadWith(t, m2, s.GetToken()).Put("n", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: defaultName, Value: s.GetToken()})
+	ms, err := m1.Load(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ms.sessionState != s.sessionState {
+		t.Fatal("expected the session registered in the manager")
+	}
+	if v, _ := ms.GetInt("n"); v != 2 {
+		t.Fatalf("got %d: expected the data saved by the other manager", v)
+	}
+	if err := ms.Put("n", 3); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOptimisticLockDestroyed(t *testing.T) {
+	m := NewManager(newVersionStore(), OptimisticLock(ConflictMerge))
+	s, _ := m.NewSession()
+	if err := s.Put("a", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	s1 := loadWith(t, m, s.GetToken())
+	if err := loadWith(t, m, s.GetToken()).Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s1.Put("b", 2); !errors.Is(err, ErrConflict) {
+		t.Fatalf("got %v: expected %v", err, ErrConflict)
+	}
+	if _, found, _ := m.store.(*versionStore).Find(s.GetToken()); found {
+		t.Fatal("expected a destroyed session not to be saved again")
+	}
+}
+
+// TestOptimisticLockRefreshDirty 延迟写入时未提交的修改在刷新之后保留
+func TestOptimisticLockRefreshDirty(t *testing.T) {
+	store := newVersionStore()
+	m1 := NewManager(store, OptimisticLock(ConflictFail), DeferWrite(true))
+	m2 := NewManager(store, OptimisticLock(ConflictFail))
+	s, _ := m1.NewSession()
+	s.Put("n", 1)
+	if err := s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loadWith(t, m2, s.GetToken()).Put("other", "x"); err != nil {
+		t.Fatal(err)
+	}
+	s.Put("n", 2)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: defaultName, Value: s.GetToken()})
+	ms, err := m1.Load(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := ms.GetInt("n"); v != 2 {
+		t.Fatalf("got %d: expected the uncommitted change to be kept", v)
+	}
+	if v, _ := ms.GetString("other"); v != "x" {
+		t.Fatalf("got %q: expected the data saved by the other manager", v)
+	}
+	if err := ms.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := loadWith(t, m2, s.GetToken()).GetString("other"); v != "x" {
+		t.Fatalf("got %q: expected the other change to be kept in the store", v)
+	}
+}
@@ -0,0 +1,185 @@
+package session
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+func init() {
+	// gob编码interface{}时需要注册具体类型，这里注册session中常用的类型
+	gob.Register(time.Time{})
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+}
+
+// Codec session数据的编解码器
+// 存储器中保存的是Codec编码后的id、data和deadline
+type Codec interface {
+	Encode(id string, data map[string]interface{}, deadline time.Time) ([]byte, error)
+	Decode(b []byte) (id string, data map[string]interface{}, deadline time.Time, err error)
+}
+
+// JSONCodec JSON编解码器，默认使用
+// 解码后数值为json.Number，time.Time为RFC3339字符串，[]byte为base64字符串
+type JSONCodec struct{}
+
+// Encode 编码
+func (JSONCodec) Encode(id string, data map[string]interface{}, deadline time.Time) ([]byte, error) {
+	return json.Marshal(&struct {
+		Data     map[string]interface{} `json:"data"`
+		Deadline int64                  `json:"deadline"`
+		ID       string                 `json:"id"`
+	}{
+		Data:     data,
+		Deadline: deadline.UnixNano(),
+		ID:       id,
+	})
+}
+
+// Decode 解码
+func (JSONCodec) Decode(b []byte) (string, map[string]interface{}, time.Time, error) {
+	aux := struct {
+		Data     map[string]interface{} `json:"data"`
+		Deadline int64                  `json:"deadline"`
+		ID       string                 `json:"id"`
+	}{}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	err := dec.Decode(&aux)
+	if err != nil {
+		return "", nil, time.Time{}, err
+	}
+	return aux.ID, aux.Data, time.Unix(0, aux.Deadline), nil
+}
+
+// gobSession gob编码的结构，字段必须导出
+type gobSession struct {
+	ID       string
+	Data     map[string]interface{}
+	Deadline int64
+}
+
+// GobCodec gob编解码器，能够还原存入时的Go类型
+// 自定义类型需要先调用gob.Register注册
+type GobCodec struct{}
+
+// Encode 编码
+func (GobCodec) Encode(id string, data map[string]interface{}, deadline time.Time) ([]byte, error) {
+	return gobEncode(&gobSession{
+		ID:       id,
+		Data:     data,
+		Deadline: deadline.UnixNano(),
+	})
+}
+
+// Decode 解码
+func (GobCodec) Decode(b []byte) (string, map[string]interface{}, time.Time, error) {
+	var aux gobSession
+	err := gobDecode(b, &aux)
+	if err != nil {
+		return "", nil, time.Time{}, err
+	}
+	if aux.Data == nil {
+		aux.Data = make(map[string]interface{})
+	}
+	return aux.ID, aux.Data, time.Unix(0, aux.Deadline), nil
+}
+
+// MsgpackCodec MessagePack编解码器
+// time.Time和[]byte能够还原，整数统一解码为int64(超出int64范围的为uint64)，浮点数解码为float64
+type MsgpackCodec struct{}
+
+type msgpackSession struct {
+	ID       string                 `msgpack:"id"`
+	Data     map[string]interface{} `msgpack:"data"`
+	Deadline int64                  `msgpack:"deadline"`
+}
+
+// Encode 编码
+func (MsgpackCodec) Encode(id string, data map[string]interface{}, deadline time.Time) ([]byte, error) {
+	return msgpack.Marshal(&msgpackSession{
+		ID:       id,
+		Data:     data,
+		Deadline: deadline.UnixNano(),
+	})
+}
+
+// Decode 解码
+func (MsgpackCodec) Decode(b []byte) (string, map[string]interface{}, time.Time, error) {
+	var aux msgpackSession
+	dec := msgpack.NewDecoder(bytes.NewReader(b))
+	dec.UseDecodeInterfaceLoose(true)
+	err := dec.Decode(&aux)
+	if err != nil {
+		return "", nil, time.Time{}, err
+	}
+	if aux.Data == nil {
+		aux.Data = make(map[string]interface{})
+	}
+	for k, v := range aux.Data {
+		aux.Data[k] = msgpackNormalize(v)
+	}
+	return aux.ID, aux.Data, time.Unix(0, aux.Deadline), nil
+}
+
+// msgpackNormalize msgpack将time.Time解码为*time.Time，这里还原为time.Time
+func msgpackNormalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case *time.Time:
+		if v != nil {
+			return *v
+		}
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = msgpackNormalize(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = msgpackNormalize(e)
+		}
+	}
+	return v
+}
+
+// MigrateCodec 返回用于编解码器迁移的Codec
+// 编码使用codec，解码时依次尝试codec和oldCodecs，用于读取旧编解码器写入的数据
+// 旧数据在下一次写入时会以新的编码保存
+func MigrateCodec(codec Codec, oldCodecs ...Codec) Codec {
+	return &migrateCodec{
+		codecs: append([]Codec{codec}, oldCodecs...),
+	}
+}
+
+type migrateCodec struct {
+	codecs []Codec
+}
+
+func (c *migrateCodec) Encode(id string, data map[string]interface{}, deadline time.Time) ([]byte, error) {
+	return c.codecs[0].Encode(id, data, deadline)
+}
+
+func (c *migrateCodec) Decode(b []byte) (id string, data map[string]interface{}, deadline time.Time, err error) {
+	for _, codec := range c.codecs {
+		id, data, deadline, err = codec.Decode(b)
+		if err == nil {
+			return
+		}
+	}
+	return "", nil, time.Time{}, fmt.Errorf("scs: data can not be decoded by any codec, last error:%v", err)
+}
+
+// DecodeTokenExpiry 返回从编码数据中解码token和过期时间的函数，用于migratestore等只能读取编码数据的存储器
+// token为session的id，与Loads预热时相同，token被RenewToken更换后与id不同，此时返回的token是错误的；
+// 过期时间为session的deadline，不包括空闲超时
+func DecodeTokenExpiry(codec Codec) func(b []byte) (token string, expiry time.Time, err error) {
+	return func(b []byte) (string, time.Time, error) {
+		id, _, deadline, err := codec.Decode(b)
+		return id, deadline, err
+	}
+}
@@ -0,0 +1,101 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	now := time.Now().Round(0)
+	data := map[string]interface{}{
+		"string": "lorem ipsum",
+		"int":    42,
+		"float":  3.14,
+		"bool":   true,
+		"time":   now,
+		"bytes":  []byte("encoded_data"),
+	}
+	deadline := now.Add(time.Hour)
+
+	for name, codec := range map[string]Codec{"gob": GobCodec{}, "msgpack": MsgpackCodec{}} {
+		b, err := codec.Encode("session_id", data, deadline)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		id, got, d, err := codec.Decode(b)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if id != "session_id" {
+			t.Fatalf("%s: got %v: expected %v", name, id, "session_id")
+		}
+		if !d.Equal(deadline) {
+			t.Fatalf("%s: got %v: expected %v", name, d, deadline)
+		}
+		if got["string"] != "lorem ipsum" || got["float"] != 3.14 || got["bool"] != true {
+			t.Fatalf("%s: got %v: expected %v", name, got, data)
+		}
+		if tm, ok := got["time"].(time.Time); !ok || !tm.Equal(now) {
+			t.Fatalf("%s: got %T %v: expected %v", name, got["time"], got["time"], now)
+		}
+		if bs, ok := got["bytes"].([]byte); !ok || !bytes.Equal(bs, []byte("encoded_data")) {
+			t.Fatalf("%s: got %T %v: expected %v", name, got["bytes"], got["bytes"], []byte("encoded_data"))
+		}
+	}
+
+	_, got, _, err := GobCodec{}.Decode(mustEncode(t, GobCodec{}, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["int"] != 42 {
+		t.Fatalf("got %T %v: expected %v", got["int"], got["int"], 42)
+	}
+	_, got, _, err = MsgpackCodec{}.Decode(mustEncode(t, MsgpackCodec{}, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["int"] != int64(42) {
+		t.Fatalf("got %T %v: expected %v", got["int"], got["int"], int64(42))
+	}
+}
+
+func TestMigrateCodec(t *testing.T) {
+	deadline := time.Now().Add(time.Hour)
+	old := mustEncode(t, JSONCodec{}, map[string]interface{}{"int": 42})
+
+	codec := MigrateCodec(GobCodec{}, JSONCodec{})
+	id, data, _, err := codec.Decode(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "session_id" || data["int"] != json.Number("42") {
+		t.Fatalf("got %v %v: expected %v %v", id, data, "session_id", map[string]interface{}{"int": 42})
+	}
+
+	b, err := codec.Encode(id, map[string]interface{}{"int": 42}, deadline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, data, _, err = GobCodec{}.Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data["int"] != 42 {
+		t.Fatalf("got %T %v: expected %v", data["int"], data["int"], 42)
+	}
+
+	_, _, _, err = codec.Decode([]byte("not_encoded_data"))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func mustEncode(t *testing.T, codec Codec, data map[string]interface{}) []byte {
+	b, err := codec.Encode("session_id", data, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
@@ -0,0 +1,92 @@
+package session
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// errHeaderWritten 响应头已经写出，无法更新客户端存储的session
+var errHeaderWritten = errors.New("scs: response header already written, can not update client session")
+
+// commitWriter 延迟写入模式下包装http.ResponseWriter
+// 在写出响应头之前提交session，保证cookie能随响应头一起写出
+type commitWriter struct {
+	http.ResponseWriter
+	session     *Session
+	wroteHeader bool
+	err         error // 写出响应头之前提交的错误
+}
+
+// WriteHeader 提交session之后写出响应头
+func (cw *commitWriter) WriteHeader(code int) {
+	if !cw.wroteHeader {
+		cw.wroteHeader = true
+		cw.err = cw.commitHeader()
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+// Write 写出响应体，没有写出响应头时先写出
+func (cw *commitWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Flush 实现http.Flusher
+func (cw *commitWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap 返回原始的ResponseWriter，用于http.ResponseController
+func (cw *commitWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// commitHeader 写出响应头之前提交，写入存储器并且设置cookie
+func (cw *commitWriter) commitHeader() error {
+	if !cw.session.shouldWrite() {
+		return nil
+	}
+	return cw.session.WriteToResponseWriter(cw.ResponseWriter)
+}
+
+// commit 请求结束时提交
+// 响应头已经写出时，只能将之后的修改写入存储器
+func (cw *commitWriter) commit() error {
+	if !cw.wroteHeader {
+		cw.wroteHeader = true
+		return cw.commitHeader()
+	}
+	if cw.err != nil {
+		return cw.err
+	}
+	if !cw.session.Dirty() {
+		return nil
+	}
+	if _, ok := cw.session.store.(clientStore); ok {
+		return errHeaderWritten
+	}
+	return cw.session.Commit()
+}
+
+// shouldWrite 提交时是否需要写入：有未提交的修改，或者设置了闲置时间需要刷新过期时间
+// 没有修改过的新session不写入存储器
+func (s *Session) shouldWrite() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dirty {
+		return true
+	}
+	if s.isNew || s.token == "" {
+		return false
+	}
+	return s.idleTimeout() > 0 && s.lastAccessTime.Add(s.opts.touchInterval).Before(time.Now())
+}
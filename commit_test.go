@@ -0,0 +1,67 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ipiao/session/stores/memstore"
+)
+
+func TestDeferWrite(t *testing.T) {
+	m := NewManager(memstore.New(0), DeferWrite(true))
+
+	h := m.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, err := m.Load(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"a", "b", "c", "d", "e"} {
+			if err := s.Put(k, k); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !s.Dirty() {
+			t.Fatal("expected session to be dirty")
+		}
+		w.Write([]byte("ok"))
+		// 写出响应头之后的修改在请求结束时写入存储器
+		s.Put("f", "f")
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if n := m.Stat().StoreOps[OpSave].Count; n != 2 {
+		t.Fatalf("got %d saves: expected %d", n, 2)
+	}
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies: expected %d", len(cookies), 1)
+	}
+
+	// 未修改的session不访问存储器
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookies[0])
+	h = m.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, _ := m.Load(r)
+		if v, _ := s.GetString("f"); v != "f" {
+			t.Fatalf("got %q: expected %q", v, "f")
+		}
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if n := m.Stat().StoreOps[OpSave].Count; n != 2 {
+		t.Fatalf("got %d saves: expected %d", n, 2)
+	}
+
+	h = m.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if len(rr.Result().Cookies()) != 0 {
+		t.Fatalf("got %v: expected no cookie", rr.Result().Cookies())
+	}
+	if n := m.Stat().StoreOps[OpSave].Count; n != 2 {
+		t.Fatalf("got %d saves for an untouched new session: expected %d", n, 2)
+	}
+}
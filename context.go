@@ -0,0 +1,47 @@
+package session
+
+import (
+	"context"
+	"fmt"
+)
+
+// sessionName 请求上下文中session的key，按manager的名称区分，多个manager可以同时使用
+type sessionName string
+
+// NewContext 返回带有session的上下文，key为session所属manager的名称
+// Manager.Use已经把session放入请求上下文，一般只在不经过Use的代码(后台任务、测试)中使用
+func NewContext(ctx context.Context, s *Session) context.Context {
+	return context.WithValue(ctx, sessionName(s.opts.name), s)
+}
+
+// FromContext 从上下文中获取名称为name的manager放入的session
+// name为manager的名称(Manager.Name)，使用CookiePrefix时包含前缀
+// 取到的session可以直接读写，不需要*http.Request
+func FromContext(ctx context.Context, name string) (*Session, bool) {
+	s, ok := ctx.Value(sessionName(name)).(*Session)
+	return s, ok
+}
+
+// MustFromContext 与FromContext相同，上下文中没有session时panic
+func MustFromContext(ctx context.Context, name string) *Session {
+	s, ok := FromContext(ctx, name)
+	if !ok {
+		panic(fmt.Sprintf("scs: no session named %q in context", name))
+	}
+	return s
+}
+
+// Name 返回manager的名称，也是cookie的名称
+func (m *Manager) Name() string {
+	return m.opts.name
+}
+
+// FromContext 从上下文中获取m放入的session
+func (m *Manager) FromContext(ctx context.Context) (*Session, bool) {
+	return FromContext(ctx, m.opts.name)
+}
+
+// MustFromContext 与FromContext相同，上下文中没有session时panic
+func (m *Manager) MustFromContext(ctx context.Context) *Session {
+	return MustFromContext(ctx, m.opts.name)
+}
@@ -0,0 +1,84 @@
+package session
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ipiao/session/stores/memstore"
+)
+
+// addToCart 模拟服务层的函数，只依赖上下文
+func addToCart(ctx context.Context, item string) error {
+	s := MustFromContext(ctx, "cart")
+	items, _ := s.GetInt("items")
+	if err := s.Put("last", item); err != nil {
+		return err
+	}
+	return s.Put("items", items+1)
+}
+
+func TestFromContext(t *testing.T) {
+	auth := NewManager(memstore.New(0), Name("auth"))
+	cart := NewManager(memstore.New(0), Name("cart"))
+
+	var token string
+	h := auth.Use(cart.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		as, ok := auth.FromContext(r.Context())
+		if !ok {
+			t.Fatal("expected the auth session in context")
+		}
+		cs := cart.MustFromContext(r.Context())
+		if as == cs || as.GetToken() == cs.GetToken() {
+			t.Fatal("expected a session per manager")
+		}
+		if s, _ := FromContext(r.Context(), auth.Name()); s != as {
+			t.Fatal("expected FromContext by name to return the auth session")
+		}
+		if err := addToCart(r.Context(), "book"); err != nil {
+			t.Fatal(err)
+		}
+		token = cs.GetToken()
+	})))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "cart", Value: token})
+	s, err := cart.LoadIM(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := s.GetInt("items"); n != 1 {
+		t.Fatalf("got %d: expected the write through the context to be saved", n)
+	}
+
+	if _, ok := cart.FromContext(context.Background()); ok {
+		t.Fatal("expected no session in an empty context")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected MustFromContext to panic")
+		}
+	}()
+	MustFromContext(context.Background(), "cart")
+}
+
+func TestNewContext(t *testing.T) {
+	m := NewManager(memstore.New(0), CookiePrefix(SecurePrefix), Secure(true))
+	s, _ := m.NewSession()
+	ctx := NewContext(context.Background(), s)
+	if got, ok := m.FromContext(ctx); !ok || got != s {
+		t.Fatal("expected the session put by NewContext")
+	}
+	if _, ok := FromContext(ctx, defaultName); ok {
+		t.Fatalf("expected the name to include the cookie prefix %q", m.Name())
+	}
+
+	// Load使用上下文中的session
+	r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	if got, err := m.Load(r); err != nil || got != s {
+		t.Fatalf("got %v, %v: expected the session from context", got, err)
+	}
+}
@@ -3,11 +3,9 @@ package main
 import (
 	"io"
 	"log"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
 	"time"
 
@@ -21,7 +19,7 @@ var sessionManager *scs.Manager
 func main() {
 	store := memstore.New(time.Second * 30)
 	store.SetDumpFile("memdump.dmp")
-	sessionManager = scs.NewManager(store)
+	sessionManager = scs.NewManager(store, scs.BindIP(24, 64), scs.TrustedProxies("127.0.0.1"))
 	go notifySign()
 
 	sessionManager.Option(scs.Persist(true))
@@ -56,7 +54,7 @@ func getHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 	}
-	log.Println("realip:", realIp(r))
+	log.Println("realip:", sessionManager.ClientIP(r))
 	session.WriteToResponseWriter(w)
 	sessions := sessionManager.FindSeesion()
 	log.Println("GET:", len(sessions))
@@ -83,15 +81,3 @@ func notifySign() {
 		}
 	}()
 }
-
-func realIp(r *http.Request) string {
-	ra := r.RemoteAddr
-	if ip := r.Header.Get("X-Forwarded-For"); ip != "" {
-		ra = strings.Split(ip, ", ")[0]
-	} else if ip := r.Header.Get("X-Real-IP"); ip != "" {
-		ra = ip
-	} else {
-		ra, _, _ = net.SplitHostPort(ra)
-	}
-	return ra
-}
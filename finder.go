@@ -18,6 +18,8 @@ func MakeFinder(fds ...Finder) Finder {
 // FindByKVEq 按键值查找,值相等
 func FindByKVEq(key string, value interface{}) Finder {
 	return func(s *Session) bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
 		if v, ok := s.data[key]; ok {
 			return v == value
 		}
@@ -42,13 +44,20 @@ func FindTimeOut() Finder {
 // FindByID 按id查找
 func FindByID(id string) Finder {
 	return func(s *Session) bool {
-		return s.id == id
+		return s.GetID() == id
 	}
 }
 
 // FindByToken 按token查找
 func FindByToken(token string) Finder {
 	return func(s *Session) bool {
-		return s.token == token
+		return s.GetToken() == token
+	}
+}
+
+// FindByUserID 按用户查找
+func FindByUserID(userID string) Finder {
+	return func(s *Session) bool {
+		return s.GetUserID() == userID
 	}
 }
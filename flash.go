@@ -0,0 +1,144 @@
+package session
+
+import (
+	"net/http"
+	"reflect"
+)
+
+// flashKey flash消息保存在data中的键
+const flashKey = internalKeyPrefix + "flash"
+
+// FlashLevel flash消息的级别
+type FlashLevel string
+
+// 内置的flash消息级别，也可以使用自定义级别
+const (
+	FlashInfo    FlashLevel = "info"
+	FlashSuccess FlashLevel = "success"
+	FlashWarning FlashLevel = "warning"
+	FlashError   FlashLevel = "error"
+)
+
+// Flash 一次性消息，读取之后即被删除
+type Flash struct {
+	Level   FlashLevel `json:"level"`
+	Message string     `json:"message"`
+}
+
+// AddFlash 添加一条flash消息，消息会一直保留到被Flashes读取，通常是重定向之后的下一个请求
+func (s *Session) AddFlash(level FlashLevel, msg string) error {
+	s.addFlash(level, msg)
+	return s.write()
+}
+
+// Flashes 读取并删除flash消息，按添加的顺序返回
+// 指定levels时只读取这些级别的消息，其它级别的消息保留
+func (s *Session) Flashes(levels ...FlashLevel) ([]Flash, error) {
+	fs, changed, err := s.popFlashes(levels)
+	if err != nil || !changed {
+		return fs, err
+	}
+	return fs, s.write()
+}
+
+// PeekFlashes 读取flash消息但不删除，消息保留到下一个请求
+func (s *Session) PeekFlashes(levels ...FlashLevel) ([]Flash, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fs, err := s.flashes()
+	if err != nil {
+		return nil, err
+	}
+	ret, _ := splitFlashes(fs, levels)
+	return ret, nil
+}
+
+// AddFlashToResponseWriter 添加一条flash消息，并写入到返回中
+// 配合cookiestore使用时，消息随重定向的cookie保存到下一个请求
+func (s *Session) AddFlashToResponseWriter(w http.ResponseWriter, level FlashLevel, msg string) error {
+	s.addFlash(level, msg)
+	return s.WriteToResponseWriter(w)
+}
+
+// FlashesFromResponseWriter 读取并删除flash消息，并写入到返回中
+func (s *Session) FlashesFromResponseWriter(w http.ResponseWriter, levels ...FlashLevel) ([]Flash, error) {
+	fs, changed, err := s.popFlashes(levels)
+	if err != nil || !changed {
+		return fs, err
+	}
+	return fs, s.WriteToResponseWriter(w)
+}
+
+func (s *Session) addFlash(level FlashLevel, msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// 以map和slice保存，保证各种编解码器都可以编解码
+	list, _ := s.data[flashKey].([]interface{})
+	s.data[flashKey] = append(list, map[string]interface{}{
+		"level":   string(level),
+		"message": msg,
+	})
+}
+
+// popFlashes 取出flash消息，changed表示data是否被修改
+func (s *Session) popFlashes(levels []FlashLevel) (ret []Flash, changed bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fs, err := s.flashes()
+	if err != nil || len(fs) == 0 {
+		return nil, false, err
+	}
+	ret, rest := splitFlashes(fs, levels)
+	if len(ret) == 0 {
+		return nil, false, nil
+	}
+	if len(rest) == 0 {
+		delete(s.data, flashKey)
+		return ret, true, nil
+	}
+	list := make([]interface{}, 0, len(rest))
+	for _, f := range rest {
+		list = append(list, map[string]interface{}{
+			"level":   string(f.Level),
+			"message": f.Message,
+		})
+	}
+	s.data[flashKey] = list
+	return ret, true, nil
+}
+
+// flashes 解析data中的flash消息，调用时需要持有s.mu
+func (s *Session) flashes() ([]Flash, error) {
+	v, ok := s.data[flashKey]
+	if !ok {
+		return nil, nil
+	}
+	var fs []Flash
+	err := convertValue(reflect.ValueOf(&fs).Elem(), v)
+	if err != nil {
+		return nil, &TypeError{Key: flashKey, Value: v, Type: reflect.TypeOf(fs), Err: err}
+	}
+	return fs, nil
+}
+
+// splitFlashes 按级别拆分消息，levels为空时全部选中
+func splitFlashes(fs []Flash, levels []FlashLevel) (selected, rest []Flash) {
+	if len(levels) == 0 {
+		return fs, nil
+	}
+	for _, f := range fs {
+		var match bool
+		for _, l := range levels {
+			if f.Level == l {
+				match = true
+				break
+			}
+		}
+		if match {
+			selected = append(selected, f)
+		} else {
+			rest = append(rest, f)
+		}
+	}
+	return selected, rest
+}
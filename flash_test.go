@@ -0,0 +1,86 @@
+package session
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/ipiao/session/stores/memstore"
+)
+
+func TestFlashes(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec{}, GobCodec{}, MsgpackCodec{}} {
+		m := NewManager(memstore.New(0), UseCodec(codec))
+		s, _ := m.NewSession()
+		s.AddFlash(FlashSuccess, "saved")
+		s.AddFlash(FlashError, "failed")
+		s.AddFlash(FlashInfo, "hello")
+
+		// 模拟下一个请求从存储器中加载
+		b, _, _ := s.store.Find(s.GetToken())
+		s, err := m.decodeSession(context.Background(), s.GetToken(), b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys, _ := s.Keys()
+		if len(keys) != 0 {
+			t.Fatalf("%T: got keys %v: expected flashes to be hidden", codec, keys)
+		}
+
+		fs, err := s.Flashes(FlashError)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(fs, []Flash{{FlashError, "failed"}}) {
+			t.Fatalf("%T: got %v: expected the error flash", codec, fs)
+		}
+		fs, err = s.PeekFlashes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fs) != 2 {
+			t.Fatalf("%T: got %v: expected 2 flashes", codec, fs)
+		}
+		fs, _ = s.Flashes()
+		if !reflect.DeepEqual(fs, []Flash{{FlashSuccess, "saved"}, {FlashInfo, "hello"}}) {
+			t.Fatalf("%T: got %v: expected flashes in order", codec, fs)
+		}
+		fs, _ = s.Flashes()
+		if len(fs) != 0 {
+			t.Fatalf("%T: got %v: expected no flashes", codec, fs)
+		}
+	}
+}
+
+func TestFlashesCookieRedirect(t *testing.T) {
+	m := NewCookieManager("u46IpCV9y5Vlur8YvODJEhgOY8m9JVE4")
+
+	rr := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/save", nil)
+	s, err := m.Load(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddFlashToResponseWriter(rr, FlashSuccess, "saved"); err != nil {
+		t.Fatal(err)
+	}
+	http.Redirect(rr, r, "/", http.StatusSeeOther)
+
+	r = httptest.NewRequest("GET", "/", nil)
+	for _, c := range rr.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	s, err = m.LoadIM(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := s.FlashesFromResponseWriter(httptest.NewRecorder())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fs, []Flash{{FlashSuccess, "saved"}}) {
+		t.Fatalf("got %v: expected the flash to survive the redirect", fs)
+	}
+}
@@ -0,0 +1,116 @@
+package session
+
+import (
+	"net/http"
+	"sync"
+)
+
+// Hook session生命周期钩子
+// r为触发事件的请求，事件不是由请求触发时(如gc、直接调用NewSession)为nil
+// 钩子同步执行，不要在钩子中做耗时的操作
+type Hook func(s *Session, r *http.Request)
+
+// RenewHook token重建钩子，oldToken为重建前的token
+type RenewHook func(s *Session, r *http.Request, oldToken string)
+
+// hooks manager注册的钩子，和session共享
+type hooks struct {
+	mu        sync.RWMutex
+	onCreate  []Hook
+	onLoad    []Hook
+	onSave    []Hook
+	onDestroy []Hook
+	onExpire  []Hook
+	onRenew   []RenewHook
+}
+
+// run 执行钩子
+func (h *hooks) run(list *[]Hook, s *Session, r *http.Request) {
+	h.mu.RLock()
+	fns := *list
+	h.mu.RUnlock()
+	for _, fn := range fns {
+		fn(s, r)
+	}
+}
+
+func (h *hooks) runRenew(s *Session, r *http.Request, oldToken string) {
+	if h == nil {
+		return
+	}
+	h.mu.RLock()
+	fns := h.onRenew
+	h.mu.RUnlock()
+	for _, fn := range fns {
+		fn(s, r, oldToken)
+	}
+}
+
+func (h *hooks) created(s *Session, r *http.Request) {
+	if h != nil {
+		h.run(&h.onCreate, s, r)
+	}
+}
+
+func (h *hooks) loaded(s *Session, r *http.Request) {
+	if h != nil {
+		h.run(&h.onLoad, s, r)
+	}
+}
+
+func (h *hooks) saved(s *Session, r *http.Request) {
+	if h != nil {
+		h.run(&h.onSave, s, r)
+	}
+}
+
+func (h *hooks) destroyed(s *Session, r *http.Request) {
+	if h != nil {
+		h.run(&h.onDestroy, s, r)
+	}
+}
+
+func (h *hooks) expired(s *Session) {
+	if h != nil {
+		h.run(&h.onExpire, s, nil)
+	}
+}
+
+func (h *hooks) add(list *[]Hook, fn Hook) {
+	h.mu.Lock()
+	*list = append(*list, fn)
+	h.mu.Unlock()
+}
+
+// OnCreate 注册session创建钩子
+func (m *Manager) OnCreate(fn Hook) {
+	m.hooks.add(&m.hooks.onCreate, fn)
+}
+
+// OnLoad 注册session加载钩子，从manager或者存储器中加载到已存在的session时触发
+func (m *Manager) OnLoad(fn Hook) {
+	m.hooks.add(&m.hooks.onLoad, fn)
+}
+
+// OnSave 注册session写入钩子，写入存储器成功后触发
+func (m *Manager) OnSave(fn Hook) {
+	m.hooks.add(&m.hooks.onSave, fn)
+}
+
+// OnDestroy 注册session销毁钩子，Session.Destroy或者登录踢出时触发
+// 钩子得到的是销毁前session的副本
+func (m *Manager) OnDestroy(fn Hook) {
+	m.hooks.add(&m.hooks.onDestroy, fn)
+}
+
+// OnExpire 注册session过期钩子，gc清理过期session时触发，r总是nil
+func (m *Manager) OnExpire(fn Hook) {
+	m.hooks.add(&m.hooks.onExpire, fn)
+}
+
+// OnRenew 注册token重建钩子
+func (m *Manager) OnRenew(fn RenewHook) {
+	m.hooks.mu.Lock()
+	m.hooks.onRenew = append(m.hooks.onRenew, fn)
+	m.hooks.mu.Unlock()
+}
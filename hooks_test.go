@@ -0,0 +1,114 @@
+package session
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ipiao/session/stores/memstore"
+)
+
+func TestHooks(t *testing.T) {
+	m := NewManager(memstore.New(0))
+
+	var events []string
+	record := func(name string) Hook {
+		return func(s *Session, r *http.Request) {
+			events = append(events, name+":"+s.GetToken())
+		}
+	}
+	m.OnCreate(record("create"))
+	m.OnLoad(record("load"))
+	m.OnSave(record("save"))
+	m.OnDestroy(record("destroy"))
+	m.OnExpire(record("expire"))
+	var renewed string
+	m.OnRenew(func(s *Session, r *http.Request, oldToken string) {
+		renewed = oldToken
+	})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	s, err := m.Load(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := s.GetToken()
+	if err := s.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0] != "create:"+token || events[1] != "save:"+token {
+		t.Fatalf("got %v: expected create and save", events)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: defaultName, Value: token})
+	if _, err := m.Load(r); err != nil {
+		t.Fatal(err)
+	}
+	if events[2] != "load:"+token {
+		t.Fatalf("got %v: expected load", events)
+	}
+
+	if err := s.RenewToken(); err != nil {
+		t.Fatal(err)
+	}
+	if renewed != token {
+		t.Fatalf("got %q: expected old token %q", renewed, token)
+	}
+
+	token = s.GetToken()
+	events = nil
+	if err := s.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0] != "destroy:"+token {
+		t.Fatalf("got %v: expected destroy with the old token", events)
+	}
+
+	s, _ = m.NewSession()
+	s.deadline = time.Now().Add(-time.Second)
+	events = nil
+	m.gc()
+	if len(events) != 1 || events[0] != "expire:"+s.GetToken() {
+		t.Fatalf("got %v: expected expire", events)
+	}
+}
+
+// TestRequestPerLoad 同一个token的并发请求共享数据，各自使用自己的请求上下文
+func TestRequestPerLoad(t *testing.T) {
+	m := NewManager(memstore.New(0))
+	s, _ := m.NewSession()
+	if err := s.Put("n", 1); err != nil {
+		t.Fatal(err)
+	}
+	var saved *http.Request
+	m.OnSave(func(s *Session, r *http.Request) {
+		saved = r
+	})
+
+	load := func(ctx context.Context) (*Session, *http.Request) {
+		r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+		r.AddCookie(&http.Cookie{Name: defaultName, Value: s.GetToken()})
+		ls, err := m.Load(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ls, r
+	}
+	a, ra := load(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	b, _ := load(ctx)
+	cancel()
+
+	if err := a.Put("n", 2); err != nil {
+		t.Fatalf("got %v: expected the other request's context not to be used", err)
+	}
+	if saved != ra {
+		t.Fatal("expected the hook to get the request of the session")
+	}
+	if v, _ := b.GetInt("n"); v != 2 {
+		t.Fatalf("got %d: expected the requests to share the data", v)
+	}
+}
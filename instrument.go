@@ -0,0 +1,101 @@
+package session
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// LogStore 记录存储器调用的中间件，记录操作名称、token摘要、耗时和错误
+// 成功的调用为Debug级别，失败的调用为Error级别；logger为nil时使用slog.Default()
+func LogStore(logger *slog.Logger) StoreMiddleware {
+	return InterceptStore(func(ctx context.Context, op, token string, call func(ctx context.Context) error) error {
+		l := logger
+		if l == nil {
+			l = slog.Default()
+		}
+		start := time.Now()
+		err := call(ctx)
+		attrs := []slog.Attr{
+			slog.String("op", op),
+			slog.Duration("latency", time.Since(start)),
+		}
+		if token != "" {
+			attrs = append(attrs, slog.String("token", TokenHash(token)))
+		}
+		if err != nil {
+			l.LogAttrs(ctx, slog.LevelError, "scs: store call failed", append(attrs, slog.Any("error", err))...)
+		} else {
+			l.LogAttrs(ctx, slog.LevelDebug, "scs: store call", attrs...)
+		}
+		return err
+	})
+}
+
+// Counter 计数器，与prometheus.Counter兼容
+type Counter interface {
+	Add(float64)
+}
+
+// Observer 直方图，与prometheus.Observer兼容
+type Observer interface {
+	Observe(float64)
+}
+
+// StoreMetrics MetricsStore使用的指标
+// 使用prometheus时可以分别传入CounterVec.WithLabelValues和HistogramVec.WithLabelValues
+type StoreMetrics struct {
+	// Calls 按操作名称和结果("ok"或者"error")返回调用次数的计数器，nil表示不统计
+	Calls func(op, result string) Counter
+	// Latency 按操作名称返回调用耗时(秒)的直方图，nil表示不统计
+	Latency func(op string) Observer
+}
+
+// MetricsStore 统计存储器调用次数和耗时的中间件
+func MetricsStore(m StoreMetrics) StoreMiddleware {
+	return InterceptStore(func(ctx context.Context, op, token string, call func(ctx context.Context) error) error {
+		start := time.Now()
+		err := call(ctx)
+		if m.Latency != nil {
+			m.Latency(op).Observe(time.Since(start).Seconds())
+		}
+		if m.Calls != nil {
+			result := "ok"
+			if err != nil {
+				result = "error"
+			}
+			m.Calls(op, result).Add(1)
+		}
+		return err
+	})
+}
+
+// Tracer 创建span，otelsession.Tracer把OpenTelemetry的trace.Tracer转换为Tracer
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span 一次存储器调用的span
+type Span interface {
+	SetAttribute(key, value string)
+	RecordError(err error)
+	End()
+}
+
+// TraceStore 为每次存储器调用创建span的中间件
+// span名称为"scs.store."加操作名称，带有操作名称和token摘要属性，调用失败时记录错误
+func TraceStore(tracer Tracer) StoreMiddleware {
+	return InterceptStore(func(ctx context.Context, op, token string, call func(ctx context.Context) error) error {
+		ctx, span := tracer.Start(ctx, "scs.store."+op)
+		defer span.End()
+		span.SetAttribute("scs.store.op", op)
+		if token != "" {
+			span.SetAttribute("scs.token", TokenHash(token))
+		}
+		err := call(ctx)
+		if err != nil {
+			span.RecordError(err)
+		}
+		return err
+	})
+}
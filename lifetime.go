@@ -0,0 +1,99 @@
+package session
+
+import (
+	"net/http"
+	"time"
+)
+
+// 单个session的设置，保存在data中，随data一起编码存储，从存储器加载之后仍然有效
+const (
+	lifetimeKey    = internalKeyPrefix + "lifetime"
+	idleTimeoutKey = internalKeyPrefix + "idle_timeout"
+	persistKey     = internalKeyPrefix + "persist"
+)
+
+// SetLifetime 设置session的有效期，覆盖manager的LifeTime
+// 过期时间从现在开始重新计算，如登录时选择"记住我"
+func (s *Session) SetLifetime(d time.Duration) error {
+	s.mu.Lock()
+	s.data[lifetimeKey] = int64(d)
+	s.deadline = time.Now().Add(d)
+	s.mu.Unlock()
+	return s.write()
+}
+
+// SetIdleTimeout 设置session的闲置时间，覆盖manager的IdleTime，0表示不限制
+func (s *Session) SetIdleTimeout(d time.Duration) error {
+	s.mu.Lock()
+	s.data[idleTimeoutKey] = int64(d)
+	s.mu.Unlock()
+	return s.write()
+}
+
+// SetPersist 设置cookie是否持久化，覆盖manager的Persist
+// 为false时cookie在浏览器关闭时失效
+func (s *Session) SetPersist(b bool) error {
+	s.mu.Lock()
+	s.data[persistKey] = b
+	s.mu.Unlock()
+	return s.write()
+}
+
+// lifetime session的有效期，调用时需要持有s.mu
+func (s *Session) lifetime() time.Duration {
+	if d, ok := s.durationOverride(lifetimeKey); ok {
+		return d
+	}
+	return s.opts.lifetime
+}
+
+// idleTimeout session的闲置时间，调用时需要持有s.mu
+func (s *Session) idleTimeout() time.Duration {
+	if d, ok := s.durationOverride(idleTimeoutKey); ok {
+		return d
+	}
+	return s.opts.idleTimeout
+}
+
+// persist cookie是否持久化，调用时需要持有s.mu
+func (s *Session) persist() bool {
+	if b, ok := s.data[persistKey].(bool); ok {
+		return b
+	}
+	return s.opts.persist
+}
+
+// durationOverride 读取data中的时间设置，编解码之后可能是json.Number等类型
+func (s *Session) durationOverride(key string) (time.Duration, bool) {
+	v, ok := s.data[key]
+	if !ok {
+		return 0, false
+	}
+	n, err := toInt64(v)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(n), true
+}
+
+// expiry 存储器中的过期时间点，调用时需要持有s.mu
+func (s *Session) expiry() time.Time {
+	expiry := s.deadline
+	if idle := s.idleTimeout(); idle > 0 {
+		ie := time.Now().Add(idle)
+		if ie.Before(expiry) {
+			expiry = ie
+		}
+	}
+	return expiry
+}
+
+// writeToken 通过TokenTransport写回token，cookie使用session的persist设置
+func (s *Session) writeToken(w http.ResponseWriter, t TokenTransport, expiry time.Time) error {
+	s.mu.Lock()
+	opts := s.opts
+	opts.persist = s.persist()
+	token := s.token
+	s.mu.Unlock()
+	return opts.bindTransport(t).WriteToken(w, token, expiry)
+}
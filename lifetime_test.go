@@ -0,0 +1,62 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ipiao/session/stores/memstore"
+)
+
+func TestRememberMe(t *testing.T) {
+	m := NewManager(memstore.New(0), IdleTime(time.Hour))
+	month := 30 * 24 * time.Hour
+
+	s, _ := m.NewSession()
+	if err := s.SetLifetime(month); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetIdleTimeout(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetPersist(true); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := s.Keys(); len(keys) != 0 {
+		t.Fatalf("got keys %v: expected overrides to be hidden", keys)
+	}
+
+	// 从存储器中重新加载，设置仍然有效
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: defaultName, Value: s.GetToken()})
+	s, err := m.LoadIM(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(s.GetExpiry()); d < month-time.Minute {
+		t.Fatalf("got expiry in %v: expected about %v", d, month)
+	}
+	rr := httptest.NewRecorder()
+	if err := s.WriteToResponseWriter(rr); err != nil {
+		t.Fatal(err)
+	}
+	c := rr.Result().Cookies()
+	if len(c) != 1 || time.Duration(c[0].MaxAge)*time.Second < month-time.Minute {
+		t.Fatalf("got %v: expected a persistent cookie for %v", c, month)
+	}
+
+	// 普通登录仍然是浏览器会话cookie
+	s, _ = m.NewSession()
+	if d := time.Until(s.GetExpiry()); d > time.Hour {
+		t.Fatalf("got expiry in %v: expected the manager idle timeout", d)
+	}
+	rr = httptest.NewRecorder()
+	if err := s.WriteToResponseWriter(rr); err != nil {
+		t.Fatal(err)
+	}
+	c = rr.Result().Cookies()
+	if len(c) != 1 || c[0].MaxAge != 0 {
+		t.Fatalf("got %v: expected a session cookie", c)
+	}
+}
@@ -0,0 +1,193 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrLockTimeout 在等待时间内没有获得session的锁
+var ErrLockTimeout = errors.New("scs: timed out waiting for the session lock")
+
+const (
+	defaultLockWait = 10 * time.Second
+	defaultLockTTL  = 30 * time.Second
+)
+
+// Locker 按key加锁，用于同一个session的请求在多个实例之间串行处理
+type Locker interface {
+	// Lock 获得key的锁，返回递增的fencing token
+	// 锁被占用时等待，直到获得锁或者ctx结束，ctx结束时返回ctx.Err()
+	// ttl为锁的最长持有时间，持有者崩溃或者超时未释放时锁自动失效
+	Lock(ctx context.Context, key string, ttl time.Duration) (fence int64, err error)
+	// Unlock 释放锁，锁已经失效并被其它持有者获得时(fence不一致)不做任何事
+	Unlock(ctx context.Context, key string, fence int64) error
+}
+
+// memLock 进程内的一把锁
+type memLock struct {
+	fence int64
+	done  chan struct{}
+	timer *time.Timer
+}
+
+// memLocker 进程内的锁
+type memLocker struct {
+	mu    sync.Mutex
+	fence int64
+	locks map[string]*memLock
+}
+
+// NewMemLocker 返回进程内的锁，多实例部署时各实例的锁互不可见
+func NewMemLocker() Locker {
+	return &memLocker{
+		locks: make(map[string]*memLock),
+	}
+}
+
+func (l *memLocker) Lock(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	for {
+		l.mu.Lock()
+		ml, ok := l.locks[key]
+		if !ok {
+			l.fence++
+			ml = &memLock{fence: l.fence, done: make(chan struct{})}
+			if ttl > 0 {
+				fence := ml.fence
+				ml.timer = time.AfterFunc(ttl, func() {
+					l.release(key, fence)
+				})
+			}
+			l.locks[key] = ml
+			l.mu.Unlock()
+			return ml.fence, nil
+		}
+		l.mu.Unlock()
+		select {
+		case <-ml.done:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+func (l *memLocker) Unlock(ctx context.Context, key string, fence int64) error {
+	l.release(key, fence)
+	return nil
+}
+
+// release 释放key上fence对应的锁，唤醒等待的请求
+func (l *memLocker) release(key string, fence int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ml, ok := l.locks[key]
+	if !ok || ml.fence != fence {
+		return
+	}
+	if ml.timer != nil {
+		ml.timer.Stop()
+	}
+	delete(l.locks, key)
+	close(ml.done)
+}
+
+// lockFenceKey 请求上下文中fencing token的key
+type lockFenceKey struct{}
+
+// LockFence 返回Use为当前请求获得的锁的fencing token
+// 未开启SerializeRequests或者请求没有携带token时返回false
+// 锁可能在请求处理完之前因为ttl失效，写入外部存储时可以带上fence，拒绝比已写入的fence小的写入
+func LockFence(ctx context.Context) (int64, bool) {
+	fence, ok := ctx.Value(lockFenceKey{}).(int64)
+	return fence, ok
+}
+
+// lock 开启SerializeRequests时，在加载session之前获得请求token对应session的锁
+// 返回释放锁的函数和带有fencing token的请求，请求没有携带token时不加锁
+func (m *Manager) lock(r *http.Request) (func(), *http.Request, error) {
+	locker := m.opts.locker
+	if locker == nil {
+		return func() {}, r, nil
+	}
+	token, _ := m.opts.readToken(r)
+	if token == "" {
+		return func() {}, r, nil
+	}
+	key, err := m.lockKey(r.Context(), token)
+	if err != nil {
+		return nil, r, err
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), m.opts.lockWait)
+	fence, err := locker.Lock(ctx, key, m.opts.lockTTL)
+	cancel()
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) && r.Context().Err() == nil {
+			return nil, r, ErrLockTimeout
+		}
+		return nil, r, err
+	}
+	release := func() {
+		// 请求被取消时也需要释放锁
+		err := locker.Unlock(context.WithoutCancel(r.Context()), key, fence)
+		if err != nil {
+			log.Printf("can not release session lock:%v", err)
+		}
+	}
+	return release, r.WithContext(context.WithValue(r.Context(), lockFenceKey{}, fence)), nil
+}
+
+// lockIDCacheSize lockKey缓存的token数量上限，超出时清空
+const lockIDCacheSize = 10000
+
+// idCache 缓存manager中没有的session的token对应的id，token对应的id不会改变
+type idCache struct {
+	mu  sync.Mutex
+	ids map[string]string
+}
+
+func (c *idCache) get(token string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, ok := c.ids[token]
+	return id, ok
+}
+
+func (c *idCache) set(token, id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ids == nil || len(c.ids) >= lockIDCacheSize {
+		c.ids = make(map[string]string)
+	}
+	c.ids[token] = id
+}
+
+// lockKey 返回token对应的session id，作为锁的key
+// 处理请求时RenewToken会改变token，按id加锁时使用新旧token的请求仍然互斥
+// 先在manager中查找，再查找缓存，都没有时才读取存储器；找不到session或者无法解码时使用token
+func (m *Manager) lockKey(ctx context.Context, token string) (string, error) {
+	if ms, ok := m.sessions.get(token); ok {
+		if id := ms.GetID(); id != "" {
+			return id, nil
+		}
+	}
+	if id, ok := m.lockIDs.get(token); ok {
+		return id, nil
+	}
+	b, found, err := m.storeCtx().FindCtx(ctx, token)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return token, nil
+	}
+	id, _, _, err := m.opts.codec.Decode(b)
+	if err != nil || id == "" {
+		return token, nil
+	}
+	m.lockIDs.set(token, id)
+	return id, nil
+}
@@ -0,0 +1,194 @@
+package session
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipiao/session/stores/memstore"
+)
+
+func TestMemLocker(t *testing.T) {
+	l := NewMemLocker()
+	ctx := context.Background()
+
+	fence, err := l.Lock(ctx, "token", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	_, err = l.Lock(wctx, "token", time.Minute)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v: expected %v", err, context.DeadlineExceeded)
+	}
+	if _, err = l.Lock(ctx, "other", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// 过期的持有者不能释放别人的锁
+	l.Unlock(ctx, "token", fence-1)
+	done := make(chan int64)
+	go func() {
+		next, _ := l.Lock(ctx, "token", 10*time.Millisecond)
+		done <- next
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected the lock to be still held")
+	case <-time.After(10 * time.Millisecond):
+	}
+	l.Unlock(ctx, "token", fence)
+	next := <-done
+	if next <= fence {
+		t.Fatalf("got fence %d: expected more than %d", next, fence)
+	}
+
+	// 超过ttl自动释放
+	if _, err = l.Lock(ctx, "token", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSerializeRequests(t *testing.T) {
+	m := NewManager(memstore.New(0), SerializeRequests(NewMemLocker(), time.Second, 0))
+	s, _ := m.NewSession()
+
+	var running, overlaps int32
+	var fences sync.Map
+	h := m.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&running, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		fence, ok := LockFence(r.Context())
+		if !ok {
+			t.Error("expected a fencing token in the request context")
+		}
+		fences.Store(fence, true)
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(&http.Cookie{Name: defaultName, Value: s.GetToken()})
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, r)
+			if rr.Code != http.StatusOK {
+				t.Errorf("got %d: expected %d", rr.Code, http.StatusOK)
+			}
+		}()
+	}
+	wg.Wait()
+	if overlaps != 0 {
+		t.Fatalf("got %d overlapping requests: expected none", overlaps)
+	}
+	var n int
+	fences.Range(func(k, v interface{}) bool {
+		n++
+		return true
+	})
+	if n != 5 {
+		t.Fatalf("got %d fencing tokens: expected one per request", n)
+	}
+
+	// 没有token的请求不加锁
+	rr := httptest.NewRecorder()
+	m.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := LockFence(r.Context()); ok {
+			t.Error("expected no lock for a new session")
+		}
+	})).ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+}
+
+func TestSerializeRequestsTimeout(t *testing.T) {
+	locker := NewMemLocker()
+	m := NewManager(memstore.New(0), SerializeRequests(locker, 10*time.Millisecond, 0))
+	s, _ := m.NewSession()
+
+	// 另一个实例持有锁
+	if _, err := locker.Lock(context.Background(), s.GetToken(), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: defaultName, Value: s.GetToken()})
+	rr := httptest.NewRecorder()
+	m.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("expected the handler not to run")
+	})).ServeHTTP(rr, r)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got %d: expected %d", rr.Code, http.StatusServiceUnavailable)
+	}
+}
+
+// TestSerializeRequestsRenew 处理请求时RenewToken，使用新token的请求仍然等待
+func TestSerializeRequestsRenew(t *testing.T) {
+	m := NewManager(memstore.New(0), SerializeRequests(NewMemLocker(), time.Second, 0))
+	s, _ := m.NewSession()
+	if err := s.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	var running, overlaps int32
+	renewed := make(chan string)
+	h := m.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&running, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		defer atomic.AddInt32(&running, -1)
+		if r.URL.Path != "/renew" {
+			return
+		}
+		s := m.MustFromContext(r.Context())
+		if err := m.RenewToken(w, s); err != nil {
+			t.Error(err)
+		}
+		renewed <- s.GetToken()
+		time.Sleep(20 * time.Millisecond)
+	}))
+
+	go func() {
+		r := httptest.NewRequest("GET", "/renew", nil)
+		r.AddCookie(&http.Cookie{Name: defaultName, Value: s.GetToken()})
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}()
+	token := <-renewed
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: defaultName, Value: token})
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if overlaps != 0 {
+		t.Fatal("expected the request with the new token to wait for the lock")
+	}
+}
+
+// TestSerializeRequestsLockKey 其他实例创建的session只在第一次请求时读取存储器得到id
+func TestSerializeRequestsLockKey(t *testing.T) {
+	store := memstore.New(0)
+	var finds int32
+	count := InterceptStore(func(ctx context.Context, op, token string, call func(ctx context.Context) error) error {
+		if op == OpFind {
+			atomic.AddInt32(&finds, 1)
+		}
+		return call(ctx)
+	})
+	m := NewManager(store, StoreMiddlewares(count), SerializeRequests(NewMemLocker(), time.Second, 0))
+	s, _ := NewManager(store).NewSession()
+	s.Put("key", "value")
+	h := m.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: defaultName, Value: s.GetToken()})
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	if finds != 3 {
+		t.Fatalf("got %d finds: expected the id to be read from the store once", finds)
+	}
+}
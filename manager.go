@@ -2,7 +2,8 @@ package session
 
 import (
 	"context"
-	"fmt"
+	"errors"
+	"io"
 	"log"
 	"math"
 	"net/http"
@@ -12,48 +13,52 @@ import (
 	"github.com/ipiao/session/stores/cookiestore"
 )
 
+// ErrTooManySessions 用户的session数量超出限制，拒绝登录
+var ErrTooManySessions = errors.New("scs: too many sessions for user")
+
+// ErrManagerClosed manager已经关闭，不再创建session
+var ErrManagerClosed = errors.New("scs: manager is closed")
+
 // Manager session控制器
 type Manager struct {
 	store    Store
 	opts     Options
-	sessions map[string]*Session // 只是为了更方便的查询session的数据，判别session之间的关系
-	mu       sync.Mutex
+	sessions *registry // 只是为了更方便的查询session的数据，判别session之间的关系
+	stats    *managerStats
+	hooks    *hooks
+	// userLocker 登录时按用户加锁，使数量限制的检查和登录原子执行，没有设置SerializeRequests时为进程内锁
+	userLocker Locker
+	lockIDs    idCache // SerializeRequests按id加锁时，缓存存储器中读到的token对应的id
+
+	mu           sync.Mutex         // 保护下面的关闭状态
+	closed       bool               // 是否已经关闭
+	gcTimer      *time.Timer        // 下一次gc的定时器
+	warmUpCancel context.CancelFunc // 停止后台预热
+	inflight     sync.WaitGroup     // 正在处理的请求，关闭时等待其提交
 }
 
 // NewManager 返回session管理器
 // 并且伴随生成一个gc任务
 func NewManager(store Store, opts ...Option) *Manager {
 	options := NewOptions(opts...)
+	options.err = errors.Join(options.err, options.checkUserIndex(store))
+	if options.err != nil {
+		log.Printf("invalid session options:%v", options.err)
+	}
 	manager := &Manager{
-		store:    store,
+		store:    ChainStore(store, options.storeMiddlewares...),
 		opts:     options,
-		sessions: make(map[string]*Session),
-	}
-	// 从store中加载sessions
-	bs, err := store.Loads()
-	if err != nil {
-		log.Printf("can not load sessions from store, error occur:%v", err)
+		sessions: newRegistry(),
+		stats:    newManagerStats(),
+		hooks:    &hooks{},
 	}
-	for _, b := range bs {
-		id, data, expiry, err := decodeFromJSON(b)
-		if err != nil {
-			log.Printf("can decode from JSON:%v", err)
-			continue
-		}
-		if expiry.After(time.Now()) {
-			s := Session{
-				id:       id,
-				token:    id,
-				data:     data,
-				deadline: expiry,
-				mu:       sync.Mutex{},
-				opts:     options,
-				store:    store,
-			}
-			manager.sessions[s.token] = &s
-		}
+	manager.userLocker = options.locker
+	if manager.userLocker == nil {
+		manager.userLocker = NewMemLocker()
 	}
-	go manager.RunGC()
+	// 从store中加载sessions
+	manager.startWarmUp()
+	manager.RunGC()
 	return manager
 }
 
@@ -69,39 +74,80 @@ func (m *Manager) Option(opts ...Option) {
 	for _, o := range opts {
 		o(&m.opts)
 	}
+	m.opts.applyCookiePrefix()
+	m.opts.err = errors.Join(m.opts.validate(), m.opts.checkUserIndex(m.store))
+}
+
+// Err 返回manager的配置错误
+func (m *Manager) Err() error {
+	return m.opts.err
+}
+
+// storeCtx 返回记录统计的存储器
+func (m *Manager) storeCtx() StoreContext {
+	return m.stats.wrap(WithContext(m.store))
 }
 
 // RunGC 运行gc,简单设定间隔
+// manager关闭之后不再运行
 func (m *Manager) RunGC() {
 	d := time.Minute * 15
 	if m.opts.idleTimeout > 0 {
 		d = time.Duration(math.Ceil(m.opts.idleTimeout.Minutes()/2)) * time.Minute
 	}
-	time.AfterFunc(d, func() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+	if m.gcTimer != nil {
+		m.gcTimer.Stop()
+	}
+	m.gcTimer = time.AfterFunc(d, func() {
 		m.gc()
 		m.RunGC()
 	})
 }
 
 func (m *Manager) gc() {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	for k, v := range m.sessions {
-		if v.TimeOut() {
-			// 这里要求所有的存储器自带GC
-			//if !m.store.AutoGC(){
-			//	v.Destroy()
-			//}
-			delete(m.sessions, k)
+	start := time.Now()
+	// 过期或者已经销毁
+	// 这里要求所有的存储器自带GC
+	//if !m.store.AutoGC(){
+	//	v.Destroy()
+	//}
+	removed := m.sessions.removeIf(func(s *Session) bool {
+		return s.TimeOut() || s.GetToken() == ""
+	})
+	// 已经销毁的session只是从manager中移除，不计入gc的数量
+	expired := 0
+	for _, s := range removed {
+		if s.GetToken() != "" {
+			expired++
+			s.mu.Lock()
+			err := s.removeUserToken(context.Background())
+			s.mu.Unlock()
+			if err != nil {
+				log.Printf("can not remove expired session from user index:%v", err)
+			}
+			m.hooks.expired(s)
 		}
 	}
+	m.stats.gcDone(start, expired)
 }
 
 // FindSeesion 查找session
+// 只在本进程manager中查找，其他实例或者未加载的session通过FindStoreSeesion在存储器中查找
+// 在查找时的快照中查找，查找过程中新建的session不会被找到
 func (m *Manager) FindSeesion(fds ...Finder) []*Session {
+	return m.findRegistry(fds...)
+}
+
+// findRegistry 只在本进程manager中查找session
+func (m *Manager) findRegistry(fds ...Finder) []*Session {
 	fd := MakeFinder(fds...)
 	var ret = make([]*Session, 0)
-	for _, s := range m.sessions {
+	for _, s := range m.sessions.snapshot() {
 		if fd(s) {
 			ret = append(ret, s)
 		}
@@ -110,9 +156,10 @@ func (m *Manager) FindSeesion(fds ...Finder) []*Session {
 }
 
 // FindHandleSeesion 查找并处理session
+// 只处理本进程manager中的session
 func (m *Manager) FindHandleSeesion(fd Finder, hd Handle) []*Session {
 	var ret = make([]*Session, 0)
-	for _, s := range m.sessions {
+	for _, s := range m.sessions.snapshot() {
 		if fd(s) {
 			hd(s)
 			ret = append(ret, s)
@@ -123,32 +170,235 @@ func (m *Manager) FindHandleSeesion(fd Finder, hd Handle) []*Session {
 
 // NewSession 创建并且返回一个Session
 func (m *Manager) NewSession() (*Session, error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	return m.newSession(nil)
+}
+
+// newSession 创建session，r不为nil时绑定请求上下文和客户端信息
+func (m *Manager) newSession(r *http.Request) (*Session, error) {
+	if m.isClosed() {
+		return nil, ErrManagerClosed
+	}
 	s, err := newSession(m.store, m.opts)
 	if err != nil {
 		return nil, err
 	}
-	m.sessions[s.token] = s
+	s.stats = m.stats
+	s.hooks = m.hooks
+	s.sessions = m.sessions
+	// manager中保存不属于任何请求的session，返回的session属于请求r
+	m.sessions.set(s.token, s)
+	if r != nil {
+		s = s.withRequest(r, nil)
+		m.bind(r, s)
+	}
+	m.stats.incCreated()
+	m.hooks.created(s, r)
 	return s, nil
 }
 
-// Stat 状态
-func (m *Manager) Stat() {
-	// TODO 返回 manager状态
+// RenewToken 重建session的token，更新manager中的索引并且重写cookie
+// 对于客户端存储器(如cookiestore)，旧的token无法作废，只能等待其自然过期
+func (m *Manager) RenewToken(w http.ResponseWriter, s *Session) error {
+	oldToken, undo, err := s.renewToken()
+	if err != nil {
+		return err
+	}
+	// 只在这里写入一次，客户端存储器在这里才生成最终的token
+	err = s.WriteToResponseWriter(w)
+	if err != nil {
+		undo()
+		return err
+	}
+	return s.renewed(oldToken)
+}
+
+// Login 将session登录为给定用户，并且执行单用户session数量限制
+// 超出限制时，根据LoginMode拒绝登录(返回ErrTooManySessions)或者踢出最早登录的session
+// 同一个用户的登录按用户加锁依次执行，使用SerializeRequests的Locker，没有设置时使用进程内锁
+// session之前登录为其它用户时，从其它用户的索引中删除
+// 客户端存储器无法作废已经发出的token，不支持数量限制
+func (m *Manager) Login(s *Session, userID string) error {
+	ctx := s.getContext()
+	unlock, err := m.lockUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	idx := m.opts.userIndex
+	if m.opts.maxUserSessions > 0 && m.opts.loginMode != LoginAllow {
+		if _, ok := m.store.(clientStore); ok {
+			return errors.New("scs: max sessions per user is not supported by client store")
+		}
+		uts, err := idx.List(ctx, userID)
+		if err != nil {
+			return err
+		}
+		// 排除当前session和存储器中已经不存在的session
+		var live []UserToken
+		for _, ut := range uts {
+			if ut.Token == s.GetToken() {
+				continue
+			}
+			_, found, err := m.storeCtx().FindCtx(ctx, ut.Token)
+			if err != nil {
+				return err
+			}
+			if !found {
+				err = idx.Remove(ctx, userID, ut.Token)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			live = append(live, ut)
+		}
+		for len(live) >= m.opts.maxUserSessions {
+			if m.opts.loginMode == LoginReject {
+				return ErrTooManySessions
+			}
+			err = m.evict(ctx, userID, live[0].Token)
+			if err != nil {
+				return err
+			}
+			live = live[1:]
+		}
+	}
+	prev := s.GetUserID()
+	err = s.SetUserID(userID)
+	if err != nil {
+		return err
+	}
+	if prev != "" && prev != userID {
+		err = idx.Remove(ctx, prev, s.GetToken())
+		if err != nil {
+			return err
+		}
+	}
+	return idx.Add(ctx, userID, UserToken{Token: s.GetToken(), LoginTime: time.Now(), Expiry: s.getDeadline()})
+}
+
+// lockUser 获得用户的登录锁，返回释放锁的函数
+func (m *Manager) lockUser(ctx context.Context, userID string) (func(), error) {
+	key := storeUserIndexPrefix + userID
+	wait := m.opts.lockWait
+	if wait <= 0 {
+		wait = defaultLockWait
+	}
+	lctx, cancel := context.WithTimeout(ctx, wait)
+	fence, err := m.userLocker.Lock(lctx, key, m.opts.lockTTL)
+	cancel()
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			return nil, ErrLockTimeout
+		}
+		return nil, err
+	}
+	return func() {
+		err := m.userLocker.Unlock(context.WithoutCancel(ctx), key, fence)
+		if err != nil {
+			log.Printf("can not release user lock:%v", err)
+		}
+	}, nil
+}
+
+// evict 踢出用户的一个session
+func (m *Manager) evict(ctx context.Context, userID, token string) error {
+	ms, ok := m.sessions.remove(token)
+	err := m.storeCtx().DeleteCtx(ctx, token)
+	if err != nil {
+		return err
+	}
+	m.stats.incDestroyed()
+	if ok {
+		// 同时清空内存中的session，避免之后的写入使其复活
+		ms.mu.Lock()
+		old := ms.snapshot()
+		ms.reset()
+		ms.mu.Unlock()
+		m.hooks.destroyed(old, nil)
+	}
+	return m.opts.userIndex.Remove(ctx, userID, token)
 }
 
-// Close 关闭
+// Close 关闭，相当于Shutdown(context.Background())
 func (m *Manager) Close() error {
-	return m.store.Dumps()
+	return m.Shutdown(context.Background())
+}
+
+// Shutdown 关闭manager
+// 1.停止gc，拒绝创建新的session和处理新的请求
+// 2.等待Use中正在处理的请求提交，ctx结束时不再等待
+// 3.停止存储器的后台清理，并且Dumps存储器
+// 4.存储器没有StopCleanup时，如果实现了io.Closer，关闭存储器
+// SQL存储器内嵌了调用方传入的*sql.DB，只调用StopCleanup，数据库由调用方关闭
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ErrManagerClosed
+	}
+	m.closed = true
+	if m.gcTimer != nil {
+		m.gcTimer.Stop()
+	}
+	if m.warmUpCancel != nil {
+		m.warmUpCancel()
+	}
+	m.mu.Unlock()
+
+	var errs []error
+	done := make(chan struct{})
+	go func() {
+		m.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		errs = append(errs, ctx.Err())
+	}
+
+	sc, stopper := m.store.(interface{ StopCleanup() })
+	if stopper {
+		sc.StopCleanup()
+	}
+	// ctx可能已经结束，仍然尝试保存
+	err := m.storeCtx().DumpsCtx(context.WithoutCancel(ctx))
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if c, ok := m.store.(io.Closer); ok && !stopper {
+		err = c.Close()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// isClosed manager是否已经关闭
+func (m *Manager) isClosed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closed
+}
+
+// begin 开始处理一个请求，manager已经关闭时返回false
+func (m *Manager) begin() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return false
+	}
+	m.inflight.Add(1)
+	return true
 }
 
 //-------------------------
 //-- handle http request
 //-------------------------
 
-type sessionName string
-
 // Load 选择manager中存在时候，从中获取
 func (m *Manager) Load(r *http.Request) (*Session, error) {
 	return m.load(r, true)
@@ -167,58 +417,137 @@ func (m *Manager) LoadIM(r *http.Request) (*Session, error) {
 // 4.如果没有则生成一个session
 func (m *Manager) load(r *http.Request, queryManager bool) (*Session, error) {
 	// 检查上下文中是否存在session信息
-	val := r.Context().Value(sessionName(m.opts.name))
-	if val != nil {
-		s, ok := val.(*Session)
-		if !ok {
-			return nil, fmt.Errorf("scs: can not assert %T to *Session", val)
-		}
+	if s, ok := m.FromContext(r.Context()); ok {
 		return s, nil
 	}
 
-	// 如果上下文中没有，从cokie中获取token,如果获取不到，直接生成
-	cookie, err := r.Cookie(m.opts.name)
-	if err == http.ErrNoCookie {
-		log.Println("newsession:", err)
-		return m.NewSession()
-	} else if err != nil {
-		return nil, err
+	ctx := r.Context()
+	// 如果上下文中没有，从cookie、header等获取token,如果获取不到，直接生成
+	token, transport := m.opts.readToken(r)
+	if token == "" {
+		log.Println("newsession: token not found")
+		return m.newRequestSession(r)
 	}
-	if cookie.Value == "" {
-		log.Println("newsession cookie.Value is empty ")
-		return m.NewSession()
-	}
-	token := cookie.Value
 	// 根据token从Store中获取数据，如果store里没有，生成一个
-	j, found, err := m.store.Find(token)
+	j, version, found, err := m.find(ctx, token)
 	if err != nil {
 		return nil, err
 	}
 	if found == false {
-		return m.NewSession()
+		// 存储器中已经不存在，使用请求中相同的方式写回新的token
+		s, err := m.newRequestSession(r)
+		if err != nil {
+			return nil, err
+		}
+		return s.withRequest(r, transport), nil
 	}
 	// 根据数据生成一个session
-	id, data, deadline, err := decodeFromJSON(j)
+	id, data, deadline, err := m.opts.codec.Decode(j)
 	if err != nil {
 		return nil, err
 	}
 	if queryManager {
-		ss := m.FindSeesion(FindByID(id), FindTimeIn())
-		if len(ss) == 1 {
-			return ss[0], nil
+		if ms := m.findLoaded(token, id); ms != nil {
+			if _, ok := m.opts.casStore(m.store); ok {
+				// 其它实例可能已经修改了存储器中的数据
+				ms.mu.Lock()
+				ms.refresh(data, deadline, version)
+				ms.mu.Unlock()
+			}
+			return m.verifyBinding(r, ms.withRequest(r, transport))
 		}
 	}
 	s := &Session{
-		id:       id,
-		token:    token,
-		data:     data,
-		deadline: deadline,
-		store:    m.store,
-		opts:     m.opts,
+		sessionState: &sessionState{
+			id:       id,
+			token:    token,
+			data:     data,
+			deadline: deadline,
+			store:    m.store,
+			opts:     m.opts,
+			stats:    m.stats,
+			hooks:    m.hooks,
+			sessions: m.sessions,
+			version:  version,
+		},
+		ctx:       ctx,
+		req:       r,
+		transport: transport,
+	}
+	if _, ok := m.opts.casStore(m.store); ok {
+		s.base = copyData(data)
+	}
+	s, err = m.verifyBinding(r, s)
+	if err != nil {
+		return nil, err
+	}
+	if queryManager {
+		s = m.hydrate(s)
 	}
 	return s, nil
 }
 
+// find 从存储器中读取session，开启乐观锁时同时读取版本号
+func (m *Manager) find(ctx context.Context, token string) ([]byte, int64, bool, error) {
+	cs, ok := m.opts.casStore(m.store)
+	if !ok {
+		b, found, err := m.storeCtx().FindCtx(ctx, token)
+		return b, 0, found, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, 0, false, err
+	}
+	start := time.Now()
+	b, version, found, err := cs.FindVersion(ctx, token)
+	if errors.Is(err, errors.ErrUnsupported) {
+		b, found, err = m.storeCtx().FindCtx(ctx, token)
+		return b, 0, found, err
+	}
+	m.stats.observe(OpFind, start, err)
+	return b, version, found, err
+}
+
+// findLoaded 在manager中查找已经加载的session
+// 先按token查找，客户端存储器每次写入都会改变token，需要按id查找
+func (m *Manager) findLoaded(token, id string) *Session {
+	if ms, ok := m.sessions.get(token); ok && ms.GetID() == id && !ms.TimeOut() {
+		return ms
+	}
+	if _, ok := m.store.(clientStore); !ok {
+		return nil
+	}
+	ss := m.findRegistry(FindByID(id), FindTimeIn())
+	if len(ss) == 1 {
+		return ss[0]
+	}
+	return nil
+}
+
+// newRequestSession 为请求创建session，绑定请求上下文和客户端信息
+func (m *Manager) newRequestSession(r *http.Request) (*Session, error) {
+	return m.newSession(r)
+}
+
+// verifyBinding 检查session的绑定信息，不一致时按照BindMismatch处理
+// 检查通过时触发OnLoad钩子，新增了绑定信息时写入session
+func (m *Manager) verifyBinding(r *http.Request, s *Session) (*Session, error) {
+	if ok, bound := m.checkBinding(r, s); ok {
+		// 新增的绑定信息需要写入存储器，否则每次请求都会重新绑定
+		if bound {
+			err := s.write()
+			if err != nil {
+				return nil, err
+			}
+		}
+		m.hooks.loaded(s, r)
+		return s, nil
+	}
+	if m.opts.bindMismatch == MismatchRegenerate {
+		return m.newRequestSession(r)
+	}
+	return nil, ErrBindingMismatch
+}
+
 // Write 写入数据
 func (m *Manager) Write(session *Session, w http.ResponseWriter) error {
 	return session.WriteToResponseWriter(w)
@@ -227,13 +556,50 @@ func (m *Manager) Write(session *Session, w http.ResponseWriter) error {
 // Use 用作中间件，作为示例，具体使用根据业务场景而定
 func (m *Manager) Use(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.begin() {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		defer m.inflight.Done()
+		// 同一个session的请求串行处理，提交之后释放锁
+		release, r, err := m.lock(r)
+		if err == ErrLockTimeout {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		} else if err != nil {
+			log.Println(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		defer release()
 		// 加载一个session
 		session, err := m.Load(r)
-		if err != nil {
+		if err == ErrBindingMismatch {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		} else if err == ErrManagerClosed {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		} else if err != nil {
 			log.Println(err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
+		ctx := NewContext(r.Context(), session)
+		// 延迟写入，在写出响应头之前或者请求结束时统一提交
+		if m.opts.deferWrite {
+			cw := &commitWriter{ResponseWriter: w, session: session}
+			next.ServeHTTP(cw, r.WithContext(ctx))
+			wroteHeader := cw.wroteHeader
+			err = cw.commit()
+			if err != nil {
+				log.Println(err)
+				if !wroteHeader {
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				}
+			}
+			return
+		}
 		if session.MayTouch() {
 			err = session.WriteToResponseWriter(w)
 			if err != nil {
@@ -242,7 +608,6 @@ func (m *Manager) Use(next http.Handler) http.Handler {
 				return
 			}
 		}
-		ctx := context.WithValue(r.Context(), sessionName(session.opts.name), session)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -0,0 +1,205 @@
+package session
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// StoreMiddleware 存储器中间件，包装存储器，在调用前后做日志、监控、追踪等处理
+type StoreMiddleware func(Store) Store
+
+// ChainStore 依次用mws包装store，第一个中间件在最外层，最先被调用
+func ChainStore(store Store, mws ...StoreMiddleware) Store {
+	for i := len(mws) - 1; i >= 0; i-- {
+		store = mws[i](store)
+	}
+	return store
+}
+
+// StoreMiddlewares NewManager用mws包装存储器，第一个中间件在最外层
+// 只在NewManager时生效，Manager.Option不会重新包装存储器
+func StoreMiddlewares(mws ...StoreMiddleware) Option {
+	return func(o *Options) {
+		o.storeMiddlewares = append(o.storeMiddlewares, mws...)
+	}
+}
+
+// 存储器操作名称，除了ManagerStats.StoreOps中的操作，还有以下操作
+const (
+	OpFindVersion   = "find_version"
+	OpSaveIfVersion = "save_if_version"
+	OpMakeToken     = "make_token"
+)
+
+// StoreInterceptor 拦截一次存储器调用
+// op为操作名称(OpSave等)，token为session的token，不针对单个session的操作(Loads等)为空
+// 必须调用call并返回它的错误，可以传入新的ctx
+type StoreInterceptor func(ctx context.Context, op, token string, call func(ctx context.Context) error) error
+
+// InterceptStore 返回每次调用都经过fn的存储器中间件
+// 包装后的存储器实现Scanner、QueryableStore、CASStore和io.Closer，被包装的存储器不支持时返回errors.ErrUnsupported，
+// 被包装的存储器是cookiestore这样的客户端存储器时，同样是客户端存储器
+func InterceptStore(fn StoreInterceptor) StoreMiddleware {
+	return func(store Store) Store {
+		is := &interceptStore{store: store, sc: WithContext(store), fn: fn}
+		if cs, ok := store.(clientStore); ok {
+			return &interceptClientStore{interceptStore: is, cs: cs}
+		}
+		return is
+	}
+}
+
+// interceptStore InterceptStore包装的存储器
+type interceptStore struct {
+	store Store
+	sc    StoreContext
+	fn    StoreInterceptor
+}
+
+// unsupported 返回被包装的存储器不支持method的错误
+func (s *interceptStore) unsupported(method string) error {
+	return fmt.Errorf("scs: %T does not support %s: %w", s.store, method, errors.ErrUnsupported)
+}
+
+func (s *interceptStore) Save(token string, b []byte, expiry time.Time) error {
+	return s.SaveCtx(context.Background(), token, b, expiry)
+}
+
+func (s *interceptStore) SaveCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	return s.fn(ctx, OpSave, token, func(ctx context.Context) error {
+		return s.sc.SaveCtx(ctx, token, b, expiry)
+	})
+}
+
+func (s *interceptStore) Delete(token string) error {
+	return s.DeleteCtx(context.Background(), token)
+}
+
+func (s *interceptStore) DeleteCtx(ctx context.Context, token string) error {
+	return s.fn(ctx, OpDelete, token, func(ctx context.Context) error {
+		return s.sc.DeleteCtx(ctx, token)
+	})
+}
+
+func (s *interceptStore) Find(token string) ([]byte, bool, error) {
+	return s.FindCtx(context.Background(), token)
+}
+
+func (s *interceptStore) FindCtx(ctx context.Context, token string) (b []byte, found bool, err error) {
+	err = s.fn(ctx, OpFind, token, func(ctx context.Context) (err error) {
+		b, found, err = s.sc.FindCtx(ctx, token)
+		return err
+	})
+	return b, found, err
+}
+
+func (s *interceptStore) Dumps() error {
+	return s.DumpsCtx(context.Background())
+}
+
+func (s *interceptStore) DumpsCtx(ctx context.Context) error {
+	return s.fn(ctx, OpDumps, "", s.sc.DumpsCtx)
+}
+
+func (s *interceptStore) Loads() ([][]byte, error) {
+	return s.LoadsCtx(context.Background())
+}
+
+func (s *interceptStore) LoadsCtx(ctx context.Context) (bs [][]byte, err error) {
+	err = s.fn(ctx, OpLoads, "", func(ctx context.Context) (err error) {
+		bs, err = s.sc.LoadsCtx(ctx)
+		return err
+	})
+	return bs, err
+}
+
+func (s *interceptStore) Scan(ctx context.Context, fn func(token string, b []byte) error) error {
+	sc, ok := s.store.(Scanner)
+	if !ok {
+		return s.unsupported("Scan")
+	}
+	return s.fn(ctx, OpScan, "", func(ctx context.Context) error {
+		return sc.Scan(ctx, fn)
+	})
+}
+
+func (s *interceptStore) QuerySessions(ctx context.Context, expiryFrom, expiryTo time.Time, keyEquals map[string]string, offset, limit int, match func(token string, b []byte) bool) (tokens []string, bs [][]byte, err error) {
+	qs, ok := s.store.(QueryableStore)
+	if !ok {
+		return nil, nil, s.unsupported("QuerySessions")
+	}
+	err = s.fn(ctx, OpQuery, "", func(ctx context.Context) (err error) {
+		tokens, bs, err = qs.QuerySessions(ctx, expiryFrom, expiryTo, keyEquals, offset, limit, match)
+		return err
+	})
+	return tokens, bs, err
+}
+
+func (s *interceptStore) FindVersion(ctx context.Context, token string) (b []byte, version int64, found bool, err error) {
+	cs, ok := s.store.(CASStore)
+	if !ok {
+		return nil, 0, false, s.unsupported("FindVersion")
+	}
+	err = s.fn(ctx, OpFindVersion, token, func(ctx context.Context) (err error) {
+		b, version, found, err = cs.FindVersion(ctx, token)
+		return err
+	})
+	return b, version, found, err
+}
+
+func (s *interceptStore) SaveIfVersion(ctx context.Context, token string, b []byte, expiry time.Time, version int64) (newVersion int64, ok bool, err error) {
+	cs, ok := s.store.(CASStore)
+	if !ok {
+		return 0, false, s.unsupported("SaveIfVersion")
+	}
+	err = s.fn(ctx, OpSaveIfVersion, token, func(ctx context.Context) (err error) {
+		newVersion, ok, err = cs.SaveIfVersion(ctx, token, b, expiry, version)
+		return err
+	})
+	return newVersion, ok, err
+}
+
+// Unwrap 返回被包装的存储器
+func (s *interceptStore) Unwrap() Store {
+	return s.store
+}
+
+// Close 与Manager.Shutdown相同，停止被包装存储器的清理协程，或者关闭它
+func (s *interceptStore) Close() error {
+	if sc, ok := s.store.(interface{ StopCleanup() }); ok {
+		sc.StopCleanup()
+		return nil
+	}
+	if c, ok := s.store.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// interceptClientStore 包装客户端存储器，拦截MakeToken
+type interceptClientStore struct {
+	*interceptStore
+	cs clientStore
+}
+
+func (s *interceptClientStore) MakeToken(b []byte, expiry time.Time) (token string, err error) {
+	err = s.fn(context.Background(), OpMakeToken, "", func(context.Context) (err error) {
+		token, err = s.cs.MakeToken(b, expiry)
+		return err
+	})
+	return token, err
+}
+
+// TokenHash 返回token的摘要，用于日志和追踪，不暴露token本身
+func TokenHash(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,231 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipiao/session/stores/cookiestore"
+	"github.com/ipiao/session/stores/memstore"
+)
+
+// recorder 记录经过中间件的调用
+type recorder struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (r *recorder) middleware(name string) StoreMiddleware {
+	return InterceptStore(func(ctx context.Context, op, token string, call func(ctx context.Context) error) error {
+		r.mu.Lock()
+		r.calls = append(r.calls, name+":"+op)
+		r.mu.Unlock()
+		return call(ctx)
+	})
+}
+
+func (r *recorder) reset() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	calls := r.calls
+	r.calls = nil
+	return calls
+}
+
+// errStore 保存总是失败的存储器
+type errStore struct {
+	*memstore.MemStore
+}
+
+var errSave = errors.New("save failed")
+
+func (s errStore) SaveCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	return errSave
+}
+
+func TestChainStore(t *testing.T) {
+	var r recorder
+	store := ChainStore(newMapStore(), r.middleware("outer"), r.middleware("inner"))
+	store.Save("token", []byte("data"), time.Now().Add(time.Minute))
+	if calls := strings.Join(r.reset(), ","); calls != "outer:save,inner:save" {
+		t.Fatalf("got %s: expected the first middleware to be the outermost", calls)
+	}
+
+	if err := store.(Scanner).Scan(context.Background(), nil); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("got %v: expected %v", err, errors.ErrUnsupported)
+	}
+}
+
+func TestStoreMiddlewares(t *testing.T) {
+	var r recorder
+	m := NewManager(newVersionStore(), OptimisticLock(ConflictFail), StoreMiddlewares(r.middleware("mw")))
+	r.reset()
+
+	s, _ := m.NewSession()
+	if err := s.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if calls := r.reset(); len(calls) != 1 || calls[0] != "mw:"+OpSaveIfVersion {
+		t.Fatalf("got %v: expected the CAS save to go through the middleware", calls)
+	}
+
+	// 被包装的存储器不支持CASStore时按不支持处理
+	m = NewManager(memstore.New(0), OptimisticLock(ConflictFail), StoreMiddlewares(r.middleware("mw")))
+	s, _ = m.NewSession()
+	if err := s.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if calls := r.reset(); calls[len(calls)-1] != "mw:"+OpSave {
+		t.Fatalf("got %v: expected a plain save", calls)
+	}
+}
+
+func TestInterceptClientStore(t *testing.T) {
+	var r recorder
+	store := cookiestore.New([]byte("G_TdvPJ9T8C4p&A?Wr3YAUYW$*9vn4?t"))
+	m := NewManager(store, StoreMiddlewares(r.middleware("mw")))
+	if _, ok := m.store.(clientStore); !ok {
+		t.Fatal("expected the wrapped cookiestore to be a client store")
+	}
+
+	h := m.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, _ := m.Load(r)
+		s.Put("key", "value")
+	}))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	var made bool
+	for _, call := range r.reset() {
+		made = made || call == "mw:"+OpMakeToken
+	}
+	if !made {
+		t.Fatal("expected MakeToken to go through the middleware")
+	}
+}
+
+func TestLogStore(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	store := ChainStore(memstore.New(0), LogStore(logger))
+
+	store.Save("secret_token", []byte("data"), time.Now().Add(time.Minute))
+	out := buf.String()
+	if !strings.Contains(out, "level=DEBUG") || !strings.Contains(out, "op=save") ||
+		!strings.Contains(out, "token="+TokenHash("secret_token")) || !strings.Contains(out, "latency=") {
+		t.Fatalf("got %q: expected the op, token hash and latency", out)
+	}
+	if strings.Contains(out, "secret_token") {
+		t.Fatal("expected the token not to be logged")
+	}
+
+	buf.Reset()
+	store = ChainStore(errStore{memstore.New(0)}, LogStore(logger))
+	store.Save("secret_token", []byte("data"), time.Now().Add(time.Minute))
+	if out = buf.String(); !strings.Contains(out, "level=ERROR") || !strings.Contains(out, `error="save failed"`) {
+		t.Fatalf("got %q: expected the error", out)
+	}
+}
+
+// memCounter 内存中的计数器和直方图
+type memCounter struct {
+	mu     sync.Mutex
+	values map[string][]float64
+}
+
+type memMetric struct {
+	c   *memCounter
+	key string
+}
+
+func (m memMetric) Add(v float64)     { m.c.add(m.key, v) }
+func (m memMetric) Observe(v float64) { m.c.add(m.key, v) }
+
+func (c *memCounter) add(key string, v float64) {
+	c.mu.Lock()
+	c.values[key] = append(c.values[key], v)
+	c.mu.Unlock()
+}
+
+func TestMetricsStore(t *testing.T) {
+	c := &memCounter{values: make(map[string][]float64)}
+	store := ChainStore(errStore{memstore.New(0)}, MetricsStore(StoreMetrics{
+		Calls:   func(op, result string) Counter { return memMetric{c, "calls:" + op + ":" + result} },
+		Latency: func(op string) Observer { return memMetric{c, "latency:" + op} },
+	}))
+
+	store.Save("token", []byte("data"), time.Now().Add(time.Minute))
+	store.Find("token")
+	store.Find("token")
+	for key, n := range map[string]int{"calls:save:error": 1, "calls:find:ok": 2, "latency:save": 1, "latency:find": 2} {
+		if got := len(c.values[key]); got != n {
+			t.Fatalf("got %d: expected %d for %s", got, n, key)
+		}
+	}
+	if v := c.values["latency:find"][0]; v < 0 || v > 1 {
+		t.Fatalf("got %v: expected the latency in seconds", v)
+	}
+}
+
+// memSpan 内存中记录的span
+type memSpan struct {
+	name  string
+	attrs map[string]string
+	err   error
+	ended bool
+}
+
+type memTracer struct {
+	spans []*memSpan
+}
+
+type spanKey struct{}
+
+func (t *memTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	s := &memSpan{name: name, attrs: make(map[string]string)}
+	t.spans = append(t.spans, s)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (s *memSpan) SetAttribute(key, value string) { s.attrs[key] = value }
+func (s *memSpan) RecordError(err error)          { s.err = err }
+func (s *memSpan) End()                           { s.ended = true }
+
+// ctxStore 检查调用时上下文中的span
+type ctxStore struct {
+	errStore
+	span *memSpan
+}
+
+func (s *ctxStore) SaveCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	s.span, _ = ctx.Value(spanKey{}).(*memSpan)
+	return s.errStore.SaveCtx(ctx, token, b, expiry)
+}
+
+func TestTraceStore(t *testing.T) {
+	var tracer memTracer
+	inner := &ctxStore{errStore: errStore{memstore.New(0)}}
+	store := ChainStore(inner, TraceStore(&tracer))
+
+	store.Save("token", []byte("data"), time.Now().Add(time.Minute))
+	store.Loads()
+	if len(tracer.spans) != 2 {
+		t.Fatalf("got %d spans: expected 2", len(tracer.spans))
+	}
+	s := tracer.spans[0]
+	if s.name != "scs.store.save" || s.attrs["scs.store.op"] != OpSave || s.attrs["scs.token"] != TokenHash("token") {
+		t.Fatalf("got %s %v: expected the save span", s.name, s.attrs)
+	}
+	if s.err != errSave || !s.ended || inner.span != s {
+		t.Fatal("expected the span to be ended with the error and passed to the store")
+	}
+	if s = tracer.spans[1]; s.name != "scs.store.loads" || s.err != nil || s.attrs["scs.token"] != "" {
+		t.Fatalf("got %s %v %v: expected the loads span", s.name, s.attrs, s.err)
+	}
+}
@@ -1,6 +1,10 @@
 package session
 
 import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
 	"time"
 )
 
@@ -16,9 +20,49 @@ type Options struct {
 	path          string
 	persist       bool
 	secure        bool
-	touchInterval time.Duration // 如果idleTimeout>0，刷新token的时间间隔，不必每个请求都刷新一边
+	sameSite      http.SameSite
+	partitioned   bool             // CHIPS分区cookie
+	cookiePrefix  string           // cookie名称前缀，__Secure-或者__Host-
+	err           error            // 配置错误，由NewOptions检查
+	touchInterval time.Duration    // 如果idleTimeout>0，刷新token的时间间隔，不必每个请求都刷新一边
+	codec         Codec            // session数据编解码器，默认JSON
+	deferWrite    bool             // 延迟写入，修改只标记session，由Commit统一写入
+	conflictMode  ConflictMode     // 乐观锁，保存冲突时的处理方式
+	transports    []TokenTransport // token的传递方式，默认cookie
+
+	locker   Locker        // 同一个session的请求串行处理，nil表示不加锁
+	lockWait time.Duration // 等待锁的最长时间
+	lockTTL  time.Duration // 锁的最长持有时间
+
+	warmUpMode        WarmUpMode // 启动时预热session的方式
+	warmUpLimit       int        // 预热放入manager的session数量上限，0表示不限制
+	warmUpConcurrency int        // 预热时并发解码的数量
+
+	maxUserSessions int       // 单个用户允许的session数量，0表示不限制
+	loginMode       LoginMode // 超出maxUserSessions时的处理方式
+	userIndex       UserIndex // 用户与session的索引
+
+	bindIPv4Bits   int          // 绑定ipv4网段的位数，0表示不绑定
+	bindIPv6Bits   int          // 绑定ipv6网段的位数，0表示不绑定
+	bindUA         bool         // 绑定User-Agent
+	bindMismatch   MismatchMode // 绑定信息不一致时的处理方式
+	trustedProxies []*net.IPNet // 可信代理，只有来自可信代理的请求才使用X-Forwarded-For和X-Real-IP
+
+	storeMiddlewares []StoreMiddleware // 包装存储器的中间件
 }
 
+// LoginMode 单个用户session数量超出限制时的处理方式
+type LoginMode int
+
+const (
+	// LoginAllow 允许登录，不做限制
+	LoginAllow LoginMode = iota
+	// LoginReject 拒绝新的登录
+	LoginReject
+	// LoginEvictOldest 踢出最早登录的session
+	LoginEvictOldest
+)
+
 // NewOptions 新建Options
 func NewOptions(opts ...Option) Options {
 	var options = Options{
@@ -31,12 +75,68 @@ func NewOptions(opts ...Option) Options {
 	if options.name == "" {
 		options.name = defaultName
 	}
+	options.applyCookiePrefix()
 	if options.lifetime == 0 {
 		options.lifetime = time.Hour * 24
 	}
+	if options.codec == nil {
+		options.codec = JSONCodec{}
+	}
+	if options.userIndex == nil {
+		options.userIndex = NewMemUserIndex()
+	}
+	if len(options.transports) == 0 {
+		options.transports = []TokenTransport{CookieTransport()}
+	}
+	options.err = options.validate()
 	return options
 }
 
+// Err 返回配置错误
+// 存在配置错误时，写入cookie会返回这个错误，而不是写出被浏览器丢弃的cookie
+func (o Options) Err() error {
+	return o.err
+}
+
+// applyCookiePrefix 给cookie名称加上前缀
+func (o *Options) applyCookiePrefix() {
+	if o.cookiePrefix != "" && !strings.HasPrefix(o.name, o.cookiePrefix) {
+		o.name = o.cookiePrefix + o.name
+	}
+}
+
+// validate 按照浏览器的规则检查cookie的配置，并检查BindIP的网段位数
+func (o *Options) validate() error {
+	var errs []error
+	if o.cookiePrefix != "" && o.cookiePrefix != SecurePrefix && o.cookiePrefix != HostPrefix {
+		errs = append(errs, errors.New("scs: cookie prefix must be __Secure- or __Host-"))
+	}
+	if o.sameSite == http.SameSiteNoneMode && !o.secure {
+		errs = append(errs, errors.New("scs: SameSite=None requires Secure"))
+	}
+	if o.partitioned && !o.secure {
+		errs = append(errs, errors.New("scs: Partitioned requires Secure"))
+	}
+	if strings.HasPrefix(o.name, SecurePrefix) && !o.secure {
+		errs = append(errs, errors.New("scs: __Secure- prefix requires Secure"))
+	}
+	if strings.HasPrefix(o.name, HostPrefix) {
+		if !o.secure {
+			errs = append(errs, errors.New("scs: __Host- prefix requires Secure"))
+		}
+		if o.path != "/" {
+			errs = append(errs, errors.New("scs: __Host- prefix requires Path=/"))
+		}
+		if o.domain != "" {
+			errs = append(errs, errors.New("scs: __Host- prefix does not allow Domain"))
+		}
+	}
+	if o.bindIPv4Bits < 0 || o.bindIPv6Bits < 0 {
+		errs = append(errs, errors.New("scs: BindIP bits must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
 // Option 处理option赋值
 type Option func(o *Options)
 
@@ -96,9 +196,157 @@ func Secure(b bool) Option {
 	}
 }
 
+// cookie名称前缀
+const (
+	// SecurePrefix 要求Secure
+	SecurePrefix = "__Secure-"
+	// HostPrefix 要求Secure、Path=/并且不能设置Domain
+	HostPrefix = "__Host-"
+)
+
+// SameSite 设置cookie的SameSite，SameSite=None要求Secure
+func SameSite(mode http.SameSite) Option {
+	return func(o *Options) {
+		o.sameSite = mode
+	}
+}
+
+// Partitioned 设置CHIPS分区cookie，要求Secure
+func Partitioned(b bool) Option {
+	return func(o *Options) {
+		o.partitioned = b
+	}
+}
+
+// CookiePrefix 给cookie名称加上前缀，SecurePrefix或者HostPrefix
+func CookiePrefix(prefix string) Option {
+	return func(o *Options) {
+		o.cookiePrefix = prefix
+	}
+}
+
 // TouchInterval ..
 func TouchInterval(d time.Duration) Option {
 	return func(o *Options) {
 		o.touchInterval = d
 	}
 }
+
+// UseCodec 设置编解码器
+// 更换编解码器时，可以使用MigrateCodec读取旧编解码器写入的数据
+func UseCodec(c Codec) Option {
+	return func(o *Options) {
+		if c == nil {
+			c = JSONCodec{}
+		}
+		o.codec = c
+	}
+}
+
+// Transports 设置token的传递方式，默认只使用cookie
+// Load时按顺序读取token，返回时使用读取到token的方式写回，新建的session使用所有方式写回
+func Transports(ts ...TokenTransport) Option {
+	return func(o *Options) {
+		o.transports = ts
+	}
+}
+
+// WarmUp 设置启动时从存储器预热session到manager的方式，默认WarmUpSync
+// limit为放入manager的session数量上限，0表示不限制；concurrency为并发解码的数量
+func WarmUp(mode WarmUpMode, limit, concurrency int) Option {
+	return func(o *Options) {
+		o.warmUpMode = mode
+		o.warmUpLimit = limit
+		o.warmUpConcurrency = concurrency
+	}
+}
+
+// OptimisticLock 存储器实现了CASStore时，按版本号保存session，检测并发请求的修改冲突
+// ConflictFail时返回ErrConflict，ConflictMerge时合并本次请求的修改后重试
+func OptimisticLock(mode ConflictMode) Option {
+	return func(o *Options) {
+		o.conflictMode = mode
+	}
+}
+
+// SerializeRequests Manager.Use在加载session之前按session的id加锁，提交之后释放，同一个session的请求依次处理
+// wait为等待锁的最长时间，超时返回503，默认10秒；ttl为锁的最长持有时间，默认30秒
+// 多实例部署时使用redisstore、mysqlstore、pgstore提供的分布式锁，单实例可以使用NewMemLocker
+func SerializeRequests(locker Locker, wait, ttl time.Duration) Option {
+	return func(o *Options) {
+		if wait <= 0 {
+			wait = defaultLockWait
+		}
+		if ttl <= 0 {
+			ttl = defaultLockTTL
+		}
+		o.locker = locker
+		o.lockWait = wait
+		o.lockTTL = ttl
+	}
+}
+
+// DeferWrite 延迟写入
+// 开启后Put、Pop、Remove、Clear等修改只标记session为已修改，不再每次都写入存储器
+// 由Manager.Use在请求结束或者写出响应头之前统一提交，不使用Use时需要调用Session.Commit
+func DeferWrite(b bool) Option {
+	return func(o *Options) {
+		o.deferWrite = b
+	}
+}
+
+// MaxSessionsPerUser 限制单个用户同时存在的session数量，在Manager.Login时执行
+func MaxSessionsPerUser(n int, mode LoginMode) Option {
+	return func(o *Options) {
+		o.maxUserSessions = n
+		o.loginMode = mode
+	}
+}
+
+// UseUserIndex 设置用户索引，默认为进程内索引
+// 多实例部署时应使用NewStoreUserIndex
+func UseUserIndex(idx UserIndex) Option {
+	return func(o *Options) {
+		if idx == nil {
+			idx = NewMemUserIndex()
+		}
+		o.userIndex = idx
+	}
+}
+
+// BindIP 在创建时将session绑定到客户端ip网段，Load时网段不一致的session按BindMismatch处理
+// v4Bits/v6Bits为网段位数，如BindIP(32, 128)绑定单个ip，BindIP(24, 64)绑定/24和/64网段，0表示不绑定，负数是配置错误
+func BindIP(v4Bits, v6Bits int) Option {
+	return func(o *Options) {
+		if v4Bits > 32 {
+			v4Bits = 32
+		}
+		if v6Bits > 128 {
+			v6Bits = 128
+		}
+		o.bindIPv4Bits = v4Bits
+		o.bindIPv6Bits = v6Bits
+	}
+}
+
+// BindUserAgent 在创建时将session绑定到User-Agent指纹
+func BindUserAgent(b bool) Option {
+	return func(o *Options) {
+		o.bindUA = b
+	}
+}
+
+// BindMismatch 设置绑定信息不一致时的处理方式，默认MismatchReject
+func BindMismatch(mode MismatchMode) Option {
+	return func(o *Options) {
+		o.bindMismatch = mode
+	}
+}
+
+// TrustedProxies 设置可信代理，支持CIDR和单个ip
+// 只有RemoteAddr属于可信代理时，才会从X-Forwarded-For或者X-Real-IP中获取客户端ip
+func TrustedProxies(proxies ...string) Option {
+	return func(o *Options) {
+		o.trustedProxies = parseTrustedProxies(proxies)
+	}
+}
@@ -0,0 +1,75 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ipiao/session/stores/memstore"
+)
+
+func TestOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		err  string
+	}{
+		{"default", nil, ""},
+		{"samesite none", []Option{SameSite(http.SameSiteNoneMode)}, "SameSite=None requires Secure"},
+		{"samesite none secure", []Option{SameSite(http.SameSiteNoneMode), Secure(true)}, ""},
+		{"partitioned", []Option{Partitioned(true)}, "Partitioned requires Secure"},
+		{"secure prefix", []Option{CookiePrefix(SecurePrefix)}, "__Secure- prefix requires Secure"},
+		{"secure prefix name", []Option{Name("__Secure-sid")}, "__Secure- prefix requires Secure"},
+		{"host prefix path", []Option{CookiePrefix(HostPrefix), Secure(true), Path("/app")}, "__Host- prefix requires Path=/"},
+		{"host prefix domain", []Option{CookiePrefix(HostPrefix), Secure(true), Domain("example.com")}, "__Host- prefix does not allow Domain"},
+		{"host prefix", []Option{CookiePrefix(HostPrefix), Secure(true)}, ""},
+		{"bad prefix", []Option{CookiePrefix("__Foo-")}, "cookie prefix must be"},
+		{"negative bind ip", []Option{BindIP(-1, 64)}, "BindIP bits must not be negative"},
+	}
+	for _, tt := range tests {
+		err := NewOptions(tt.opts...).Err()
+		if tt.err == "" {
+			if err != nil {
+				t.Fatalf("%s: got %v: expected no error", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Fatalf("%s: got %v: expected %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestCookieAttributes(t *testing.T) {
+	m := NewManager(memstore.New(0), CookiePrefix(HostPrefix), Secure(true),
+		SameSite(http.SameSiteNoneMode), Partitioned(true))
+	if err := m.Err(); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := m.NewSession()
+	rr := httptest.NewRecorder()
+	if err := s.WriteToResponseWriter(rr); err != nil {
+		t.Fatal(err)
+	}
+	header := rr.Header().Get("Set-Cookie")
+	for _, want := range []string{"__Host-session=", "Secure", "SameSite=None", "Partitioned"} {
+		if !strings.Contains(header, want) {
+			t.Fatalf("got %q: expected %q", header, want)
+		}
+	}
+
+	// 配置错误时不写出cookie
+	m.Option(Secure(false))
+	if m.Err() == nil {
+		t.Fatal("expected a configuration error")
+	}
+	s, _ = m.NewSession()
+	rr = httptest.NewRecorder()
+	if err := s.WriteToResponseWriter(rr); err == nil {
+		t.Fatal("expected the cookie to be rejected")
+	}
+	if v := rr.Header().Get("Set-Cookie"); v != "" {
+		t.Fatalf("got %q: expected no cookie", v)
+	}
+}
@@ -0,0 +1,51 @@
+// Package otelsession adapts OpenTelemetry tracing to the session package, for use
+// with session.TraceStore:
+//
+//	m := session.NewManager(store, session.StoreMiddlewares(
+//		session.TraceStore(otelsession.Tracer(otel.Tracer("session"))),
+//	))
+//
+// In tests, the spans can be recorded without a collector by a tracer of a
+// TracerProvider with a tracetest.SpanRecorder.
+package otelsession
+
+import (
+	"context"
+
+	"github.com/ipiao/session"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer returns a session.Tracer which starts the spans with t. The spans are
+// client spans.
+func Tracer(t trace.Tracer) session.Tracer {
+	return tracer{t}
+}
+
+type tracer struct {
+	t trace.Tracer
+}
+
+func (t tracer) Start(ctx context.Context, name string) (context.Context, session.Span) {
+	ctx, s := t.t.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+	return ctx, span{s}
+}
+
+type span struct {
+	s trace.Span
+}
+
+func (s span) SetAttribute(key, value string) {
+	s.s.SetAttributes(attribute.String(key, value))
+}
+
+func (s span) RecordError(err error) {
+	s.s.RecordError(err)
+	s.s.SetStatus(codes.Error, err.Error())
+}
+
+func (s span) End() {
+	s.s.End()
+}
@@ -0,0 +1,75 @@
+package otelsession
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ipiao/session"
+	"github.com/ipiao/session/stores/memstore"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var errSave = errors.New("save failed")
+
+// errStore is a store whose saves always fail
+type errStore struct {
+	*memstore.MemStore
+}
+
+func (s errStore) SaveCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	return errSave
+}
+
+func attrs(s sdktrace.ReadOnlySpan) map[attribute.Key]string {
+	m := make(map[attribute.Key]string)
+	for _, kv := range s.Attributes() {
+		m[kv.Key] = kv.Value.AsString()
+	}
+	return m
+}
+
+func TestTracer(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	store := session.ChainStore(errStore{memstore.New(0)}, session.TraceStore(Tracer(tp.Tracer("session"))))
+
+	store.Save("token", []byte("data"), time.Now().Add(time.Minute))
+	store.Loads()
+	spans := sr.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans: expected 2", len(spans))
+	}
+
+	s := spans[0]
+	a := attrs(s)
+	if s.Name() != "scs.store.save" || s.SpanKind() != trace.SpanKindClient {
+		t.Fatalf("got %s %v: expected the client save span", s.Name(), s.SpanKind())
+	}
+	if a["scs.store.op"] != session.OpSave || a["scs.token"] != session.TokenHash("token") {
+		t.Fatalf("got %v: expected the op and token hash attributes", a)
+	}
+	if s.Status().Code != codes.Error || s.Status().Description != errSave.Error() {
+		t.Fatalf("got %v: expected the error status", s.Status())
+	}
+	if len(s.Events()) != 1 || s.Events()[0].Name != "exception" {
+		t.Fatalf("got %v: expected the error to be recorded", s.Events())
+	}
+
+	s = spans[1]
+	a = attrs(s)
+	if s.Name() != "scs.store.loads" || a["scs.store.op"] != session.OpLoads {
+		t.Fatalf("got %s %v: expected the loads span", s.Name(), a)
+	}
+	if _, ok := a["scs.token"]; ok {
+		t.Fatal("expected no token attribute without a token")
+	}
+	if s.Status().Code != codes.Unset || len(s.Events()) != 0 {
+		t.Fatalf("got %v: expected no error", s.Status())
+	}
+}
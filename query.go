@@ -0,0 +1,221 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Query 结构化的session查询，可以下推到存储器执行
+type Query struct {
+	KeyEquals    map[string]interface{} // data中的键值相等，值会按照编解码规则转换后比较
+	ExpiryAfter  time.Time              // 过期时间不早于，零值表示不限制
+	ExpiryBefore time.Time              // 过期时间早于，零值表示不限制
+	Offset       int                    // 跳过的数量
+	Limit        int                    // 返回的最大数量，0表示不限制
+}
+
+// QueryableStore 支持查询下推的存储器
+// 只返回未过期的session，并且过期时间在[expiryFrom, expiryTo)之间(零值表示不限制)，按过期时间升序
+// keyEquals是data中的键与JSON编码后的值，由存储器按JSON值比较，只在使用JSONCodec时传入
+// 存储器保存的是编码后的数据，其余data的比较通过match完成(nil表示全部匹配)，offset和limit作用于match之后的结果
+type QueryableStore interface {
+	QuerySessions(ctx context.Context, expiryFrom, expiryTo time.Time, keyEquals map[string]string, offset, limit int, match func(token string, b []byte) bool) (tokens []string, bs [][]byte, err error)
+}
+
+// FindStoreSeesion 在存储器中查找session，多实例部署时可以查到其他实例的session
+// 存储器实现了QueryableStore时，过期时间和分页下推到存储器执行，使用JSONCodec时KeyEquals中的字符串、布尔和数值也下推到存储器，
+// 按JSON值比较，类型需要与保存时一致；
+// 否则通过Scanner遍历或者Loads加载全部数据，解码后过滤，此时按session的deadline过滤，Loads无法得到token，查到的session的token为空
+// fds在解码后执行，Query的分页作用于fds过滤之后的结果；解码后的值是编解码之后的类型，
+// 如JSONCodec下数值为json.Number，FindByKVEq需要使用相同的类型
+func (m *Manager) FindStoreSeesion(ctx context.Context, q Query, fds ...Finder) ([]*Session, error) {
+	fd := MakeFinder(fds...)
+	var ret = make([]*Session, 0)
+
+	qs, ok := m.store.(QueryableStore)
+	if ok {
+		keyEquals, rest := q.pushKeys(m.opts.codec)
+		matched := make(map[string]*Session)
+		match := func(token string, b []byte) bool {
+			s, err := m.decodeSession(ctx, token, b)
+			if err != nil || !rest.matchData(s.data) || !fd(s) {
+				return false
+			}
+			matched[token] = s
+			return true
+		}
+		if len(rest.KeyEquals) == 0 && len(fds) == 0 {
+			match = nil
+		}
+		start := time.Now()
+		tokens, bs, err := qs.QuerySessions(ctx, q.ExpiryAfter, q.ExpiryBefore, keyEquals, q.Offset, q.Limit, match)
+		// 装饰器包装的存储器不支持查询时按未实现处理
+		if !errors.Is(err, errors.ErrUnsupported) {
+			m.stats.observe(OpQuery, start, err)
+			if err != nil {
+				return nil, err
+			}
+			for i, b := range bs {
+				s, ok := matched[tokens[i]]
+				if !ok {
+					// 跳过无法解码的数据
+					s, err = m.decodeSession(ctx, tokens[i], b)
+					if err != nil {
+						continue
+					}
+				}
+				ret = append(ret, s)
+			}
+			return ret, nil
+		}
+	}
+
+	// 无法下推，遍历全部数据后过滤
+	add := func(token string, b []byte) error {
+		s, err := m.decodeSession(ctx, token, b)
+		if err != nil {
+			return nil
+		}
+		if s.TimeOut() || !q.matchExpiry(s.deadline) || !q.matchData(s.data) || !fd(s) {
+			return nil
+		}
+		ret = append(ret, s)
+		return nil
+	}
+	sc, scan := m.store.(Scanner)
+	if scan {
+		start := time.Now()
+		err := sc.Scan(ctx, add)
+		if errors.Is(err, errors.ErrUnsupported) {
+			scan = false
+		} else {
+			m.stats.observe(OpScan, start, err)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !scan {
+		bs, err := m.storeCtx().LoadsCtx(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range bs {
+			add("", b)
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].deadline.Before(ret[j].deadline)
+	})
+	if q.Offset >= len(ret) {
+		return ret[:0], nil
+	}
+	ret = ret[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(ret) {
+		ret = ret[:q.Limit]
+	}
+	return ret, nil
+}
+
+// pushKeys 将KeyEquals中可以按JSON值比较的键值编码后下推到存储器，返回下推的键值和剩余的查询条件
+// 只有JSONCodec编码的数据可以在存储器中比较
+func (q *Query) pushKeys(codec Codec) (map[string]string, *Query) {
+	rest := &Query{KeyEquals: make(map[string]interface{})}
+	if _, ok := codec.(JSONCodec); !ok {
+		rest.KeyEquals = q.KeyEquals
+		return nil, rest
+	}
+	var keyEquals map[string]string
+	for k, v := range q.KeyEquals {
+		if !isJSONScalar(v) {
+			rest.KeyEquals[k] = v
+			continue
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			rest.KeyEquals[k] = v
+			continue
+		}
+		if keyEquals == nil {
+			keyEquals = make(map[string]string)
+		}
+		keyEquals[k] = string(b)
+	}
+	return keyEquals, rest
+}
+
+// isJSONScalar JSON编码后可以直接比较的值
+func isJSONScalar(v interface{}) bool {
+	switch v.(type) {
+	case string, bool, json.Number,
+		int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64,
+		float32, float64:
+		return true
+	}
+	return false
+}
+
+// decodeSession 根据存储器中的数据生成session
+func (m *Manager) decodeSession(ctx context.Context, token string, b []byte) (*Session, error) {
+	id, data, deadline, err := m.opts.codec.Decode(b)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{
+		sessionState: &sessionState{
+			id:       id,
+			token:    token,
+			data:     data,
+			deadline: deadline,
+			store:    m.store,
+			opts:     m.opts,
+			stats:    m.stats,
+			hooks:    m.hooks,
+			sessions: m.sessions,
+		},
+		ctx: ctx,
+	}, nil
+}
+
+func (q *Query) matchExpiry(expiry time.Time) bool {
+	if !q.ExpiryAfter.IsZero() && expiry.Before(q.ExpiryAfter) {
+		return false
+	}
+	if !q.ExpiryBefore.IsZero() && !expiry.Before(q.ExpiryBefore) {
+		return false
+	}
+	return true
+}
+
+func (q *Query) matchData(data map[string]interface{}) bool {
+	for k, want := range q.KeyEquals {
+		v, ok := data[k]
+		if !ok || !valueEquals(v, want) {
+			return false
+		}
+	}
+	return true
+}
+
+// valueEquals 比较session中的值与给定值，session中的值会先转换为给定值的类型
+func valueEquals(v, want interface{}) bool {
+	if v == nil || want == nil {
+		return v == want
+	}
+	if reflect.DeepEqual(v, want) {
+		return true
+	}
+	rv := reflect.New(reflect.TypeOf(want)).Elem()
+	if convertValue(rv, v) != nil {
+		return false
+	}
+	if tm, ok := want.(time.Time); ok {
+		return tm.Equal(rv.Interface().(time.Time))
+	}
+	return reflect.DeepEqual(rv.Interface(), want)
+}
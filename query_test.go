@@ -0,0 +1,175 @@
+package session
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipiao/session/stores/memstore"
+)
+
+// mapStore 只实现了Store的存储器，用于测试无法下推查询的情况
+type mapStore struct {
+	data map[string][]byte
+	mu   sync.Mutex
+}
+
+func newMapStore() *mapStore {
+	return &mapStore{data: make(map[string][]byte)}
+}
+
+func (m *mapStore) Save(token string, b []byte, expiry time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data[token] = b
+	return nil
+}
+
+func (m *mapStore) Delete(token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.data, token)
+	return nil
+}
+
+func (m *mapStore) Find(token string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.data[token]
+	return b, ok, nil
+}
+
+func (m *mapStore) Dumps() error {
+	return nil
+}
+
+func (m *mapStore) Loads() ([][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var bs [][]byte
+	for _, b := range m.data {
+		bs = append(bs, b)
+	}
+	return bs, nil
+}
+
+func TestFindStoreSeesion(t *testing.T) {
+	for name, store := range map[string]Store{"queryable": memstore.New(0), "fallback": newMapStore()} {
+		m := NewManager(store)
+		for i := 0; i < 5; i++ {
+			s, err := m.NewSession()
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.deadline = time.Now().Add(time.Duration(i+1) * time.Minute)
+			if err = s.Put("n", i); err != nil {
+				t.Fatal(err)
+			}
+			if err = s.Put("odd", i%2 == 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		ss, err := m.FindStoreSeesion(context.Background(), Query{KeyEquals: map[string]interface{}{"odd": false}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ss) != 3 {
+			t.Fatalf("%s: got %d: expected %d", name, len(ss), 3)
+		}
+
+		ss, err = m.FindStoreSeesion(context.Background(), Query{
+			KeyEquals: map[string]interface{}{"odd": false},
+			Offset:    1,
+			Limit:     1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ss) != 1 || GetOr(ss[0], "n", -1) != 2 {
+			t.Fatalf("%s: got %v: expected the session with n=2", name, ss)
+		}
+
+		ss, err = m.FindStoreSeesion(context.Background(), Query{
+			ExpiryAfter:  time.Now().Add(90 * time.Second),
+			ExpiryBefore: time.Now().Add(270 * time.Second),
+		}, FindByKVEq("odd", true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ss) != 2 || GetOr(ss[0], "n", -1) != 1 || GetOr(ss[1], "n", -1) != 3 {
+			t.Fatalf("%s: got %v: expected the sessions with n=1 and n=3", name, ss)
+		}
+		if name == "queryable" && ss[0].GetToken() == "" {
+			t.Fatalf("%s: expected the session token", name)
+		}
+	}
+}
+
+// keyStore 记录下推到存储器的keyEquals
+type keyStore struct {
+	*memstore.MemStore
+	keyEquals map[string]string
+}
+
+func (k *keyStore) QuerySessions(ctx context.Context, expiryFrom, expiryTo time.Time, keyEquals map[string]string, offset, limit int, match func(token string, b []byte) bool) ([]string, [][]byte, error) {
+	k.keyEquals = keyEquals
+	return k.MemStore.QuerySessions(ctx, expiryFrom, expiryTo, keyEquals, offset, limit, match)
+}
+
+func TestFindStoreSeesionPushKeys(t *testing.T) {
+	store := &keyStore{MemStore: memstore.New(0)}
+	m := NewManager(store)
+	for _, name := range []string{"alice", "bob"} {
+		s, err := m.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.Put("name", name); err != nil {
+			t.Fatal(err)
+		}
+		if err = s.Put("tags", []string{name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ss, err := m.FindStoreSeesion(context.Background(), Query{KeyEquals: map[string]interface{}{
+		"name": "alice",
+		"tags": []string{"alice"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ss) != 1 || GetOr(ss[0], "name", "") != "alice" {
+		t.Fatalf("got %v: expected the session of alice", ss)
+	}
+	if len(store.keyEquals) != 1 || store.keyEquals["name"] != `"alice"` {
+		t.Fatalf("got %v: expected only name to be pushed down", store.keyEquals)
+	}
+}
+
+// TestFindSeesionStore FindSeesion只查找本进程的session，FindStoreSeesion查找其他实例保存在存储器中的session
+func TestFindSeesionStore(t *testing.T) {
+	store := memstore.New(0)
+	m1 := NewManager(store)
+	m2 := NewManager(store)
+	s, err := m2.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ss := m1.FindSeesion(FindByKVEq("key", "value")); len(ss) != 0 {
+		t.Fatalf("got %v: expected only the sessions of the manager", ss)
+	}
+	ss, err := m1.FindStoreSeesion(context.Background(), Query{}, FindByKVEq("key", "value"))
+	if err != nil || len(ss) != 1 || ss[0].GetID() != s.GetID() || ss[0].GetToken() != s.GetToken() {
+		t.Fatalf("got %v %v: expected the session saved by the other manager", ss, err)
+	}
+	if ss = m2.FindSeesion(FindByID(s.GetID())); len(ss) != 1 {
+		t.Fatalf("got %d sessions: expected the loaded session", len(ss))
+	}
+}
@@ -0,0 +1,135 @@
+package session
+
+import "sync"
+
+// registryShards registry的分片数量
+const registryShards = 64
+
+// registry manager中保存session的注册表
+// 按token分片，每个分片一把锁，减少多核下的锁竞争
+type registry struct {
+	shards [registryShards]registryShard
+}
+
+type registryShard struct {
+	mu       sync.RWMutex
+	sessions map[string]*Session
+}
+
+func newRegistry() *registry {
+	r := &registry{}
+	for i := range r.shards {
+		r.shards[i].sessions = make(map[string]*Session)
+	}
+	return r
+}
+
+// shard 返回token所在的分片，使用fnv-1a哈希
+func (r *registry) shard(token string) *registryShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(token); i++ {
+		h ^= uint32(token[i])
+		h *= 16777619
+	}
+	return &r.shards[h%registryShards]
+}
+
+// get 获取token对应的session
+func (r *registry) get(token string) (*Session, bool) {
+	sh := r.shard(token)
+	sh.mu.RLock()
+	s, ok := sh.sessions[token]
+	sh.mu.RUnlock()
+	return s, ok
+}
+
+// set 保存session
+func (r *registry) set(token string, s *Session) {
+	sh := r.shard(token)
+	sh.mu.Lock()
+	sh.sessions[token] = s
+	sh.mu.Unlock()
+}
+
+// add token不存在时保存session，返回是否保存
+func (r *registry) add(token string, s *Session) bool {
+	sh := r.shard(token)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, ok := sh.sessions[token]; ok {
+		return false
+	}
+	sh.sessions[token] = s
+	return true
+}
+
+// remove 删除并返回token对应的session
+func (r *registry) remove(token string) (*Session, bool) {
+	sh := r.shard(token)
+	sh.mu.Lock()
+	s, ok := sh.sessions[token]
+	delete(sh.sessions, token)
+	sh.mu.Unlock()
+	return s, ok
+}
+
+// rekey token变更时更新索引，只有旧token对应的仍然是s(共享数据的session)时才更新
+func (r *registry) rekey(oldToken, newToken string, s *Session) bool {
+	sh := r.shard(oldToken)
+	sh.mu.Lock()
+	ms, ok := sh.sessions[oldToken]
+	same := ok && ms.sessionState == s.sessionState
+	if same {
+		delete(sh.sessions, oldToken)
+	}
+	sh.mu.Unlock()
+	if !same {
+		return false
+	}
+	r.set(newToken, ms)
+	return true
+}
+
+// len session数量
+func (r *registry) len() int {
+	var n int
+	for i := range r.shards {
+		sh := &r.shards[i]
+		sh.mu.RLock()
+		n += len(sh.sessions)
+		sh.mu.RUnlock()
+	}
+	return n
+}
+
+// snapshot 返回所有session的快照
+// 遍历快照时不持有锁，可以在遍历过程中修改registry
+func (r *registry) snapshot() []*Session {
+	ret := make([]*Session, 0, r.len())
+	for i := range r.shards {
+		sh := &r.shards[i]
+		sh.mu.RLock()
+		for _, s := range sh.sessions {
+			ret = append(ret, s)
+		}
+		sh.mu.RUnlock()
+	}
+	return ret
+}
+
+// removeIf 删除满足条件的session并返回，逐个分片加锁，不会阻塞整个registry
+func (r *registry) removeIf(fn func(*Session) bool) []*Session {
+	var ret []*Session
+	for i := range r.shards {
+		sh := &r.shards[i]
+		sh.mu.Lock()
+		for k, s := range sh.sessions {
+			if fn(s) {
+				delete(sh.sessions, k)
+				ret = append(ret, s)
+			}
+		}
+		sh.mu.Unlock()
+	}
+	return ret
+}
@@ -0,0 +1,202 @@
+package session
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipiao/session/stores/memstore"
+)
+
+func TestRegistry(t *testing.T) {
+	r := newRegistry()
+	s1 := &Session{sessionState: &sessionState{token: "t1"}}
+	s2 := &Session{sessionState: &sessionState{token: "t2"}}
+	r.set("t1", s1)
+	r.set("t2", s2)
+	if s, ok := r.get("t1"); !ok || s != s1 {
+		t.Fatalf("got %v %v: expected %v", s, ok, s1)
+	}
+	if r.rekey("t1", "t3", s2) {
+		t.Fatal("expected rekey of a different session to fail")
+	}
+	if !r.rekey("t1", "t3", s1) {
+		t.Fatal("expected rekey to succeed")
+	}
+	if _, ok := r.get("t1"); ok {
+		t.Fatal("expected old token to be removed")
+	}
+	if s, ok := r.get("t3"); !ok || s != s1 {
+		t.Fatalf("got %v %v: expected %v", s, ok, s1)
+	}
+	removed := r.removeIf(func(s *Session) bool { return s == s2 })
+	if len(removed) != 1 || removed[0] != s2 || r.len() != 1 {
+		t.Fatalf("got %v and %d left: expected s2 removed", removed, r.len())
+	}
+}
+
+// TestManagerConcurrent 并发创建、查找和gc，不应出现concurrent map read and map write
+func TestManagerConcurrent(t *testing.T) {
+	m := NewManager(memstore.New(0), LifeTime(time.Millisecond))
+	var wg sync.WaitGroup
+	var stop int32
+	for i := 0; i < 4; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				m.NewSession()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&stop) == 0 {
+				m.FindSeesion(FindTimeIn())
+				m.FindHandleSeesion(FindTimeOut(), func(*Session) {})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&stop) == 0 {
+				m.gc()
+				m.Stat()
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+}
+
+// TestSessionConcurrent 同一个session并发修改、续期、销毁和查找，需要在-race下运行
+func TestSessionConcurrent(t *testing.T) {
+	m := NewManager(memstore.New(0))
+	var wg sync.WaitGroup
+	var stop int32
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				s, err := m.NewSession()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				s.Put("n", i)
+				m.Login(s, "user-"+strconv.Itoa(i))
+				m.RenewToken(httptest.NewRecorder(), s)
+				s.WriteToResponseWriter(httptest.NewRecorder())
+				s.RenewToken()
+				s.Destroy()
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&stop) == 0 {
+				for _, s := range m.findRegistry(FindByKVEq("n", 0), FindTimeIn()) {
+					s.GetID()
+					s.GetToken()
+					s.GetExpiry()
+					s.LastAccessTime()
+					s.GetData()["n"] = -1
+				}
+				m.findRegistry(FindByUserID("user-1"))
+				m.findRegistry(FindByToken("token"), FindByID("id"))
+				m.gc()
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+}
+
+// benchmarkSessions 预先放入的session数量
+const benchmarkSessions = 10000
+
+func benchmarkTokens() []string {
+	tokens := make([]string, benchmarkSessions)
+	for i := range tokens {
+		tokens[i] = "token-" + strconv.Itoa(i)
+	}
+	return tokens
+}
+
+// mutexRegistry 分片之前的实现：一个map和一把锁，作为对比
+type mutexRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func (r *mutexRegistry) get(token string) (*Session, bool) {
+	r.mu.Lock()
+	s, ok := r.sessions[token]
+	r.mu.Unlock()
+	return s, ok
+}
+
+func (r *mutexRegistry) set(token string, s *Session) {
+	r.mu.Lock()
+	r.sessions[token] = s
+	r.mu.Unlock()
+}
+
+// 90%读10%写，使用-cpu=1,4,8对比多核下的扩展性
+func BenchmarkRegistrySharded(b *testing.B) {
+	r := newRegistry()
+	tokens := benchmarkTokens()
+	for _, tk := range tokens {
+		r.set(tk, &Session{sessionState: &sessionState{}})
+	}
+	var seq uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint32(&seq, 1)) * 7919
+		for pb.Next() {
+			tk := tokens[i%len(tokens)]
+			if i%10 == 0 {
+				r.set(tk, &Session{sessionState: &sessionState{}})
+			} else {
+				r.get(tk)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkRegistryMutex(b *testing.B) {
+	r := &mutexRegistry{sessions: make(map[string]*Session)}
+	tokens := benchmarkTokens()
+	for _, tk := range tokens {
+		r.set(tk, &Session{sessionState: &sessionState{}})
+	}
+	var seq uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint32(&seq, 1)) * 7919
+		for pb.Next() {
+			tk := tokens[i%len(tokens)]
+			if i%10 == 0 {
+				r.set(tk, &Session{sessionState: &sessionState{}})
+			} else {
+				r.get(tk)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkRegistrySnapshot(b *testing.B) {
+	r := newRegistry()
+	for _, tk := range benchmarkTokens() {
+		r.set(tk, &Session{sessionState: &sessionState{}})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.snapshot()
+	}
+}
@@ -2,13 +2,14 @@ package session
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/gob"
-	"encoding/json"
 	"errors"
+	"net/http"
 	"sort"
-	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -16,8 +17,32 @@ import (
 // ErrTypeAssertionFailed 断言错误
 var ErrTypeAssertionFailed = errors.New("type assertion failed")
 
+// ErrReservedKey 键使用了内部保留的前缀
+var ErrReservedKey = errors.New("scs: keys with the " + internalKeyPrefix + " prefix are reserved")
+
+// 内部使用的键，保存在data中，随data一起编码存储
+const (
+	internalKeyPrefix = "__scs_"
+	userIDKey         = internalKeyPrefix + "user_id"
+)
+
+// isInternalKey 是否为内部使用的键
+func isInternalKey(key string) bool {
+	return strings.HasPrefix(key, internalKeyPrefix)
+}
+
 // Session 一个会话状态
+// manager中的session被同一个token的并发请求共享，每个请求得到各自的*Session，
+// 它们共享同一份数据，请求上下文、请求和读取到token的方式只属于当前请求
 type Session struct {
+	*sessionState
+	ctx       context.Context // 加载session的请求上下文，传递给存储器
+	req       *http.Request   // 加载session的请求，传递给钩子
+	transport TokenTransport  // 读取到token的方式，为nil时使用所有方式写回
+}
+
+// sessionState session的数据，同一个token的请求共享，由mu保护
+type sessionState struct {
 	id             string                 // session的id值，一般情况下就是token
 	token          string                 // session的Token值，其实也就是sessionID
 	data           map[string]interface{} // session储存数据
@@ -26,6 +51,13 @@ type Session struct {
 	mu             sync.Mutex
 	opts           Options
 	store          Store
+	stats          *managerStats          // 所属manager的统计，可能为nil
+	hooks          *hooks                 // 所属manager的钩子，可能为nil
+	sessions       *registry              // 所属manager的session索引，可能为nil
+	dirty          bool                   // 延迟写入模式下，是否有未提交的修改
+	isNew          bool                   // 新建的session，还没有写入过存储器
+	version        int64                  // 乐观锁，读取或保存时存储器中的版本号
+	base           map[string]interface{} // 乐观锁，读取或保存时的data，用于合并冲突
 }
 
 // newSession 返回一个默认的Session
@@ -34,53 +66,134 @@ func newSession(store Store, opts Options) (*Session, error) {
 	if err != nil {
 		return nil, err
 	}
-	s := &Session{
+	s := &Session{sessionState: &sessionState{
 		id:       token,
 		data:     make(map[string]interface{}),
 		deadline: time.Now().Add(opts.lifetime),
 		store:    store,
 		opts:     opts,
 		token:    token,
-	}
+		isNew:    true,
+	}}
 	return s, nil
 }
 
+// getContext 获取调用存储器时使用的上下文
+func (s *Session) getContext() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// withRequest 返回处理请求r的session，与s共享数据，t为读取到token的方式
+// r为nil时返回不属于任何请求的session，用于保存在manager中
+func (s *Session) withRequest(r *http.Request, t TokenTransport) *Session {
+	ns := &Session{sessionState: s.sessionState, transport: t}
+	if r != nil {
+		ns.ctx = r.Context()
+		ns.req = r
+	}
+	return ns
+}
+
+// snapshot 返回session的副本，用于销毁之后传递给钩子，调用时需要持有s.mu
+func (s *Session) snapshot() *Session {
+	data := make(map[string]interface{}, len(s.data))
+	for k, v := range s.data {
+		data[k] = v
+	}
+	return &Session{
+		sessionState: &sessionState{
+			id:             s.id,
+			token:          s.token,
+			data:           data,
+			deadline:       s.deadline,
+			lastAccessTime: s.lastAccessTime,
+			opts:           s.opts,
+			store:          s.store,
+		},
+		ctx: s.ctx,
+		req: s.req,
+	}
+}
+
+// storeCtx 返回记录统计的存储器
+func (s *Session) storeCtx() StoreContext {
+	return s.stats.wrap(WithContext(s.store))
+}
+
 // GetID 获取sessionID
 func (s *Session) GetID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.id
 }
 
 // GetToken 获取sessionToken
 func (s *Session) GetToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.token
 }
 
-// GetData 获取session Data
+// GetData 获取session Data的副本，修改副本不会影响session，不包含用户等内部数据
 func (s *Session) GetData() map[string]interface{} {
-	return s.data
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data := copyData(s.data)
+	for k := range data {
+		if isInternalKey(k) {
+			delete(data, k)
+		}
+	}
+	return data
 }
 
 // GetExpiry 获取过期时间点
 func (s *Session) GetExpiry() time.Time {
-	expiry := s.deadline
-	if s.opts.idleTimeout > 0 {
-		ie := time.Now().Add(s.opts.idleTimeout)
-		if ie.Before(expiry) {
-			expiry = ie
-		}
-	}
-	return expiry
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.expiry()
+}
+
+// GetUserID 获取session所属的用户，未登录返回空
+func (s *Session) GetUserID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uid, _ := s.data[userIDKey].(string)
+	return uid
+}
+
+// SetUserID 设置session所属的用户
+// 需要限制单用户session数量时，使用Manager.Login
+func (s *Session) SetUserID(userID string) error {
+	s.mu.Lock()
+	s.data[userIDKey] = userID
+	s.mu.Unlock()
+	return s.write()
 }
 
 // LastAccessTime 获取上次时间
 func (s *Session) LastAccessTime() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.lastAccessTime
 }
 
+// getDeadline 获取session的过期时间，不考虑闲置时间
+func (s *Session) getDeadline() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deadline
+}
+
 // TimeOut 判断session是否过期
 // 1.验证过期时间
 // 2.如果未过期，到数据库中查找，如果存不存在
 func (s *Session) TimeOut() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if time.Now().Before(s.deadline) {
 		//_, found, _ := s.store.Find(s.token)
 		//if !found {
@@ -93,24 +206,14 @@ func (s *Session) TimeOut() bool {
 
 // MayTouch 建议刷新
 func (s *Session) MayTouch() bool {
-	return s.opts.idleTimeout > 0 && s.lastAccessTime.Add(s.opts.touchInterval).Before(time.Now()) || s.lastAccessTime.IsZero()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.idleTimeout() > 0 && s.lastAccessTime.Add(s.opts.touchInterval).Before(time.Now()) || s.lastAccessTime.IsZero()
 }
 
 // GetString 获取String
 func (s *Session) GetString(key string) (string, error) {
-	v, exists, err := s.Get(key)
-	if err != nil {
-		return "", err
-	}
-	if exists == false {
-		return "", nil
-	}
-
-	str, ok := v.(string)
-	if ok == false {
-		return "", ErrTypeAssertionFailed
-	}
-	return str, nil
+	return Get[string](s, key)
 }
 
 // PutString 存储string
@@ -120,36 +223,12 @@ func (s *Session) PutString(key string, val string) error {
 
 // PopString 移除并返回
 func (s *Session) PopString(key string) (string, error) {
-	v, exists, err := s.Pop(key)
-	if err != nil {
-		return "", err
-	}
-	if exists == false {
-		return "", nil
-	}
-
-	str, ok := v.(string)
-	if ok == false {
-		return "", ErrTypeAssertionFailed
-	}
-	return str, nil
+	return Pop[string](s, key)
 }
 
 // GetBool 获取Bool
 func (s *Session) GetBool(key string) (bool, error) {
-	v, exists, err := s.Get(key)
-	if err != nil {
-		return false, err
-	}
-	if exists == false {
-		return false, nil
-	}
-
-	b, ok := v.(bool)
-	if ok == false {
-		return false, ErrTypeAssertionFailed
-	}
-	return b, nil
+	return Get[bool](s, key)
 }
 
 // PutBool 存入，存在则替换
@@ -159,38 +238,12 @@ func (s *Session) PutBool(key string, val bool) error {
 
 // PopBool 移除并返回
 func (s *Session) PopBool(key string) (bool, error) {
-	v, exists, err := s.Pop(key)
-	if err != nil {
-		return false, err
-	}
-	if exists == false {
-		return false, nil
-	}
-
-	b, ok := v.(bool)
-	if ok == false {
-		return false, ErrTypeAssertionFailed
-	}
-	return b, nil
+	return Pop[bool](s, key)
 }
 
 // GetInt 获取
 func (s *Session) GetInt(key string) (int, error) {
-	v, exists, err := s.Get(key)
-	if err != nil {
-		return 0, err
-	}
-	if exists == false {
-		return 0, nil
-	}
-
-	switch v := v.(type) {
-	case int:
-		return v, nil
-	case json.Number:
-		return strconv.Atoi(v.String())
-	}
-	return 0, ErrTypeAssertionFailed
+	return Get[int](s, key)
 }
 
 // PutInt 存入，存在则替换
@@ -200,40 +253,12 @@ func (s *Session) PutInt(key string, val int) error {
 
 // PopInt 移除并返回
 func (s *Session) PopInt(key string) (int, error) {
-	v, exists, err := s.Pop(key)
-	if err != nil {
-		return 0, err
-	}
-	if exists == false {
-		return 0, nil
-	}
-
-	switch v := v.(type) {
-	case int:
-		return v, nil
-	case json.Number:
-		return strconv.Atoi(v.String())
-	}
-	return 0, ErrTypeAssertionFailed
+	return Pop[int](s, key)
 }
 
 // GetInt64 获取
 func (s *Session) GetInt64(key string) (int64, error) {
-	v, exists, err := s.Get(key)
-	if err != nil {
-		return 0, err
-	}
-	if exists == false {
-		return 0, nil
-	}
-
-	switch v := v.(type) {
-	case int64:
-		return v, nil
-	case json.Number:
-		return v.Int64()
-	}
-	return 0, ErrTypeAssertionFailed
+	return Get[int64](s, key)
 }
 
 // PutInt64 存入，存在则替换
@@ -243,40 +268,12 @@ func (s *Session) PutInt64(key string, val int64) error {
 
 // PopInt64 移除并返回
 func (s *Session) PopInt64(key string) (int64, error) {
-	v, exists, err := s.Pop(key)
-	if err != nil {
-		return 0, err
-	}
-	if exists == false {
-		return 0, nil
-	}
-
-	switch v := v.(type) {
-	case int64:
-		return v, nil
-	case json.Number:
-		return v.Int64()
-	}
-	return 0, ErrTypeAssertionFailed
+	return Pop[int64](s, key)
 }
 
 // GetFloat64 获取
 func (s *Session) GetFloat64(key string) (float64, error) {
-	v, exists, err := s.Get(key)
-	if err != nil {
-		return 0, err
-	}
-	if exists == false {
-		return 0, nil
-	}
-
-	switch v := v.(type) {
-	case float64:
-		return v, nil
-	case json.Number:
-		return v.Float64()
-	}
-	return 0, ErrTypeAssertionFailed
+	return Get[float64](s, key)
 }
 
 // PutFloat64 存入，存在则替换
@@ -286,40 +283,12 @@ func (s *Session) PutFloat64(key string, val float64) error {
 
 // PopFloat64 移除并返回
 func (s *Session) PopFloat64(key string) (float64, error) {
-	v, exists, err := s.Pop(key)
-	if err != nil {
-		return 0, err
-	}
-	if exists == false {
-		return 0, nil
-	}
-
-	switch v := v.(type) {
-	case float64:
-		return v, nil
-	case json.Number:
-		return v.Float64()
-	}
-	return 0, ErrTypeAssertionFailed
+	return Pop[float64](s, key)
 }
 
 // GetTime 获取
 func (s *Session) GetTime(key string) (time.Time, error) {
-	v, exists, err := s.Get(key)
-	if err != nil {
-		return time.Time{}, err
-	}
-	if exists == false {
-		return time.Time{}, nil
-	}
-
-	switch v := v.(type) {
-	case time.Time:
-		return v, nil
-	case string:
-		return time.Parse(time.RFC3339, v)
-	}
-	return time.Time{}, ErrTypeAssertionFailed
+	return Get[time.Time](s, key)
 }
 
 // PutTime 存入，存在则替换
@@ -329,40 +298,12 @@ func (s *Session) PutTime(key string, val time.Time) error {
 
 // PopTime 移除并返回
 func (s *Session) PopTime(key string) (time.Time, error) {
-	v, exists, err := s.Pop(key)
-	if err != nil {
-		return time.Time{}, err
-	}
-	if exists == false {
-		return time.Time{}, nil
-	}
-
-	switch v := v.(type) {
-	case time.Time:
-		return v, nil
-	case string:
-		return time.Parse(time.RFC3339, v)
-	}
-	return time.Time{}, ErrTypeAssertionFailed
+	return Pop[time.Time](s, key)
 }
 
 // GetBytes 获取
 func (s *Session) GetBytes(key string) ([]byte, error) {
-	v, exists, err := s.Get(key)
-	if err != nil {
-		return nil, err
-	}
-	if exists == false {
-		return nil, nil
-	}
-
-	switch v := v.(type) {
-	case []byte:
-		return v, nil
-	case string:
-		return base64.StdEncoding.DecodeString(v)
-	}
-	return nil, ErrTypeAssertionFailed
+	return Get[[]byte](s, key)
 }
 
 // PutBytes 存入，存在则替换
@@ -375,21 +316,7 @@ func (s *Session) PutBytes(key string, val []byte) error {
 
 // PopBytes 移除并返回
 func (s *Session) PopBytes(key string) ([]byte, error) {
-	v, exists, err := s.Pop(key)
-	if err != nil {
-		return nil, err
-	}
-	if exists == false {
-		return nil, nil
-	}
-
-	switch v := v.(type) {
-	case []byte:
-		return v, nil
-	case string:
-		return base64.StdEncoding.DecodeString(v)
-	}
-	return nil, ErrTypeAssertionFailed
+	return Pop[[]byte](s, key)
 }
 
 // GetObject 获取
@@ -435,20 +362,25 @@ func (s *Session) Keys() ([]string, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	keys := make([]string, len(s.data))
-	i := 0
+	keys := make([]string, 0, len(s.data))
 	for k := range s.data {
-		keys[i] = k
-		i++
+		if isInternalKey(k) {
+			continue
+		}
+		keys = append(keys, k)
 	}
 
 	sort.Strings(keys)
 	return keys, nil
 }
 
-// Exists 是否存在给定键的数据
+// Exists 是否存在给定键的数据，内部保留的键返回false
 func (s *Session) Exists(key string) (bool, error) {
 
+	if isInternalKey(key) {
+		return false, nil
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -456,8 +388,11 @@ func (s *Session) Exists(key string) (bool, error) {
 	return exists, nil
 }
 
-// Remove 移除给定键数据
+// Remove 移除给定键数据，内部保留的键返回ErrReservedKey
 func (s *Session) Remove(key string) error {
+	if isInternalKey(key) {
+		return ErrReservedKey
+	}
 
 	s.mu.Lock()
 
@@ -473,59 +408,123 @@ func (s *Session) Remove(key string) error {
 	return s.write()
 }
 
-// Clear 清楚所有的数据
+// Clear 清楚所有的数据，用户等内部数据会保留
 func (s *Session) Clear() error {
 
 	s.mu.Lock()
 
-	if len(s.data) == 0 {
-		s.mu.Unlock()
-		return nil
-	}
-
+	var cleared bool
 	for key := range s.data {
+		if isInternalKey(key) {
+			continue
+		}
 		delete(s.data, key)
+		cleared = true
+	}
+	if !cleared {
+		s.mu.Unlock()
+		return nil
 	}
 	s.mu.Unlock()
 
 	return s.write()
 }
 
-// // RenewToken 重建token
-// func (s *Session) RenewToken() error {
-// 	s.mu.Lock()
-// 	err := s.store.Delete(s.token)
-// 	if err != nil {
-// 		s.mu.Unlock()
-// 		return err
-// 	}
-// 	token, err := generateToken()
-// 	if err != nil {
-// 		s.mu.Unlock()
-// 		return err
-// 	}
-
-// 	s.token = token
-// 	s.deadline = time.Now().Add(s.opts.lifetime)
-// 	s.mu.Unlock()
-
-// 	return s.write()
-// }
-
-// Destroy 摧毁session
-func (s *Session) Destroy() error {
+// RenewToken 重建token
+// 生成新的token并写入数据之后删除存储器中旧token对应的数据，id保持不变，同时更新manager的索引和用户索引
+// 在登录或者权限变更时调用，防止session固定攻击
+// 需要通过Manager.RenewToken或者WriteToResponseWriter将新token写回客户端
+func (s *Session) RenewToken() error {
+	oldToken, undo, err := s.renewToken()
+	if err != nil {
+		return err
+	}
+	err = s.write()
+	if err != nil {
+		undo()
+		return err
+	}
+	return s.renewed(oldToken)
+}
+
+// renewToken 生成新的token，返回旧token和写入失败时恢复旧token的函数
+// 不写入新token的数据，由调用方写入之后调用renewed
+func (s *Session) renewToken() (string, func(), error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	err := s.store.Delete(s.token)
+	token, err := generateToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	oldToken, version, base, deadline := s.token, s.version, s.base, s.deadline
+	s.token = token
+	s.version = 0
+	s.base = nil
+	s.deadline = time.Now().Add(s.lifetime())
+	undo := func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.token == token {
+			s.token, s.version, s.base, s.deadline = oldToken, version, base, deadline
+		}
+	}
+	return oldToken, undo, nil
+}
+
+// renewed 新token的数据写入之后，删除存储器中旧token对应的数据，更新manager的索引和用户索引
+// 写入失败时旧token的数据仍然保留，session不会丢失
+func (s *Session) renewed(oldToken string) error {
+	ctx := s.getContext()
+	err := s.storeCtx().DeleteCtx(ctx, oldToken)
+	if err != nil {
+		return err
+	}
+	token := s.GetToken()
+	if s.sessions != nil {
+		s.sessions.rekey(oldToken, token, s)
+	}
+	s.hooks.runRenew(s, s.req, oldToken)
+	uid := s.GetUserID()
+	if uid == "" || s.opts.userIndex == nil {
+		return nil
+	}
+	err = s.opts.userIndex.Remove(ctx, uid, oldToken)
+	if err != nil {
+		return err
+	}
+	return s.opts.userIndex.Add(ctx, uid, UserToken{Token: token, LoginTime: time.Now(), Expiry: s.getDeadline()})
+}
+
+// Destroy 摧毁session，同时从用户索引中删除
+func (s *Session) Destroy() error {
+	s.mu.Lock()
+	err := s.storeCtx().DeleteCtx(s.getContext(), s.token)
+	if err == nil {
+		err = s.removeUserToken(s.getContext())
+	}
 	if err != nil {
+		s.mu.Unlock()
 		return err
 	}
+	old := s.snapshot()
+	s.reset()
+	s.mu.Unlock()
+	s.stats.incDestroyed()
+	s.hooks.destroyed(old, old.req)
+	return nil
+}
+
+// reset 清空session，调用时需要持有s.mu
+func (s *Session) reset() {
 	s.token = ""
 	s.id = ""
+	s.dirty = false
+	s.version = 0
+	s.base = nil
 	for key := range s.data {
 		delete(s.data, key)
 	}
-	return nil
 }
 
 // Write 相当于刷新一下时间
@@ -535,25 +534,34 @@ func (s *Session) Write(bs []byte) error {
 
 //-------------------------
 
-// Get 获取key对应的值
+// Get 获取key对应的值，内部保留的键视为不存在
 // err:如果将从store中获取值，将会有错误返回
 func (s *Session) Get(key string) (interface{}, bool, error) {
+	if isInternalKey(key) {
+		return nil, false, nil
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	v, exists := s.data[key]
 	return v, exists, nil
 }
 
-// Put 存入，存在则替换
+// Put 存入，存在则替换，内部保留的键返回ErrReservedKey
 func (s *Session) Put(key string, val interface{}) error {
+	if isInternalKey(key) {
+		return ErrReservedKey
+	}
 	s.mu.Lock()
 	s.data[key] = val
 	s.mu.Unlock()
 	return s.write()
 }
 
-// Pop 移除并返回
+// Pop 移除并返回，内部保留的键返回ErrReservedKey
 func (s *Session) Pop(key string) (interface{}, bool, error) {
+	if isInternalKey(key) {
+		return nil, false, ErrReservedKey
+	}
 	s.mu.Lock()
 
 	v, exists := s.data[key]
@@ -571,8 +579,48 @@ func (s *Session) Pop(key string) (interface{}, bool, error) {
 	return v, true, nil
 }
 
+// Commit 提交延迟写入的修改，没有修改时不访问存储器
+func (s *Session) Commit() error {
+	s.mu.Lock()
+	dirty := s.dirty
+	s.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+	return s.flush()
+}
+
+// Dirty 是否有未提交的修改
+func (s *Session) Dirty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dirty
+}
+
 // 写入并更改相应的数据
+// 延迟写入模式下只标记为已修改
 func (s *Session) write(bs ...[]byte) error {
+	if len(bs) == 0 && s.opts.deferWrite {
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+		return nil
+	}
+	return s.flush(bs...)
+}
+
+// flush 立即写入存储器
+func (s *Session) flush(bs ...[]byte) error {
+	err := s.save(bs...)
+	if err != nil {
+		return err
+	}
+	s.hooks.saved(s, s.req)
+	return nil
+}
+
+// save 编码并写入存储器
+func (s *Session) save(bs ...[]byte) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.lastAccessTime = time.Now()
@@ -585,16 +633,22 @@ func (s *Session) write(bs ...[]byte) error {
 	if len(bs) > 0 {
 		j = bs[0]
 	} else {
-		j, err = encodeToJSON(s.id, s.data, s.deadline)
+		j, err = s.opts.codec.Encode(s.id, s.data, s.deadline)
 		if err != nil {
 			return err
 		}
 	}
-	expiry := s.GetExpiry()
-	err = s.store.Save(s.token, j, expiry)
+	expiry := s.expiry()
+	if cs, ok := s.opts.casStore(s.store); ok {
+		err = s.saveCAS(cs, j, expiry)
+	} else {
+		err = s.storeCtx().SaveCtx(s.getContext(), s.token, j, expiry)
+	}
 	if err != nil {
 		return err
 	}
+	s.dirty = false
+	s.isNew = false
 	return nil
 }
 
@@ -621,31 +675,3 @@ func gobDecode(b []byte, dst interface{}) error {
 	buf := bytes.NewBuffer(b)
 	return gob.NewDecoder(buf).Decode(dst)
 }
-
-func encodeToJSON(id string, data map[string]interface{}, deadline time.Time) ([]byte, error) {
-	return json.Marshal(&struct {
-		Data     map[string]interface{} `json:"data"`
-		Deadline int64                  `json:"deadline"`
-		ID       string                 `json:"id"`
-	}{
-		Data:     data,
-		Deadline: deadline.UnixNano(),
-		ID:       id,
-	})
-}
-
-func decodeFromJSON(j []byte) (string, map[string]interface{}, time.Time, error) {
-	aux := struct {
-		Data     map[string]interface{} `json:"data"`
-		Deadline int64                  `json:"deadline"`
-		ID       string                 `json:"id"`
-	}{}
-
-	dec := json.NewDecoder(bytes.NewReader(j))
-	dec.UseNumber()
-	err := dec.Decode(&aux)
-	if err != nil {
-		return "", nil, time.Time{}, err
-	}
-	return aux.ID, aux.Data, time.Unix(0, aux.Deadline), nil
-}
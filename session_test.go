@@ -0,0 +1,173 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ipiao/session/stores/memstore"
+)
+
+func TestRenewToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		store  Store
+		client bool
+	}{
+		{"memstore", memstore.New(0), false},
+		{"cookiestore", NewCookieManager("u46IpCV9y5Vlur8YvODJEhgOY8m9JVE4").store, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var saves int
+			count := InterceptStore(func(ctx context.Context, op, token string, call func(ctx context.Context) error) error {
+				if op == OpSave {
+					saves++
+				}
+				return call(ctx)
+			})
+			m := NewManager(tt.store, StoreMiddlewares(count))
+			var renewed string
+			m.OnRenew(func(s *Session, r *http.Request, oldToken string) {
+				renewed = oldToken
+			})
+
+			rr := httptest.NewRecorder()
+			s, err := m.Load(httptest.NewRequest("GET", "/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = s.PutToResponseWriter(rr, "key", "value"); err != nil {
+				t.Fatal(err)
+			}
+			id, oldToken := s.GetID(), s.GetToken()
+
+			saves = 0
+			rr = httptest.NewRecorder()
+			if err = m.RenewToken(rr, s); err != nil {
+				t.Fatal(err)
+			}
+			token := s.GetToken()
+			if token == oldToken || s.GetID() != id || renewed != oldToken {
+				t.Fatalf("got token %q id %q renewed %q: expected a new token, the same id and the hook", token, s.GetID(), renewed)
+			}
+			if saves != 1 {
+				t.Fatalf("got %d saves: expected the session to be written once", saves)
+			}
+			cookies := rr.Result().Cookies()
+			if len(cookies) != 1 || cookies[0].Value != token {
+				t.Fatalf("got %v: expected the cookie to be rewritten with the new token", cookies)
+			}
+			// 客户端存储器的token每次写入都会改变，manager按id查找，不需要更新索引
+			if !tt.client {
+				if ms, ok := m.sessions.get(token); !ok || ms.sessionState != s.sessionState {
+					t.Fatal("expected the session to be registered under the new token")
+				}
+				if _, ok := m.sessions.get(oldToken); ok {
+					t.Fatal("expected the old token to be removed from the manager")
+				}
+				if _, found, _ := m.store.Find(oldToken); found {
+					t.Fatal("expected the old token to be deleted from the store")
+				}
+			}
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(cookies[0])
+			ls, err := m.LoadIM(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v, _ := ls.GetString("key"); ls.GetID() != id || v != "value" {
+				t.Fatalf("got id %q value %q: expected the session to load with the new token", ls.GetID(), v)
+			}
+		})
+	}
+}
+
+func TestSessionRenewToken(t *testing.T) {
+	var fail bool
+	failSave := InterceptStore(func(ctx context.Context, op, token string, call func(ctx context.Context) error) error {
+		if fail && op == OpSave {
+			return errors.New("save failed")
+		}
+		return call(ctx)
+	})
+	store := memstore.New(0)
+	m := NewManager(store, StoreMiddlewares(failSave))
+	s, err := m.Load(httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Login(s, "user"); err != nil {
+		t.Fatal(err)
+	}
+	oldToken := s.GetToken()
+
+	// 写入新token失败时保留旧token的数据
+	fail = true
+	if err = s.RenewToken(); err == nil {
+		t.Fatal("expected the failed save to be returned")
+	}
+	if _, found, _ := store.Find(oldToken); !found {
+		t.Fatal("expected the session to be kept under the old token")
+	}
+
+	fail = false
+	if err = s.RenewToken(); err != nil {
+		t.Fatal(err)
+	}
+	token := s.GetToken()
+	if _, found, _ := store.Find(oldToken); found {
+		t.Fatal("expected the old token to be deleted from the store")
+	}
+	if _, ok := m.sessions.get(oldToken); ok {
+		t.Fatal("expected the old token to be removed from the manager")
+	}
+	if ms, ok := m.sessions.get(token); !ok || ms.sessionState != s.sessionState {
+		t.Fatal("expected the session to be registered under the new token")
+	}
+	uts, _ := m.opts.userIndex.List(context.Background(), "user")
+	if len(uts) != 1 || uts[0].Token != token {
+		t.Fatalf("got %v: expected the user index to hold the new token only", uts)
+	}
+}
+
+func TestInternalKeys(t *testing.T) {
+	m := NewManager(memstore.New(0))
+	s, err := m.Load(httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Login(s, "user"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put("a", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	data := s.GetData()
+	if len(data) != 1 || data["a"] != 1 {
+		t.Fatalf("got %v: expected the internal keys to be hidden", data)
+	}
+	if ok, _ := s.Exists(userIDKey); ok {
+		t.Fatal("expected the user key to be hidden from Exists")
+	}
+	if _, ok, _ := s.Get(userIDKey); ok {
+		t.Fatal("expected the user key to be hidden from Get")
+	}
+
+	if err = s.Put(userIDKey, "other"); !errors.Is(err, ErrReservedKey) {
+		t.Fatalf("got %v: expected Put to reject the reserved key", err)
+	}
+	if err = s.Remove(userIDKey); !errors.Is(err, ErrReservedKey) {
+		t.Fatalf("got %v: expected Remove to reject the reserved key", err)
+	}
+	if _, _, err = s.Pop(userIDKey); !errors.Is(err, ErrReservedKey) {
+		t.Fatalf("got %v: expected Pop to reject the reserved key", err)
+	}
+	if uid := s.GetUserID(); uid != "user" {
+		t.Fatalf("got %q: expected the user to be kept", uid)
+	}
+}
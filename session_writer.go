@@ -1,13 +1,8 @@
 package session
 
 import (
-	"encoding/base64"
-	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
-	"strconv"
-	"strings"
 	"time"
 )
 
@@ -17,10 +12,12 @@ import (
 
 // WriteToResponseWriter 将session数据写入到返回中
 func (s *Session) WriteToResponseWriter(w http.ResponseWriter) error {
-	expiry := s.GetExpiry()
-	s.lastAccessTime = time.Now()
+	s.mu.Lock()
 	// 如果设置了闲置时间
-	j, err := encodeToJSON(s.id, s.data, s.deadline)
+	expiry := s.expiry()
+	s.lastAccessTime = time.Now()
+	j, err := s.opts.codec.Encode(s.id, s.data, s.deadline)
+	s.mu.Unlock()
 	if err != nil {
 		return err
 	}
@@ -31,44 +28,33 @@ func (s *Session) WriteToResponseWriter(w http.ResponseWriter) error {
 	// 如果是客户端存储,要更新token值
 	ce, ok := s.store.(clientStore)
 	if ok {
-		s.token, err = ce.MakeToken(j, expiry)
+		token, err := ce.MakeToken(j, expiry)
 		if err != nil {
 			return err
 		}
+		s.mu.Lock()
+		s.token = token
+		s.mu.Unlock()
 	}
-	// 设置cookie
-	cookie := &http.Cookie{
-		Name:     s.opts.name,
-		Value:    s.token,
-		Path:     s.opts.path,
-		Domain:   s.opts.domain,
-		Secure:   s.opts.secure,
-		HttpOnly: s.opts.httpOnly,
-	}
-	if s.opts.persist == true {
-		// Round up expiry time to the nearest second.
-		cookie.Expires = time.Unix(expiry.Unix()+1, 0)
-		cookie.MaxAge = int(expiry.Sub(time.Now()).Seconds() + 1)
+	// 使用读取到token的方式写回，新建的session使用所有方式
+	ts := s.opts.transports
+	if s.transport != nil {
+		ts = []TokenTransport{s.transport}
 	}
-
-	// 重写存在的cookie
-	var set bool
-	for i, h := range w.Header()["Set-Cookie"] {
-		if strings.HasPrefix(h, fmt.Sprintf("%s=", s.opts.name)) {
-			w.Header()["Set-Cookie"][i] = cookie.String()
-			set = true
-			break
+	for _, t := range ts {
+		err = s.writeToken(w, t, expiry)
+		if err != nil {
+			return err
 		}
 	}
-	// 如果不存在，则新生成一个
-	if !set {
-		http.SetCookie(w, cookie)
-	}
 	return nil
 }
 
 // PutToResponseWriter 存入，存在则替换
 func (s *Session) PutToResponseWriter(w http.ResponseWriter, key string, val interface{}) error {
+	if isInternalKey(key) {
+		return ErrReservedKey
+	}
 	s.mu.Lock()
 	s.data[key] = val
 	s.mu.Unlock()
@@ -77,6 +63,9 @@ func (s *Session) PutToResponseWriter(w http.ResponseWriter, key string, val int
 
 // PopFromResponseWriter 移除并返回
 func (s *Session) PopFromResponseWriter(w http.ResponseWriter, key string) (interface{}, bool, error) {
+	if isInternalKey(key) {
+		return nil, false, ErrReservedKey
+	}
 	s.mu.Lock()
 	v, exists := s.data[key]
 	if exists == false {
@@ -99,18 +88,7 @@ func (s *Session) PutStringToResponseWriter(w http.ResponseWriter, key string, v
 
 // PopStringFromResponseWriter 移除并返回
 func (s *Session) PopStringFromResponseWriter(w http.ResponseWriter, key string) (string, error) {
-	v, exists, err := s.PopFromResponseWriter(w, key)
-	if err != nil {
-		return "", err
-	}
-	if exists == false {
-		return "", nil
-	}
-	str, ok := v.(string)
-	if ok == false {
-		return "", ErrTypeAssertionFailed
-	}
-	return str, nil
+	return PopFromResponseWriter[string](s, w, key)
 }
 
 // PutBoolToResponseWriter 存储
@@ -120,19 +98,7 @@ func (s *Session) PutBoolToResponseWriter(w http.ResponseWriter, key string, val
 
 // PopBoolFromResponseWriter 移除并返回
 func (s *Session) PopBoolFromResponseWriter(w http.ResponseWriter, key string) (bool, error) {
-	v, exists, err := s.PopFromResponseWriter(w, key)
-	if err != nil {
-		return false, err
-	}
-	if exists == false {
-		return false, nil
-	}
-
-	b, ok := v.(bool)
-	if ok == false {
-		return false, ErrTypeAssertionFailed
-	}
-	return b, nil
+	return PopFromResponseWriter[bool](s, w, key)
 }
 
 // PutIntToResponseWriter 存储
@@ -142,21 +108,7 @@ func (s *Session) PutIntToResponseWriter(w http.ResponseWriter, key string, val
 
 // PopIntFromResponseWriter 移除并返回
 func (s *Session) PopIntFromResponseWriter(w http.ResponseWriter, key string) (int, error) {
-	v, exists, err := s.PopFromResponseWriter(w, key)
-	if err != nil {
-		return 0, err
-	}
-	if exists == false {
-		return 0, nil
-	}
-
-	switch v := v.(type) {
-	case int:
-		return v, nil
-	case json.Number:
-		return strconv.Atoi(v.String())
-	}
-	return 0, ErrTypeAssertionFailed
+	return PopFromResponseWriter[int](s, w, key)
 }
 
 // PutInt64ToResponseWriter 存储
@@ -166,21 +118,7 @@ func (s *Session) PutInt64ToResponseWriter(w http.ResponseWriter, key string, va
 
 // PopInt64FromResponseWriter 移除并返回
 func (s *Session) PopInt64FromResponseWriter(w http.ResponseWriter, key string) (int64, error) {
-	v, exists, err := s.PopFromResponseWriter(w, key)
-	if err != nil {
-		return 0, err
-	}
-	if exists == false {
-		return 0, nil
-	}
-
-	switch v := v.(type) {
-	case int64:
-		return v, nil
-	case json.Number:
-		return v.Int64()
-	}
-	return 0, ErrTypeAssertionFailed
+	return PopFromResponseWriter[int64](s, w, key)
 }
 
 // PutFloat64ToResponseWriter 存储
@@ -190,21 +128,7 @@ func (s *Session) PutFloat64ToResponseWriter(w http.ResponseWriter, key string,
 
 // PopFloat64FromResponseWriter 移除并返回
 func (s *Session) PopFloat64FromResponseWriter(w http.ResponseWriter, key string) (float64, error) {
-	v, exists, err := s.PopFromResponseWriter(w, key)
-	if err != nil {
-		return 0, err
-	}
-	if exists == false {
-		return 0, nil
-	}
-
-	switch v := v.(type) {
-	case float64:
-		return v, nil
-	case json.Number:
-		return v.Float64()
-	}
-	return 0, ErrTypeAssertionFailed
+	return PopFromResponseWriter[float64](s, w, key)
 }
 
 // PutTimeToResponseWriter 存储
@@ -214,21 +138,7 @@ func (s *Session) PutTimeToResponseWriter(w http.ResponseWriter, key string, val
 
 // PopTimeFromResponseWriter 移除并返回
 func (s *Session) PopTimeFromResponseWriter(w http.ResponseWriter, key string) (time.Time, error) {
-	v, exists, err := s.PopFromResponseWriter(w, key)
-	if err != nil {
-		return time.Time{}, err
-	}
-	if exists == false {
-		return time.Time{}, nil
-	}
-
-	switch v := v.(type) {
-	case time.Time:
-		return v, nil
-	case string:
-		return time.Parse(time.RFC3339, v)
-	}
-	return time.Time{}, ErrTypeAssertionFailed
+	return PopFromResponseWriter[time.Time](s, w, key)
 }
 
 // PutBytesToResponseWriter 存储
@@ -238,21 +148,7 @@ func (s *Session) PutBytesToResponseWriter(w http.ResponseWriter, key string, va
 
 // PopBytesFromResponseWriter 移除并返回
 func (s *Session) PopBytesFromResponseWriter(w http.ResponseWriter, key string) ([]byte, error) {
-	v, exists, err := s.PopFromResponseWriter(w, key)
-	if err != nil {
-		return nil, err
-	}
-	if exists == false {
-		return nil, nil
-	}
-
-	switch v := v.(type) {
-	case []byte:
-		return v, nil
-	case string:
-		return base64.StdEncoding.DecodeString(v)
-	}
-	return nil, ErrTypeAssertionFailed
+	return PopFromResponseWriter[[]byte](s, w, key)
 }
 
 // PutObject 存入，存在则替换
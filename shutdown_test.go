@@ -0,0 +1,101 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ipiao/session/stores/memstore"
+)
+
+// closeStore 记录Dumps和Close调用的存储器
+type closeStore struct {
+	*memstore.MemStore
+	dumped bool
+	closed bool
+}
+
+func (s *closeStore) DumpsCtx(ctx context.Context) error {
+	s.dumped = true
+	return nil
+}
+
+func (s *closeStore) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestShutdown(t *testing.T) {
+	store := &closeStore{MemStore: memstore.New(0)}
+	m := NewManager(store, DeferWrite(true))
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	h := m.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, _ := m.Load(r)
+		close(entered)
+		<-release
+		s.Put("key", "value")
+	}))
+	go h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	<-entered
+
+	done := make(chan error)
+	go func() {
+		done <- m.Shutdown(context.Background())
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected shutdown to wait for the in-flight request")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := m.Stat().StoreOps[OpSave].Count; n != 1 {
+		t.Fatalf("got %d saves: expected the deferred write to be committed", n)
+	}
+	if !store.dumped || !store.closed {
+		t.Fatalf("got dumped %v closed %v: expected both", store.dumped, store.closed)
+	}
+	if m.gcTimer.Stop() {
+		t.Fatal("expected gc timer to be stopped")
+	}
+
+	if _, err := m.NewSession(); err != ErrManagerClosed {
+		t.Fatalf("got %v: expected %v", err, ErrManagerClosed)
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got %d: expected %d", rr.Code, http.StatusServiceUnavailable)
+	}
+	if err := m.Close(); err != ErrManagerClosed {
+		t.Fatalf("got %v: expected %v", err, ErrManagerClosed)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	m := NewManager(memstore.New(0))
+
+	release := make(chan struct{})
+	defer close(release)
+	entered := make(chan struct{})
+	h := m.Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+	}))
+	go h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	<-entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := m.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v: expected %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,258 @@
+package session
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 存储器操作名称，用于ManagerStats.StoreOps
+const (
+	OpSave   = "save"
+	OpFind   = "find"
+	OpDelete = "delete"
+	OpLoads  = "loads"
+	OpDumps  = "dumps"
+	OpQuery  = "query"
+	OpScan   = "scan"
+)
+
+// latencyBuckets 存储器操作耗时直方图的分桶上界
+var latencyBuckets = []time.Duration{
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// ManagerStats manager的运行状态
+type ManagerStats struct {
+	Active  int // manager中未过期的session数量
+	Expired int // manager中已过期、等待gc的session数量
+
+	Created   uint64 // 启动以来创建的session数量
+	Destroyed uint64 // 启动以来销毁的session数量
+	GCed      uint64 // 启动以来gc清理的过期session数量，不包括已经销毁的session
+
+	LastGC         time.Time     // 上一次gc的时间
+	LastGCDuration time.Duration // 上一次gc的耗时
+
+	StoreOps map[string]StoreOpStats // 按操作统计的存储器调用
+
+	Migration *MigrationStats // 存储器为migratestore时的迁移进度，否则为nil
+}
+
+// MigrationStats 存储器迁移的进度
+type MigrationStats struct {
+	Copied  uint64 // 复制到新存储器的session数量，包括Find时复制的
+	Skipped uint64 // 新存储器中已经存在或者已经过期，没有复制的session数量
+	Failed  uint64 // 复制失败的session数量
+	Done    bool   // 后台复制是否已经完成
+}
+
+// migrator 报告迁移进度的存储器，如migratestore
+type migrator interface {
+	MigrationProgress() (copied, skipped, failed uint64, done bool)
+}
+
+// unwrapper 包装其它存储器的装饰器，Unwrap返回被包装的存储器
+type unwrapper interface {
+	Unwrap() Store
+}
+
+// migration 返回存储器或者被存储器中间件包装的存储器的迁移进度
+func migration(store Store) *MigrationStats {
+	for store != nil {
+		if mg, ok := store.(migrator); ok {
+			var ms MigrationStats
+			ms.Copied, ms.Skipped, ms.Failed, ms.Done = mg.MigrationProgress()
+			return &ms
+		}
+		u, ok := store.(unwrapper)
+		if !ok {
+			return nil
+		}
+		store = u.Unwrap()
+	}
+	return nil
+}
+
+// StoreOpStats 存储器某个操作的统计
+type StoreOpStats struct {
+	Count   uint64        // 调用次数
+	Errors  uint64        // 返回错误的次数
+	Total   time.Duration // 总耗时
+	Buckets []uint64      // 耗时分布，Buckets[i]为耗时不超过LatencyBuckets()[i]的次数，最后一个为超出的次数
+}
+
+// LatencyBuckets 返回存储器操作耗时直方图的分桶上界
+func LatencyBuckets() []time.Duration {
+	return append([]time.Duration(nil), latencyBuckets...)
+}
+
+// managerStats manager的统计计数
+type managerStats struct {
+	created   uint64
+	destroyed uint64
+	gced      uint64
+
+	mu             sync.Mutex
+	lastGC         time.Time
+	lastGCDuration time.Duration
+
+	ops map[string]*opStats
+}
+
+type opStats struct {
+	count   uint64
+	errors  uint64
+	total   int64
+	buckets []uint64
+}
+
+func newManagerStats() *managerStats {
+	st := &managerStats{
+		ops: make(map[string]*opStats),
+	}
+	for _, op := range []string{OpSave, OpFind, OpDelete, OpLoads, OpDumps, OpQuery, OpScan} {
+		st.ops[op] = &opStats{
+			buckets: make([]uint64, len(latencyBuckets)+1),
+		}
+	}
+	return st
+}
+
+// observe 记录一次存储器操作
+func (st *managerStats) observe(op string, start time.Time, err error) {
+	if st == nil {
+		return
+	}
+	s := st.ops[op]
+	d := time.Since(start)
+	atomic.AddUint64(&s.count, 1)
+	if err != nil {
+		atomic.AddUint64(&s.errors, 1)
+	}
+	atomic.AddInt64(&s.total, int64(d))
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+	atomic.AddUint64(&s.buckets[i], 1)
+}
+
+func (st *managerStats) incCreated() {
+	if st != nil {
+		atomic.AddUint64(&st.created, 1)
+	}
+}
+
+func (st *managerStats) incDestroyed() {
+	if st != nil {
+		atomic.AddUint64(&st.destroyed, 1)
+	}
+}
+
+func (st *managerStats) gcDone(start time.Time, n int) {
+	atomic.AddUint64(&st.gced, uint64(n))
+	st.mu.Lock()
+	st.lastGC = start
+	st.lastGCDuration = time.Since(start)
+	st.mu.Unlock()
+}
+
+// wrap 返回记录统计的存储器
+func (st *managerStats) wrap(sc StoreContext) StoreContext {
+	if st == nil {
+		return sc
+	}
+	return &statStore{sc: sc, stats: st}
+}
+
+// statStore 记录调用统计的存储器
+type statStore struct {
+	sc    StoreContext
+	stats *managerStats
+}
+
+func (s *statStore) SaveCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	start := time.Now()
+	err := s.sc.SaveCtx(ctx, token, b, expiry)
+	s.stats.observe(OpSave, start, err)
+	return err
+}
+
+func (s *statStore) DeleteCtx(ctx context.Context, token string) error {
+	start := time.Now()
+	err := s.sc.DeleteCtx(ctx, token)
+	s.stats.observe(OpDelete, start, err)
+	return err
+}
+
+func (s *statStore) FindCtx(ctx context.Context, token string) ([]byte, bool, error) {
+	start := time.Now()
+	b, found, err := s.sc.FindCtx(ctx, token)
+	s.stats.observe(OpFind, start, err)
+	return b, found, err
+}
+
+func (s *statStore) DumpsCtx(ctx context.Context) error {
+	start := time.Now()
+	err := s.sc.DumpsCtx(ctx)
+	s.stats.observe(OpDumps, start, err)
+	return err
+}
+
+func (s *statStore) LoadsCtx(ctx context.Context) ([][]byte, error) {
+	start := time.Now()
+	bs, err := s.sc.LoadsCtx(ctx)
+	s.stats.observe(OpLoads, start, err)
+	return bs, err
+}
+
+// Stat 返回manager的运行状态
+func (m *Manager) Stat() ManagerStats {
+	var ms ManagerStats
+	for _, s := range m.sessions.snapshot() {
+		if s.GetToken() == "" {
+			// 已经销毁，等待gc
+			continue
+		}
+		if s.TimeOut() {
+			ms.Expired++
+		} else {
+			ms.Active++
+		}
+	}
+
+	st := m.stats
+	ms.Created = atomic.LoadUint64(&st.created)
+	ms.Destroyed = atomic.LoadUint64(&st.destroyed)
+	ms.GCed = atomic.LoadUint64(&st.gced)
+	st.mu.Lock()
+	ms.LastGC = st.lastGC
+	ms.LastGCDuration = st.lastGCDuration
+	st.mu.Unlock()
+
+	ms.StoreOps = make(map[string]StoreOpStats, len(st.ops))
+	for op, s := range st.ops {
+		os := StoreOpStats{
+			Count:   atomic.LoadUint64(&s.count),
+			Errors:  atomic.LoadUint64(&s.errors),
+			Total:   time.Duration(atomic.LoadInt64(&s.total)),
+			Buckets: make([]uint64, len(s.buckets)),
+		}
+		for i := range s.buckets {
+			os.Buckets[i] = atomic.LoadUint64(&s.buckets[i])
+		}
+		ms.StoreOps[op] = os
+	}
+	ms.Migration = migration(m.store)
+	return ms
+}
@@ -0,0 +1,93 @@
+package session
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ipiao/session/stores/memstore"
+	"github.com/ipiao/session/stores/migratestore"
+)
+
+func TestStat(t *testing.T) {
+	m := NewManager(memstore.New(0))
+
+	s1, _ := m.NewSession()
+	s2, _ := m.NewSession()
+	s3, _ := m.NewSession()
+	if err := s1.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	s3.deadline = time.Now().Add(-time.Second)
+
+	st := m.Stat()
+	if st.Created != 3 || st.Destroyed != 1 {
+		t.Fatalf("got created %d destroyed %d: expected %d %d", st.Created, st.Destroyed, 3, 1)
+	}
+	if st.Active != 1 || st.Expired != 1 {
+		t.Fatalf("got active %d expired %d: expected %d %d", st.Active, st.Expired, 1, 1)
+	}
+	if st.StoreOps[OpSave].Count != 1 || st.StoreOps[OpDelete].Count != 1 {
+		t.Fatalf("got %+v: expected one save and one delete", st.StoreOps)
+	}
+	var n uint64
+	for _, c := range st.StoreOps[OpSave].Buckets {
+		n += c
+	}
+	if n != 1 || len(st.StoreOps[OpSave].Buckets) != len(LatencyBuckets())+1 {
+		t.Fatalf("got %v: expected one observation", st.StoreOps[OpSave].Buckets)
+	}
+
+	m.gc()
+	st = m.Stat()
+	if st.GCed != 1 || st.Expired != 0 || st.LastGC.IsZero() {
+		t.Fatalf("got gced %d expired %d last gc %v: expected %d %d and a gc time", st.GCed, st.Expired, st.LastGC, 1, 0)
+	}
+}
+
+func TestMigrationStats(t *testing.T) {
+	if st := NewManager(memstore.New(0)).Stat(); st.Migration != nil {
+		t.Fatalf("got %+v: expected no migration", st.Migration)
+	}
+
+	old, new := memstore.New(0), memstore.New(0)
+	store, err := migratestore.New(old, new, migratestore.Config{Decode: DecodeTokenExpiry(JSONCodec{})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(store, StoreMiddlewares(LogStore(nil)))
+
+	// 旧存储器中的session
+	s, _ := NewManager(old).NewSession()
+	if err = s.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: defaultName, Value: s.GetToken()})
+	ls, err := m.LoadIM(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := ls.GetString("key"); v != "value" {
+		t.Fatalf("got %q: expected the session of the old store", v)
+	}
+
+	st := m.Stat().Migration
+	if st == nil || st.Copied != 1 || st.Done {
+		t.Fatalf("got %+v: expected 1 session copied", st)
+	}
+	if _, found, _ := new.Find(s.GetToken()); !found {
+		t.Fatal("expected the session to be copied to the new store")
+	}
+	if err = store.Copy(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if st = m.Stat().Migration; !st.Done {
+		t.Fatalf("got %+v: expected the copy to be done", st)
+	}
+}
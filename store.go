@@ -1,6 +1,9 @@
 package session
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 // Store 存储session
 // 存储的实际是Session的data和deadline
@@ -25,6 +28,74 @@ type Store interface {
 	Loads() (bs [][]byte, err error)
 }
 
+// StoreContext 支持context的存储器
+// 方法与Store一一对应，ctx被取消或者超时后应尽快返回ctx.Err()
+type StoreContext interface {
+	SaveCtx(ctx context.Context, token string, b []byte, expiry time.Time) (err error)
+
+	DeleteCtx(ctx context.Context, token string) (err error)
+
+	FindCtx(ctx context.Context, token string) (b []byte, found bool, err error)
+
+	DumpsCtx(ctx context.Context) (err error)
+
+	LoadsCtx(ctx context.Context) (bs [][]byte, err error)
+}
+
+// WithContext 将Store转换为StoreContext
+// 如果store本身实现了StoreContext，直接返回；
+// 否则返回一个兼容层，只在调用前检查ctx是否已经结束
+func WithContext(store Store) StoreContext {
+	if sc, ok := store.(StoreContext); ok {
+		return sc
+	}
+	return contextShim{store}
+}
+
+// contextShim 兼容没有实现StoreContext的旧存储器
+type contextShim struct {
+	Store
+}
+
+func (c contextShim) SaveCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Save(token, b, expiry)
+}
+
+func (c contextShim) DeleteCtx(ctx context.Context, token string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Delete(token)
+}
+
+func (c contextShim) FindCtx(ctx context.Context, token string) ([]byte, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	return c.Find(token)
+}
+
+func (c contextShim) DumpsCtx(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Dumps()
+}
+
+func (c contextShim) LoadsCtx(ctx context.Context) ([][]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Loads()
+}
+
+// 可选接口Scanner、QueryableStore、CASStore由存储器自行实现
+// 包装其它存储器的装饰器(如encryptstore)总是实现这些接口，被包装的存储器不支持时返回errors.ErrUnsupported，
+// manager按存储器没有实现该接口处理
+
 // 自带token生成方法的，将数据存储在token里面的存储器，如cookie存储器,客户端存储器
 type clientStore interface {
 	MakeToken(b []byte, expiry time.Time) (token string, err error)
@@ -2,15 +2,23 @@
 package boltstore
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"log"
+	"sort"
 	"time"
 
 	"github.com/boltdb/bolt"
+
+	"github.com/ipiao/session/stores/internal/storeutil"
 )
 
 var (
 	dataBucketName   = []byte("scs_data_bucket")
 	expiryBucketName = []byte("scs_expiry_bucket")
+	// versionBucketName holds the version of each session, see FindVersion.
+	versionBucketName = []byte("scs_version_bucket")
 )
 
 // BoltStore is a SCS session store backed by a boltdb file.
@@ -31,6 +39,10 @@ func New(db *bolt.DB, cleanupInterval time.Duration) *BoltStore {
 			return err
 		}
 		_, err = tx.CreateBucketIfNotExists(expiryBucketName)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(versionBucketName)
 		return err
 	})
 	bs := &BoltStore{
@@ -46,20 +58,8 @@ func New(db *bolt.DB, cleanupInterval time.Duration) *BoltStore {
 // Any existing data + expiry will be over-written.
 func (bs *BoltStore) Save(token string, b []byte, expiry time.Time) error {
 	return bs.db.Update(func(tx *bolt.Tx) error {
-		tokenBytes := []byte(token)
-
-		bucket := tx.Bucket(dataBucketName)
-		err := bucket.Put(tokenBytes, b)
-		if err != nil {
-			return err
-		}
-
-		expiryBucket := tx.Bucket(expiryBucketName)
-		expBytes, err := expiry.MarshalText()
-		if err != nil {
-			return err
-		}
-		return expiryBucket.Put(tokenBytes, expBytes)
+		_, err := txSave(tx, []byte(token), b, expiry)
+		return err
 	})
 }
 
@@ -90,6 +90,49 @@ func (bs *BoltStore) Find(token string) (b []byte, exists bool, err error) {
 	return value, value != nil, err
 }
 
+// FindVersion returns the data and version for a session token. The version is
+// incremented by every save, and is 0 if the session token is not found or is expired.
+func (bs *BoltStore) FindVersion(ctx context.Context, token string) (b []byte, version int64, found bool, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, 0, false, err
+	}
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		tokenBytes := []byte(token)
+		version = txVersion(tx, tokenBytes)
+		if version == 0 {
+			return nil
+		}
+		// v is only valid for the life of the transaction
+		v := tx.Bucket(dataBucketName).Get(tokenBytes)
+		b = make([]byte, len(v))
+		copy(b, v)
+		return nil
+	})
+	if err != nil || version == 0 {
+		return nil, 0, false, err
+	}
+	return b, version, true, nil
+}
+
+// SaveIfVersion saves the data for a session token only if its current version
+// equals version, and returns the new version. If the versions differ nothing is
+// saved and ok is false.
+func (bs *BoltStore) SaveIfVersion(ctx context.Context, token string, b []byte, expiry time.Time, version int64) (newVersion int64, ok bool, err error) {
+	if err = ctx.Err(); err != nil {
+		return 0, false, err
+	}
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		tokenBytes := []byte(token)
+		if txVersion(tx, tokenBytes) != version {
+			return nil
+		}
+		newVersion, err = txSave(tx, tokenBytes, b, expiry)
+		ok = err == nil
+		return err
+	})
+	return newVersion, ok, err
+}
+
 // Delete removes session token and corresponding data.
 func (bs *BoltStore) Delete(token string) error {
 	return bs.db.Update(func(tx *bolt.Tx) error {
@@ -98,6 +141,189 @@ func (bs *BoltStore) Delete(token string) error {
 	})
 }
 
+// SaveCtx is the context-aware version of Save. A bolt transaction can't be
+// interrupted, so ctx is only checked before the transaction starts.
+func (bs *BoltStore) SaveCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return bs.Save(token, b, expiry)
+}
+
+// FindCtx is the context-aware version of Find.
+func (bs *BoltStore) FindCtx(ctx context.Context, token string) ([]byte, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	return bs.Find(token)
+}
+
+// DeleteCtx is the context-aware version of Delete.
+func (bs *BoltStore) DeleteCtx(ctx context.Context, token string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return bs.Delete(token)
+}
+
+// Loads returns the data of all unexpired sessions.
+func (bs *BoltStore) Loads() ([][]byte, error) {
+	return bs.LoadsCtx(context.Background())
+}
+
+// LoadsCtx is the context-aware version of Loads. Iteration stops when ctx is done.
+func (bs *BoltStore) LoadsCtx(ctx context.Context) ([][]byte, error) {
+	var values [][]byte
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		expiryBucket := tx.Bucket(expiryBucketName)
+		return tx.Bucket(dataBucketName).ForEach(func(k, v []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if isExpired(expiryBucket.Get(k)) {
+				return nil
+			}
+			// v is only valid for the life of the transaction
+			b := make([]byte, len(v))
+			copy(b, v)
+			values = append(values, b)
+			return nil
+		})
+	})
+	return values, err
+}
+
+// scanBatch is the number of sessions read in each read-only transaction by Scan.
+const scanBatch = 100
+
+// Scan calls fn for every unexpired session. It walks the data bucket with a cursor in
+// batches, so fn is called outside of any transaction and a slow fn doesn't hold a
+// read transaction open. Scan stops and returns the error if fn returns one.
+func (bs *BoltStore) Scan(ctx context.Context, fn func(token string, b []byte) error) error {
+	var last []byte
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var tokens []string
+		var values [][]byte
+		err := bs.db.View(func(tx *bolt.Tx) error {
+			expiryBucket := tx.Bucket(expiryBucketName)
+			c := tx.Bucket(dataBucketName).Cursor()
+			var k, v []byte
+			if last == nil {
+				k, v = c.First()
+			} else if k, v = c.Seek(last); k != nil && bytes.Equal(k, last) {
+				k, v = c.Next()
+			}
+			for ; k != nil && len(tokens) < scanBatch; k, v = c.Next() {
+				// k and v are only valid for the life of the transaction
+				last = append(last[:0], k...)
+				if isExpired(expiryBucket.Get(k)) {
+					continue
+				}
+				b := make([]byte, len(v))
+				copy(b, v)
+				tokens = append(tokens, string(k))
+				values = append(values, b)
+			}
+			if k == nil {
+				last = nil
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, token := range tokens {
+			if err = fn(token, values[i]); err != nil {
+				return err
+			}
+		}
+		if last == nil {
+			return nil
+		}
+	}
+}
+
+// Dumps is a no-op, boltdb persists every transaction to its file.
+func (bs *BoltStore) Dumps() error {
+	return nil
+}
+
+// DumpsCtx is a no-op, like Dumps.
+func (bs *BoltStore) DumpsCtx(ctx context.Context) error {
+	return nil
+}
+
+// QuerySessions returns the unexpired sessions whose expiry time is in [expiryFrom, expiryTo),
+// ordered by expiry time. A zero expiryFrom or expiryTo means no bound. keyEquals holds
+// keys of the session data with their JSON encoded values, which are checked on the data
+// encoded by session.JSONCodec. They and the match func, if not nil, filter the sessions
+// before offset and limit (0 means no limit) are applied.
+func (bs *BoltStore) QuerySessions(ctx context.Context, expiryFrom, expiryTo time.Time, keyEquals map[string]string, offset, limit int, match func(token string, b []byte) bool) (tokens []string, values [][]byte, err error) {
+	match = storeutil.MatchKeys(keyEquals, match)
+	type entry struct {
+		token  []byte
+		expiry time.Time
+	}
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		var entries []entry
+		now := time.Now()
+		err := tx.Bucket(expiryBucketName).ForEach(func(k, v []byte) error {
+			var expiry time.Time
+			if err := expiry.UnmarshalText(v); err != nil || !now.Before(expiry) {
+				return nil
+			}
+			if !expiryFrom.IsZero() && expiry.Before(expiryFrom) {
+				return nil
+			}
+			if !expiryTo.IsZero() && !expiry.Before(expiryTo) {
+				return nil
+			}
+			entries = append(entries, entry{k, expiry})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].expiry.Before(entries[j].expiry)
+		})
+
+		dataBucket := tx.Bucket(dataBucketName)
+		for _, e := range entries {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			v := dataBucket.Get(e.token)
+			if v == nil {
+				continue
+			}
+			if match != nil && !match(string(e.token), v) {
+				continue
+			}
+			if offset > 0 {
+				offset--
+				continue
+			}
+			// v is only valid for the life of the transaction
+			b := make([]byte, len(v))
+			copy(b, v)
+			tokens = append(tokens, string(e.token))
+			values = append(values, b)
+			if limit > 0 && len(values) >= limit {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return tokens, values, nil
+}
+
 // startCleanup is a helper func to periodically call deleteExpired.
 // It will stop if/when it recieves a message on stopCleanup channel.
 func (bs *BoltStore) startCleanup(cleanupInterval time.Duration) {
@@ -165,12 +391,55 @@ func (bs *BoltStore) deleteExpired() error {
 	return nil
 }
 
+// txSave is a helper to put a key into the data + expiry bucket
+// and increment its version inside a transaction.
+func txSave(tx *bolt.Tx, tokenBytes, b []byte, expiry time.Time) (int64, error) {
+	bucket := tx.Bucket(dataBucketName)
+	err := bucket.Put(tokenBytes, b)
+	if err != nil {
+		return 0, err
+	}
+
+	expiryBucket := tx.Bucket(expiryBucketName)
+	expBytes, err := expiry.MarshalText()
+	if err != nil {
+		return 0, err
+	}
+	err = expiryBucket.Put(tokenBytes, expBytes)
+	if err != nil {
+		return 0, err
+	}
+
+	// an expired session starts again from version 1
+	version := txVersion(tx, tokenBytes) + 1
+	verBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(verBytes, uint64(version))
+	return version, tx.Bucket(versionBucketName).Put(tokenBytes, verBytes)
+}
+
+// txVersion is a helper to get the version of an
+// unexpired key inside a transaction, or 0 if there is none.
+func txVersion(tx *bolt.Tx, tokenBytes []byte) int64 {
+	if tx.Bucket(dataBucketName).Get(tokenBytes) == nil {
+		return 0
+	}
+	if isExpired(tx.Bucket(expiryBucketName).Get(tokenBytes)) {
+		return 0
+	}
+	verBytes := tx.Bucket(versionBucketName).Get(tokenBytes)
+	if len(verBytes) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(verBytes))
+}
+
 // txDelete is a helper to delete a key
-// from both the data + expiry bucket
+// from the data, expiry + version bucket
 // inside a transaction.
 func txDelete(tx *bolt.Tx, tokenBytes []byte) error {
 	expiryBucket := tx.Bucket(expiryBucketName)
 	expiryBucket.Delete(tokenBytes)
+	tx.Bucket(versionBucketName).Delete(tokenBytes)
 
 	bucket := tx.Bucket(dataBucketName)
 	return bucket.Delete(tokenBytes)
@@ -2,7 +2,11 @@ package boltstore
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"os"
 	"testing"
 	"time"
 
@@ -186,3 +190,130 @@ func TestStopNilCleanup(t *testing.T) {
 	// A send to a nil channel will block forever
 	m.StopCleanup()
 }
+
+func TestLoads(t *testing.T) {
+	db, err := bolt.Open("/tmp/testing.db", 0600, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	bs := New(db, 0)
+	err = bs.Save("session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bs.Save("expired_token", []byte("expired_data"), time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := bs.Loads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || string(values[0]) != "encoded_data" {
+		t.Fatalf("got %q: expected %q", values, []string{"encoded_data"})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = bs.LoadsCtx(ctx)
+	if err != context.Canceled {
+		t.Fatalf("got %v: expected %v", err, context.Canceled)
+	}
+}
+
+func TestScan(t *testing.T) {
+	os.Remove("/tmp/testing.db")
+	db, err := bolt.Open("/tmp/testing.db", 0600, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	bs := New(db, 0)
+	n := scanBatch*2 + 10
+	for i := 0; i < n; i++ {
+		err = bs.Save(fmt.Sprintf("token_%03d", i), []byte(fmt.Sprint(i)), time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = bs.Save("expired_token", []byte("expired_data"), time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	err = bs.Scan(context.Background(), func(token string, b []byte) error {
+		if seen[token] {
+			t.Fatalf("token %s scanned twice", token)
+		}
+		seen[token] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != n || seen["expired_token"] {
+		t.Fatalf("got %d tokens: expected %d unexpired", len(seen), n)
+	}
+
+	stop := errors.New("stop")
+	var count int
+	err = bs.Scan(context.Background(), func(token string, b []byte) error {
+		count++
+		return stop
+	})
+	if err != stop || count != 1 {
+		t.Fatalf("got %v after %d calls: expected %v after 1", err, count, stop)
+	}
+}
+
+func TestSaveIfVersion(t *testing.T) {
+	os.Remove("/tmp/testing.db")
+	db, err := bolt.Open("/tmp/testing.db", 0600, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	bs := New(db, 0)
+	ctx := context.Background()
+	expiry := time.Now().Add(time.Minute)
+
+	version, ok, err := bs.SaveIfVersion(ctx, "session_token", []byte("v1"), expiry, 0)
+	if err != nil || !ok || version != 1 {
+		t.Fatalf("got %d %v %v: expected version 1", version, ok, err)
+	}
+	_, ok, err = bs.SaveIfVersion(ctx, "session_token", []byte("stale"), expiry, 0)
+	if err != nil || ok {
+		t.Fatalf("got %v %v: expected a conflict", ok, err)
+	}
+	err = bs.Save("session_token", []byte("v2"), expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, version, found, err := bs.FindVersion(ctx, "session_token")
+	if err != nil || !found || version != 2 || !bytes.Equal(b, []byte("v2")) {
+		t.Fatalf("got %s %d %v %v: expected v2 at version 2", b, version, found, err)
+	}
+	version, ok, err = bs.SaveIfVersion(ctx, "session_token", []byte("v3"), expiry, 2)
+	if err != nil || !ok || version != 3 {
+		t.Fatalf("got %d %v %v: expected version 3", version, ok, err)
+	}
+
+	err = bs.Delete("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, version, found, err = bs.FindVersion(ctx, "session_token")
+	if err != nil || found || version != 0 {
+		t.Fatalf("got %d %v %v: expected a deleted session at version 0", version, found, err)
+	}
+	_, ok, err = bs.SaveIfVersion(ctx, "session_token", []byte("v4"), expiry, 3)
+	if err != nil || ok {
+		t.Fatalf("got %v %v: expected a conflict on a deleted session", ok, err)
+	}
+}
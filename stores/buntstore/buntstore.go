@@ -2,11 +2,21 @@
 package buntstore
 
 import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/tidwall/buntdb"
+
+	"github.com/ipiao/session/stores/internal/storeutil"
 )
 
+// versionPrefix is prepended to a session token to form the key holding its
+// version, see FindVersion. These keys are skipped when iterating over sessions.
+const versionPrefix = "scs:version:"
+
 // BuntStore is a SCS session store backed by a buntdb file.
 type BuntStore struct {
 	db *buntdb.DB
@@ -24,7 +34,7 @@ func New(db *buntdb.DB) *BuntStore {
 // Any existing data + expiry will be over-written.
 func (bs *BuntStore) Save(token string, b []byte, expiry time.Time) error {
 	return bs.db.Update(func(tx *buntdb.Tx) error {
-		_, _, err := tx.Set(token, string(b), &buntdb.SetOptions{Expires: true, TTL: expiry.Sub(time.Now())})
+		_, err := txSave(tx, token, b, expiry)
 		return err
 	})
 }
@@ -51,6 +61,263 @@ func (bs *BuntStore) Find(token string) (b []byte, exists bool, err error) {
 func (bs *BuntStore) Delete(token string) error {
 	return bs.db.Update(func(tx *buntdb.Tx) error {
 		_, err := tx.Delete(token)
+		if _, verr := tx.Delete(versionPrefix + token); verr != nil && verr != buntdb.ErrNotFound {
+			return verr
+		}
 		return err
 	})
 }
+
+// FindVersion returns the data and version for a session token. The version is
+// incremented by every save, and is 0 if the session token is not found or is expired.
+func (bs *BuntStore) FindVersion(ctx context.Context, token string) (b []byte, version int64, found bool, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, 0, false, err
+	}
+	var value string
+	err = bs.db.View(func(tx *buntdb.Tx) error {
+		value, err = tx.Get(token)
+		if err != nil {
+			return err
+		}
+		version, err = txVersion(tx, token)
+		return err
+	})
+	if err != nil {
+		if err == buntdb.ErrNotFound {
+			return nil, 0, false, nil
+		}
+		return nil, 0, false, err
+	}
+	return []byte(value), version, true, nil
+}
+
+// SaveIfVersion saves the data for a session token only if its current version
+// equals version, and returns the new version. If the versions differ nothing is
+// saved and ok is false.
+func (bs *BuntStore) SaveIfVersion(ctx context.Context, token string, b []byte, expiry time.Time, version int64) (newVersion int64, ok bool, err error) {
+	if err = ctx.Err(); err != nil {
+		return 0, false, err
+	}
+	err = bs.db.Update(func(tx *buntdb.Tx) error {
+		current, err := txVersion(tx, token)
+		if err != nil || current != version {
+			return err
+		}
+		newVersion, err = txSave(tx, token, b, expiry)
+		ok = err == nil
+		return err
+	})
+	return newVersion, ok, err
+}
+
+// SaveCtx is the context-aware version of Save. A buntdb transaction can't be
+// interrupted, so ctx is only checked before the transaction starts.
+func (bs *BuntStore) SaveCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return bs.Save(token, b, expiry)
+}
+
+// FindCtx is the context-aware version of Find.
+func (bs *BuntStore) FindCtx(ctx context.Context, token string) ([]byte, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	return bs.Find(token)
+}
+
+// DeleteCtx is the context-aware version of Delete.
+func (bs *BuntStore) DeleteCtx(ctx context.Context, token string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return bs.Delete(token)
+}
+
+// Loads returns the data of all unexpired sessions.
+func (bs *BuntStore) Loads() ([][]byte, error) {
+	return bs.LoadsCtx(context.Background())
+}
+
+// LoadsCtx is the context-aware version of Loads. Iteration stops when ctx is done.
+func (bs *BuntStore) LoadsCtx(ctx context.Context) ([][]byte, error) {
+	var values [][]byte
+	err := bs.db.View(func(tx *buntdb.Tx) error {
+		return tx.Ascend("", func(key, value string) bool {
+			if ctx.Err() != nil {
+				return false
+			}
+			if strings.HasPrefix(key, versionPrefix) {
+				return true
+			}
+			values = append(values, []byte(value))
+			return true
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, ctx.Err()
+}
+
+// scanBatch is the number of sessions read in each read-only transaction by Scan.
+const scanBatch = 100
+
+// Scan calls fn for every unexpired session. It walks the keys in batches, so fn is
+// called outside of any transaction and a slow fn doesn't block writers. Scan stops
+// and returns the error if fn returns one.
+func (bs *BuntStore) Scan(ctx context.Context, fn func(token string, b []byte) error) error {
+	var last string
+	first := true
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var tokens, values []string
+		err := bs.db.View(func(tx *buntdb.Tx) error {
+			return tx.AscendGreaterOrEqual("", last, func(key, value string) bool {
+				if !first && key == last {
+					return true
+				}
+				if strings.HasPrefix(key, versionPrefix) {
+					return true
+				}
+				tokens = append(tokens, key)
+				values = append(values, value)
+				return len(tokens) < scanBatch
+			})
+		})
+		if err != nil {
+			return err
+		}
+		for i, token := range tokens {
+			if err = fn(token, []byte(values[i])); err != nil {
+				return err
+			}
+		}
+		if len(tokens) < scanBatch {
+			return nil
+		}
+		last, first = tokens[len(tokens)-1], false
+	}
+}
+
+// Dumps is a no-op, buntdb persists the data itself.
+func (bs *BuntStore) Dumps() error {
+	return nil
+}
+
+// DumpsCtx is a no-op, like Dumps.
+func (bs *BuntStore) DumpsCtx(ctx context.Context) error {
+	return nil
+}
+
+// QuerySessions returns the unexpired sessions whose expiry time is in [expiryFrom, expiryTo),
+// ordered by expiry time. A zero expiryFrom or expiryTo means no bound. keyEquals holds
+// keys of the session data with their JSON encoded values, which are checked on the data
+// encoded by session.JSONCodec. They and the match func, if not nil, filter the sessions
+// before offset and limit (0 means no limit) are applied.
+func (bs *BuntStore) QuerySessions(ctx context.Context, expiryFrom, expiryTo time.Time, keyEquals map[string]string, offset, limit int, match func(token string, b []byte) bool) (tokens []string, values [][]byte, err error) {
+	match = storeutil.MatchKeys(keyEquals, match)
+	type entry struct {
+		token  string
+		value  string
+		expiry time.Time
+	}
+	var entries []entry
+	now := time.Now()
+	err = bs.db.View(func(tx *buntdb.Tx) error {
+		var ierr error
+		err := tx.Ascend("", func(key, value string) bool {
+			if strings.HasPrefix(key, versionPrefix) {
+				return true
+			}
+			ttl, err := tx.TTL(key)
+			if err != nil {
+				ierr = err
+				return false
+			}
+			// sessions are always saved with a TTL, a negative one means no expiry
+			if ttl < 0 {
+				return true
+			}
+			expiry := now.Add(ttl)
+			if !expiryFrom.IsZero() && expiry.Before(expiryFrom) {
+				return true
+			}
+			if !expiryTo.IsZero() && !expiry.Before(expiryTo) {
+				return true
+			}
+			entries = append(entries, entry{key, value, expiry})
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		return ierr
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].expiry.Before(entries[j].expiry)
+	})
+
+	for _, e := range entries {
+		if err = ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		b := []byte(e.value)
+		if match != nil && !match(e.token, b) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		tokens = append(tokens, e.token)
+		values = append(values, b)
+		if limit > 0 && len(values) >= limit {
+			break
+		}
+	}
+	return tokens, values, nil
+}
+
+// txSave is a helper to set a key and increment its version inside a transaction.
+// The version key expires together with the session.
+func txSave(tx *buntdb.Tx, token string, b []byte, expiry time.Time) (int64, error) {
+	version, err := txVersion(tx, token)
+	if err != nil {
+		return 0, err
+	}
+	// the TTL is computed once so that both keys expire at the same time
+	opts := &buntdb.SetOptions{Expires: true, TTL: expiry.Sub(time.Now())}
+	if _, _, err = tx.Set(token, string(b), opts); err != nil {
+		return 0, err
+	}
+	version++
+	_, _, err = tx.Set(versionPrefix+token, strconv.FormatInt(version, 10), opts)
+	return version, err
+}
+
+// txVersion is a helper to get the version of a session token inside a
+// transaction, or 0 if there is none.
+func txVersion(tx *buntdb.Tx, token string) (int64, error) {
+	if _, err := tx.Get(token); err != nil {
+		if err == buntdb.ErrNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	v, err := tx.Get(versionPrefix + token)
+	if err != nil {
+		if err == buntdb.ErrNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
@@ -2,6 +2,8 @@ package buntstore
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"os"
 	"testing"
 	"time"
@@ -176,3 +178,117 @@ func TestCleanup(t *testing.T) {
 		}
 	}
 }
+
+func TestQuerySessions(t *testing.T) {
+	db := getTestDatabase()
+	defer db.Close()
+
+	bs := New(db)
+	now := time.Now()
+	bs.Save("key3", []byte("value3"), now.Add(3*time.Minute))
+	bs.Save("key1", []byte("value1"), now.Add(time.Minute))
+	bs.Save("key2", []byte("value2"), now.Add(2*time.Minute))
+
+	tokens, values, err := bs.QuerySessions(context.Background(), now.Add(90*time.Second), time.Time{}, nil, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens[0] != "key2" || tokens[1] != "key3" {
+		t.Fatalf("expected [key2 key3], got %v", tokens)
+	}
+	if !bytes.Equal(values[0], []byte("value2")) {
+		t.Fatalf("expected value2, got %s", values[0])
+	}
+
+	match := func(token string, b []byte) bool {
+		return token != "key1"
+	}
+	tokens, _, err = bs.QuerySessions(context.Background(), time.Time{}, time.Time{}, nil, 1, 1, match)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0] != "key3" {
+		t.Fatalf("expected [key3], got %v", tokens)
+	}
+}
+
+func TestScan(t *testing.T) {
+	db := getTestDatabase()
+	defer db.Close()
+
+	bs := New(db)
+	n := scanBatch*2 + 10
+	for i := 0; i < n; i++ {
+		err := bs.Save(fmt.Sprintf("token_%03d", i), []byte(fmt.Sprint(i)), time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := make(map[string]bool)
+	err := bs.Scan(context.Background(), func(token string, b []byte) error {
+		if seen[token] {
+			t.Fatalf("token %s scanned twice", token)
+		}
+		seen[token] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != n {
+		t.Fatalf("got %d tokens: expected %d", len(seen), n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = bs.Scan(ctx, func(token string, b []byte) error { return nil })
+	if err != context.Canceled {
+		t.Fatalf("got %v: expected %v", err, context.Canceled)
+	}
+}
+
+func TestSaveIfVersion(t *testing.T) {
+	db := getTestDatabase()
+	defer db.Close()
+
+	bs := New(db)
+	ctx := context.Background()
+	expiry := time.Now().Add(time.Minute)
+
+	version, ok, err := bs.SaveIfVersion(ctx, "session_token", []byte("v1"), expiry, 0)
+	if err != nil || !ok || version != 1 {
+		t.Fatalf("got %d %v %v: expected version 1", version, ok, err)
+	}
+	_, ok, err = bs.SaveIfVersion(ctx, "session_token", []byte("stale"), expiry, 0)
+	if err != nil || ok {
+		t.Fatalf("got %v %v: expected a conflict", ok, err)
+	}
+	err = bs.Save("session_token", []byte("v2"), expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, version, found, err := bs.FindVersion(ctx, "session_token")
+	if err != nil || !found || version != 2 || !bytes.Equal(b, []byte("v2")) {
+		t.Fatalf("got %s %d %v %v: expected v2 at version 2", b, version, found, err)
+	}
+
+	// version keys are not sessions
+	values, err := bs.Loads()
+	if err != nil || len(values) != 1 {
+		t.Fatalf("got %d values %v: expected only the session", len(values), err)
+	}
+
+	err = bs.Delete("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, version, found, err = bs.FindVersion(ctx, "session_token")
+	if err != nil || found || version != 0 {
+		t.Fatalf("got %d %v %v: expected a deleted session at version 0", version, found, err)
+	}
+	_, ok, err = bs.SaveIfVersion(ctx, "session_token", []byte("v3"), expiry, 2)
+	if err != nil || ok {
+		t.Fatalf("got %v %v: expected a conflict on a deleted session", ok, err)
+	}
+}
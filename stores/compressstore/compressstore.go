@@ -0,0 +1,240 @@
+// Package compressstore is a decorator which compresses large session data for the
+// stores of the SCS session package, both the server-side stores (redisstore,
+// mysqlstore, boltstore, ...) and the client-side cookiestore.
+//
+// Data of at least threshold bytes is compressed before it is passed to the wrapped
+// store, and saved with a header recording the codec. Smaller data, and data which
+// doesn't get smaller, is saved as is. Values without the header, such as the values
+// saved before the store was wrapped, are read as they are, so compressed and
+// uncompressed data can be mixed during a rollout:
+//
+//	store, err := compressstore.Wrap(redisstore.New(pool), compressstore.Gzip(gzip.BestSpeed), compressstore.DefaultThreshold)
+//
+//	store, err := compressstore.WrapClient(cookiestore.New(key), compressstore.Gzip(gzip.DefaultCompression), 512)
+//
+// Gzip is built in. The zstdcodec and snappycodec subpackages provide zstd and snappy.
+// The codecs passed after threshold are only used to decompress, to keep reading the
+// values saved before the codec was changed.
+//
+// To compress and encrypt, wrap the encryptstore with the compressstore, so that data
+// is compressed before it is encrypted.
+package compressstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ipiao/session/stores/internal/storeutil"
+)
+
+// Store is the interface of the wrapped store, the same as session.Store.
+type Store = storeutil.Store
+
+// ClientStore is a store which keeps the data in the token, like cookiestore.
+type ClientStore interface {
+	Store
+	MakeToken(b []byte, expiry time.Time) (token string, err error)
+}
+
+// Codec compresses session data. ID is saved in the header of the compressed values
+// and must be unique among the codecs of a store.
+type Codec interface {
+	ID() byte
+	Compress(b []byte) ([]byte, error)
+	Decompress(b []byte) ([]byte, error)
+}
+
+// The IDs of the provided codecs. Other codecs should use other IDs.
+const (
+	GzipID   byte = 1
+	ZstdID   byte = 2
+	SnappyID byte = 3
+)
+
+// MaxDecompressedSize is the largest size of the data a codec decompresses. A value
+// which decompresses to more, such as a compression bomb, can't be read.
+var MaxDecompressedSize = 16 << 20
+
+// DefaultThreshold is the suggested size from which data is compressed. Smaller data
+// seldom gets much smaller.
+const DefaultThreshold = 1024
+
+// magic starts every compressed value, followed by the codec ID. It can't start a
+// JSON, gob or msgpack encoded session, nor an encryptstore value.
+var magic = []byte{0xff, 'S', 'C', 'Z'}
+
+const headerSize = 4 + 1
+
+var (
+	errNoCodec         = errors.New("compressstore: a codec is required")
+	errDuplicateCodec  = errors.New("compressstore: duplicate codec ID")
+	errUnknownCodec    = errors.New("compressstore: value is compressed with an unknown codec")
+	errNotCompressed   = errors.New("compressstore: value is not compressed")
+	errInvalidEncoding = errors.New("compressstore: value can't be decompressed")
+	errTooLarge        = errors.New("compressstore: decompressed value is too large")
+)
+
+// CompressStore compresses the data saved to the wrapped store. The read methods
+// return the decompressed data; values which can't be decompressed are reported as
+// not found, like encryptstore, and uncompressed values are returned as they are.
+type CompressStore struct {
+	storeutil.Transform
+	codecs    []Codec
+	threshold int
+}
+
+// Wrap returns a CompressStore which compresses with codec the data of at least
+// threshold bytes saved to store. The old codecs are only used to decompress.
+func Wrap(store Store, codec Codec, threshold int, oldCodecs ...Codec) (*CompressStore, error) {
+	if codec == nil {
+		return nil, errNoCodec
+	}
+	c := &CompressStore{threshold: threshold}
+	c.Transform = storeutil.NewTransform(store, c.encode, c.open)
+	for _, codec := range append([]Codec{codec}, oldCodecs...) {
+		if _, err := c.codec(codec.ID()); err == nil {
+			return nil, fmt.Errorf("%w %d", errDuplicateCodec, codec.ID())
+		}
+		c.codecs = append(c.codecs, codec)
+	}
+	return c, nil
+}
+
+// ClientCompressStore compresses the data kept in the tokens of the wrapped client
+// store, so that larger sessions fit in a cookie.
+type ClientCompressStore struct {
+	*CompressStore
+	store ClientStore
+}
+
+// WrapClient is like Wrap for a client store such as cookiestore. MakeToken compresses
+// the data before it is put into the token.
+func WrapClient(store ClientStore, codec Codec, threshold int, oldCodecs ...Codec) (*ClientCompressStore, error) {
+	c, err := Wrap(store, codec, threshold, oldCodecs...)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientCompressStore{CompressStore: c, store: store}, nil
+}
+
+// MakeToken compresses the data and makes the token with the wrapped store.
+func (c *ClientCompressStore) MakeToken(b []byte, expiry time.Time) (string, error) {
+	v, err := c.compress(b)
+	if err != nil {
+		return "", err
+	}
+	return c.store.MakeToken(v, expiry)
+}
+
+// codec returns the codec with id.
+func (c *CompressStore) codec(id byte) (Codec, error) {
+	for _, codec := range c.codecs {
+		if codec.ID() == id {
+			return codec, nil
+		}
+	}
+	return nil, errUnknownCodec
+}
+
+// compress compresses b with the current codec if it is large enough, and if the
+// result is smaller.
+func (c *CompressStore) compress(b []byte) ([]byte, error) {
+	if len(b) < c.threshold {
+		return b, nil
+	}
+	codec := c.codecs[0]
+	z, err := codec.Compress(b)
+	if err != nil {
+		return nil, err
+	}
+	if headerSize+len(z) >= len(b) {
+		return b, nil
+	}
+	v := make([]byte, 0, headerSize+len(z))
+	v = append(v, magic...)
+	v = append(v, codec.ID())
+	return append(v, z...), nil
+}
+
+// decompress decompresses a value made by compress. A value without the header is
+// returned as is, with errNotCompressed.
+func (c *CompressStore) decompress(v []byte) ([]byte, error) {
+	if !bytes.HasPrefix(v, magic) {
+		return v, errNotCompressed
+	}
+	if len(v) < headerSize {
+		return nil, errInvalidEncoding
+	}
+	codec, err := c.codec(v[4])
+	if err != nil {
+		return nil, err
+	}
+	b, err := codec.Decompress(v[headerSize:])
+	if err != nil {
+		return nil, errInvalidEncoding
+	}
+	return b, nil
+}
+
+// encode compresses b for the write methods.
+func (c *CompressStore) encode(token string, b []byte, expiry time.Time) ([]byte, error) {
+	return c.compress(b)
+}
+
+// open decompresses v for the read methods. Uncompressed values are accepted.
+func (c *CompressStore) open(token string, v []byte) ([]byte, bool) {
+	b, err := c.decompress(v)
+	if err != nil && err != errNotCompressed {
+		return nil, false
+	}
+	return b, true
+}
+
+type gzipCodec struct {
+	level int
+}
+
+// Gzip returns a codec which compresses with gzip at level, one of the compress/gzip
+// levels.
+func Gzip(level int) Codec {
+	return gzipCodec{level}
+}
+
+func (g gzipCodec) ID() byte {
+	return GzipID
+}
+
+func (g gzipCodec) Compress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, g.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(b); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (g gzipCodec) Decompress(b []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	b, err = io.ReadAll(io.LimitReader(r, int64(MaxDecompressedSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > MaxDecompressedSize {
+		return nil, errTooLarge
+	}
+	return b, nil
+}
@@ -0,0 +1,153 @@
+package compressstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ipiao/session/stores/cookiestore"
+	"github.com/ipiao/session/stores/internal/storetest"
+	"github.com/ipiao/session/stores/memstore"
+)
+
+// large is a session carrying a cart, larger than a cookie allows
+var large = []byte(`{"cart":[` + string(bytes.Repeat([]byte(`{"sku":"A-1000","qty":1,"price":"9.99"},`), 200)) + `{}]}`)
+
+// idCodec is a codec with another ID, to test old codecs
+type idCodec struct {
+	Codec
+	id byte
+}
+
+func (c idCodec) ID() byte { return c.id }
+
+func TestWrap(t *testing.T) {
+	if _, err := Wrap(memstore.New(0), nil, 0); err != errNoCodec {
+		t.Fatalf("got %v: expected %v", err, errNoCodec)
+	}
+	gz := Gzip(gzip.DefaultCompression)
+	if _, err := Wrap(memstore.New(0), gz, 0, gz); !errors.Is(err, errDuplicateCodec) {
+		t.Fatalf("got %v: expected %v", err, errDuplicateCodec)
+	}
+}
+
+func TestSaveFind(t *testing.T) {
+	inner := storetest.NewBuntStore(t)
+	c, err := Wrap(inner, Gzip(gzip.BestSpeed), DefaultThreshold)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry := time.Now().Add(time.Minute)
+
+	for token, b := range map[string][]byte{"small": []byte(`{"a":1}`), "large": large} {
+		if err = c.Save(token, b, expiry); err != nil {
+			t.Fatal(err)
+		}
+		got, found, err := c.Find(token)
+		if err != nil || !found || !bytes.Equal(got, b) {
+			t.Fatalf("got %v %v: expected the data of %s", found, err, token)
+		}
+	}
+
+	v, _, _ := inner.Find("small")
+	if !bytes.Equal(v, []byte(`{"a":1}`)) {
+		t.Fatalf("got %q: expected data below the threshold to be saved as is", v)
+	}
+	v, _, _ = inner.Find("large")
+	if !bytes.HasPrefix(v, magic) || v[4] != GzipID || len(v) >= len(large) {
+		t.Fatalf("got %d bytes: expected the data to be compressed", len(v))
+	}
+
+	// 包装之前保存的未压缩数据
+	inner.Save("plain", large, expiry)
+	if b, found, _ := c.Find("plain"); !found || !bytes.Equal(b, large) {
+		t.Fatal("expected the uncompressed value")
+	}
+}
+
+func TestOldCodecs(t *testing.T) {
+	inner := memstore.New(0)
+	old, _ := Wrap(inner, Gzip(gzip.BestCompression), 0)
+	old.Save("session_token", large, time.Now().Add(time.Minute))
+
+	c, _ := Wrap(inner, idCodec{Gzip(gzip.BestSpeed), 100}, 0)
+	if _, found, _ := c.Find("session_token"); found {
+		t.Fatal("expected a value of an unknown codec not to be found")
+	}
+	c, _ = Wrap(inner, idCodec{Gzip(gzip.BestSpeed), 100}, 0, Gzip(gzip.BestCompression))
+	if b, found, _ := c.Find("session_token"); !found || !bytes.Equal(b, large) {
+		t.Fatal("expected the old codec to decompress")
+	}
+}
+
+func TestClient(t *testing.T) {
+	cookie := cookiestore.New([]byte("G_TdvPJ9T8C4p&A?Wr3YAUYW$*9vn4?t"))
+	expiry := time.Now().Add(time.Minute)
+	if _, err := cookie.MakeToken(large, expiry); err == nil {
+		t.Fatal("expected the data not to fit in a cookie")
+	}
+
+	c, err := WrapClient(cookie, Gzip(gzip.DefaultCompression), 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := c.MakeToken(large, expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, found, err := c.Find(token)
+	if err != nil || !found || !bytes.Equal(b, large) {
+		t.Fatalf("got %v %v: expected the data in the token", found, err)
+	}
+
+	// 压缩之前生成的token
+	token, _ = cookie.MakeToken([]byte(`{"a":1}`), expiry)
+	if b, found, _ = c.Find(token); !found || !bytes.Equal(b, []byte(`{"a":1}`)) {
+		t.Fatalf("got %s: expected the uncompressed data", b)
+	}
+}
+
+func TestScanAndCAS(t *testing.T) {
+	c, _ := Wrap(storetest.NewBuntStore(t), Gzip(gzip.BestSpeed), 0)
+	ctx := context.Background()
+	expiry := time.Now().Add(time.Minute)
+
+	if _, ok, err := c.SaveIfVersion(ctx, "a", large, expiry, 0); err != nil || !ok {
+		t.Fatalf("got %v %v: expected the data to be saved", ok, err)
+	}
+	b, version, found, err := c.FindVersion(ctx, "a")
+	if err != nil || !found || version != 1 || !bytes.Equal(b, large) {
+		t.Fatalf("got %d %v %v: expected the data at version 1", version, found, err)
+	}
+	err = c.Scan(ctx, func(token string, b []byte) error {
+		if !bytes.Equal(b, large) {
+			t.Fatalf("expected the decompressed data of %s", token)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 隐藏memstore的Scan
+	m, _ := Wrap(struct{ Store }{memstore.New(0)}, Gzip(gzip.BestSpeed), 0)
+	if err = m.Scan(ctx, nil); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("got %v: expected %v", err, errors.ErrUnsupported)
+	}
+}
+
+func TestMaxDecompressedSize(t *testing.T) {
+	inner := memstore.New(0)
+	c, _ := Wrap(inner, Gzip(gzip.BestCompression), 0)
+	bomb := make([]byte, MaxDecompressedSize+1)
+	c.Save("session_token", bomb, time.Now().Add(time.Minute))
+	if v, _, _ := inner.Find("session_token"); len(v) >= len(bomb)/100 {
+		t.Fatalf("got %d bytes: expected the data to be compressed", len(v))
+	}
+	if _, found, _ := c.Find("session_token"); found {
+		t.Fatal("expected a value larger than MaxDecompressedSize not to be found")
+	}
+}
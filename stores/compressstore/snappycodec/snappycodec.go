@@ -0,0 +1,41 @@
+// Package snappycodec provides a snappy codec for compressstore, relying on
+// github.com/golang/snappy.
+package snappycodec
+
+import (
+	"errors"
+
+	"github.com/golang/snappy"
+	"github.com/ipiao/session/stores/compressstore"
+)
+
+var errTooLarge = errors.New("snappycodec: decompressed value is too large")
+
+type codec struct{}
+
+// New returns a codec which compresses with snappy. Snappy compresses less than gzip
+// and zstd, but faster.
+func New() compressstore.Codec {
+	return codec{}
+}
+
+func (codec) ID() byte {
+	return compressstore.SnappyID
+}
+
+func (codec) Compress(b []byte) ([]byte, error) {
+	return snappy.Encode(nil, b), nil
+}
+
+// Decompress refuses the values which decompress to more than
+// compressstore.MaxDecompressedSize.
+func (codec) Decompress(b []byte) ([]byte, error) {
+	n, err := snappy.DecodedLen(b)
+	if err != nil {
+		return nil, err
+	}
+	if n > compressstore.MaxDecompressedSize {
+		return nil, errTooLarge
+	}
+	return snappy.Decode(nil, b)
+}
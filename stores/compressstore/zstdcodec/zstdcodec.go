@@ -0,0 +1,40 @@
+// Package zstdcodec provides a zstd codec for compressstore, relying on
+// github.com/klauspost/compress/zstd.
+package zstdcodec
+
+import (
+	"github.com/ipiao/session/stores/compressstore"
+	"github.com/klauspost/compress/zstd"
+)
+
+type codec struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+// New returns a codec which compresses with zstd at level. The codec can be used
+// concurrently. It refuses the values which decompress to more than
+// compressstore.MaxDecompressedSize at the time New is called.
+func New(level zstd.EncoderLevel) (compressstore.Codec, error) {
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level))
+	if err != nil {
+		return nil, err
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(compressstore.MaxDecompressedSize)))
+	if err != nil {
+		return nil, err
+	}
+	return &codec{enc: enc, dec: dec}, nil
+}
+
+func (c *codec) ID() byte {
+	return compressstore.ZstdID
+}
+
+func (c *codec) Compress(b []byte) ([]byte, error) {
+	return c.enc.EncodeAll(b, nil), nil
+}
+
+func (c *codec) Decompress(b []byte) ([]byte, error) {
+	return c.dec.DecodeAll(b, nil)
+}
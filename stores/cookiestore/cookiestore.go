@@ -1,6 +1,7 @@
 package cookiestore
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
@@ -142,3 +143,32 @@ func (c *CookieStore) Loads() (bs [][]byte, err error) {
 func (c *CookieStore) Dumps() (err error) {
 	return nil
 }
+
+// FindCtx is the context-aware version of Find. Decoding happens locally, so ctx
+// is only checked before the token is decoded.
+func (c *CookieStore) FindCtx(ctx context.Context, token string) ([]byte, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	return c.Find(token)
+}
+
+// SaveCtx is a no-op, like Save.
+func (c *CookieStore) SaveCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	return nil
+}
+
+// DeleteCtx is a no-op, like Delete.
+func (c *CookieStore) DeleteCtx(ctx context.Context, token string) error {
+	return nil
+}
+
+// LoadsCtx 加载所有
+func (c *CookieStore) LoadsCtx(ctx context.Context) ([][]byte, error) {
+	return nil, nil
+}
+
+// DumpsCtx 数据存储
+func (c *CookieStore) DumpsCtx(ctx context.Context) error {
+	return nil
+}
@@ -5,10 +5,12 @@
 package dynamostore
 
 import (
+	"context"
 	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 )
 
@@ -16,12 +18,13 @@ import (
 // a wrapper around a DynamoDB client. And table is a table name session stored. token, data,
 // expiry are key names.
 type DynamoStore struct {
-	DB     *dynamodb.DynamoDB
-	table  string
-	token  string
-	data   string
-	expiry string
-	ttl    string
+	DB      *dynamodb.DynamoDB
+	table   string
+	token   string
+	data    string
+	expiry  string
+	ttl     string
+	version string
 }
 
 const (
@@ -30,6 +33,8 @@ const (
 	defaultData   = "data"
 	defaultExpiry = "expiry"
 	defaultTTL    = "ttl"
+	// defaultVersion is the key name of the version used by FindVersion and SaveIfVersion.
+	defaultVersion = "version"
 )
 
 // New returns a new DynamoStore instance. The client parameter shoud be a pointer to a
@@ -43,18 +48,50 @@ func New(dynamo *dynamodb.DynamoDB) *DynamoStore {
 // The parameter table is DynamoDB tabel name, and token/data/expiry are key names.
 func NewWithOption(dynamo *dynamodb.DynamoDB, table string, token string, data string, expiry string, ttl string) *DynamoStore {
 	return &DynamoStore{
-		DB:     dynamo,
-		table:  table,
-		token:  token,
-		data:   data,
-		expiry: expiry,
-		ttl:    ttl,
+		DB:      dynamo,
+		table:   table,
+		token:   token,
+		data:    data,
+		expiry:  expiry,
+		ttl:     ttl,
+		version: defaultVersion,
 	}
 }
 
 // Find returns the data for a given session token from the DynamoStore instance. If the session
 // token is not found or is expired, the returned exists flag will be set to false.
 func (d *DynamoStore) Find(token string) (b []byte, found bool, err error) {
+	return d.FindCtx(context.Background(), token)
+}
+
+// FindCtx is the context-aware version of Find. The request is cancelled when ctx is done.
+func (d *DynamoStore) FindCtx(ctx context.Context, token string) (b []byte, found bool, err error) {
+	item, err := d.getItem(ctx, token)
+	if err != nil || item == nil {
+		return nil, false, err
+	}
+	return item[d.DataName()].B, true, nil
+}
+
+// FindVersion returns the data and version for a given session token. The version is
+// incremented by every save, and is 0 if the session token is not found or is expired.
+func (d *DynamoStore) FindVersion(ctx context.Context, token string) (b []byte, version int64, found bool, err error) {
+	item, err := d.getItem(ctx, token)
+	if err != nil || item == nil {
+		return nil, 0, false, err
+	}
+	if v := item[d.VersionName()]; v != nil {
+		version, err = strconv.ParseInt(aws.StringValue(v.N), 10, 64)
+		if err != nil {
+			return nil, 0, false, err
+		}
+	}
+	return item[d.DataName()].B, version, true, nil
+}
+
+// getItem returns the unexpired item for a given session token, or nil if there is none.
+// An expired item is deleted.
+func (d *DynamoStore) getItem(ctx context.Context, token string) (map[string]*dynamodb.AttributeValue, error) {
 	params := &dynamodb.GetItemInput{
 		TableName: aws.String(d.TableName()),
 		Key: map[string]*dynamodb.AttributeValue{
@@ -65,42 +102,91 @@ func (d *DynamoStore) Find(token string) (b []byte, found bool, err error) {
 		ConsistentRead: aws.Bool(true),
 	}
 
-	resp, err := d.DB.GetItem(params)
+	resp, err := d.DB.GetItemWithContext(ctx, params)
 	if err != nil {
-		return nil, false, err
+		return nil, err
 	}
 	if resp.Item == nil {
-		return nil, false, nil
+		return nil, nil
 	}
 
 	expiry, err := strconv.ParseInt(aws.StringValue(resp.Item[d.ExpiryName()].N), 10, 64)
 	if err != nil {
-		return nil, false, err
+		return nil, err
 	}
 
 	if expiry < time.Now().UnixNano() {
-		return nil, false, d.Delete(token)
+		return nil, d.DeleteCtx(ctx, token)
 	}
 
-	return resp.Item[d.DataName()].B, true, nil
+	return resp.Item, nil
 }
 
 // Save adds a session token and data to the RedisStore instance with the given expiry time.
 // If the session token already exists then the data and expiry time are updated.
 func (d *DynamoStore) Save(token string, b []byte, expiry time.Time) error {
-	params := &dynamodb.PutItemInput{
+	return d.SaveCtx(context.Background(), token, b, expiry)
+}
+
+// SaveCtx is the context-aware version of Save. It also increments the version.
+func (d *DynamoStore) SaveCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	params := d.updateItemInput(token, b, expiry)
+	params.UpdateExpression = aws.String("SET #d = :d, #e = :e, #t = :t ADD #v :one")
+	params.ExpressionAttributeValues[":one"] = &dynamodb.AttributeValue{N: aws.String("1")}
+	_, err := d.DB.UpdateItemWithContext(ctx, params)
+	return err
+}
+
+// SaveIfVersion saves the data for a given session token only if its current version
+// equals version, and returns the new version. If the versions differ nothing is
+// saved and ok is false. A version of 0 saves a new session, replacing an expired one.
+func (d *DynamoStore) SaveIfVersion(ctx context.Context, token string, b []byte, expiry time.Time, version int64) (newVersion int64, ok bool, err error) {
+	params := d.updateItemInput(token, b, expiry)
+	params.UpdateExpression = aws.String("SET #d = :d, #e = :e, #t = :t, #v = :nv")
+	params.ExpressionAttributeNames["#k"] = aws.String(d.TokenName())
+	values := params.ExpressionAttributeValues
+	values[":nv"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(version+1, 10))}
+	values[":now"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(time.Now().UnixNano(), 10))}
+	if version == 0 {
+		params.ConditionExpression = aws.String("attribute_not_exists(#k) OR #e < :now")
+	} else {
+		params.ConditionExpression = aws.String("#v = :v AND #e >= :now")
+		values[":v"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(version, 10))}
+	}
+	_, err = d.DB.UpdateItemWithContext(ctx, params)
+	if aerr, isAWS := err.(awserr.Error); isAWS && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return version + 1, true, nil
+}
+
+// updateItemInput returns the UpdateItemInput shared by SaveCtx and SaveIfVersion,
+// with the data, expiry and ttl values. The version name is bound to #v.
+func (d *DynamoStore) updateItemInput(token string, b []byte, expiry time.Time) *dynamodb.UpdateItemInput {
+	return &dynamodb.UpdateItemInput{
 		TableName: aws.String(d.TableName()),
-		Item: map[string]*dynamodb.AttributeValue{
+		Key: map[string]*dynamodb.AttributeValue{
 			d.TokenName(): {
 				S: aws.String(token),
 			},
-			d.DataName(): {
+		},
+		// data and ttl are reserved words, so all names are bound to placeholders
+		ExpressionAttributeNames: map[string]*string{
+			"#d": aws.String(d.DataName()),
+			"#e": aws.String(d.ExpiryName()),
+			"#t": aws.String(d.TTLName()),
+			"#v": aws.String(d.VersionName()),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":d": {
 				B: b,
 			},
-			d.ExpiryName(): {
+			":e": {
 				N: aws.String(strconv.FormatInt(expiry.UnixNano(), 10)),
 			},
-			d.TTLName(): {
+			":t": {
 				// TTL is used by DynamoDB Time To Live. It must be Unix Epoch format.
 				// TTL cannot handle under second like milliseocnd and nanosecond, but
 				// Expiry can.
@@ -108,12 +194,15 @@ func (d *DynamoStore) Save(token string, b []byte, expiry time.Time) error {
 			},
 		},
 	}
-	_, err := d.DB.PutItem(params)
-	return err
 }
 
 // Delete removes a session token and corresponding data from the ResisStore instance.
 func (d *DynamoStore) Delete(token string) error {
+	return d.DeleteCtx(context.Background(), token)
+}
+
+// DeleteCtx is the context-aware version of Delete.
+func (d *DynamoStore) DeleteCtx(ctx context.Context, token string) error {
 	params := &dynamodb.DeleteItemInput{
 		TableName: aws.String(d.TableName()),
 		Key: map[string]*dynamodb.AttributeValue{
@@ -123,10 +212,79 @@ func (d *DynamoStore) Delete(token string) error {
 		},
 	}
 
-	_, err := d.DB.DeleteItem(params)
+	_, err := d.DB.DeleteItemWithContext(ctx, params)
+	return err
+}
+
+// Loads returns the data of all unexpired sessions. It scans the whole table.
+func (d *DynamoStore) Loads() ([][]byte, error) {
+	return d.LoadsCtx(context.Background())
+}
+
+// LoadsCtx is the context-aware version of Loads.
+func (d *DynamoStore) LoadsCtx(ctx context.Context) ([][]byte, error) {
+	params := &dynamodb.ScanInput{
+		TableName: aws.String(d.TableName()),
+	}
+	var bs [][]byte
+	now := time.Now().UnixNano()
+	err := d.DB.ScanPagesWithContext(ctx, params, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			ev, dv := item[d.ExpiryName()], item[d.DataName()]
+			if ev == nil || dv == nil {
+				continue
+			}
+			expiry, err := strconv.ParseInt(aws.StringValue(ev.N), 10, 64)
+			if err != nil || expiry < now {
+				continue
+			}
+			bs = append(bs, dv.B)
+		}
+		return true
+	})
+	return bs, err
+}
+
+// Scan calls fn for every unexpired session, one page of the table scan at a time.
+// Scan stops and returns the error if fn returns one.
+func (d *DynamoStore) Scan(ctx context.Context, fn func(token string, b []byte) error) error {
+	params := &dynamodb.ScanInput{
+		TableName: aws.String(d.TableName()),
+	}
+	now := time.Now().UnixNano()
+	var fnErr error
+	err := d.DB.ScanPagesWithContext(ctx, params, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			tv, ev, dv := item[d.TokenName()], item[d.ExpiryName()], item[d.DataName()]
+			if tv == nil || ev == nil || dv == nil {
+				continue
+			}
+			expiry, err := strconv.ParseInt(aws.StringValue(ev.N), 10, 64)
+			if err != nil || expiry < now {
+				continue
+			}
+			if fnErr = fn(aws.StringValue(tv.S), dv.B); fnErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if fnErr != nil {
+		return fnErr
+	}
 	return err
 }
 
+// Dumps is a no-op, DynamoDB persists the data itself.
+func (d *DynamoStore) Dumps() error {
+	return nil
+}
+
+// DumpsCtx is a no-op, like Dumps.
+func (d *DynamoStore) DumpsCtx(ctx context.Context) error {
+	return nil
+}
+
 // Ping checks to exisit session table in DynamoDB.
 func (d *DynamoStore) Ping() error {
 	params := &dynamodb.DescribeTableInput{
@@ -161,3 +319,8 @@ func (d *DynamoStore) ExpiryName() string {
 func (d *DynamoStore) TTLName() string {
 	return d.ttl
 }
+
+// VersionName returns session version key name.
+func (d *DynamoStore) VersionName() string {
+	return d.version
+}
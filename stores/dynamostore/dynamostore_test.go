@@ -2,6 +2,7 @@ package dynamostore
 
 import (
 	"bytes"
+	"context"
 	"reflect"
 	"testing"
 	"time"
@@ -167,3 +168,33 @@ func TestExpiry(t *testing.T) {
 		t.Fatalf("got %v: expected %v", found, false)
 	}
 }
+
+func TestSaveIfVersion(t *testing.T) {
+	dy := getTestDynamoDB(t)
+	clearTestDynamoDB(t, dy)
+
+	d := New(dy)
+	ctx := context.Background()
+	expiry := time.Now().Add(time.Minute)
+
+	version, ok, err := d.SaveIfVersion(ctx, token, []byte(data), expiry, 0)
+	if err != nil || !ok || version != 1 {
+		t.Fatalf("got %d %v %v: expected version 1", version, ok, err)
+	}
+	_, ok, err = d.SaveIfVersion(ctx, token, []byte(dataUpdated), expiry, 0)
+	if err != nil || ok {
+		t.Fatalf("got %v %v: expected a conflict", ok, err)
+	}
+	err = d.Save(token, []byte(dataUpdated), expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, version, found, err := d.FindVersion(ctx, token)
+	if err != nil || !found || version != 2 || !bytes.Equal(b, []byte(dataUpdated)) {
+		t.Fatalf("got %s %d %v %v: expected %s at version 2", b, version, found, err, dataUpdated)
+	}
+	_, ok, err = d.SaveIfVersion(ctx, token, []byte(data), expiry, 1)
+	if err != nil || ok {
+		t.Fatalf("got %v %v: expected a conflict", ok, err)
+	}
+}
@@ -0,0 +1,294 @@
+// Package encryptstore is a decorator which encrypts session data at rest for the
+// server-side stores of the SCS session package (redisstore, mysqlstore, pgstore,
+// boltstore, dynamostore, ...).
+//
+// Data is sealed with XChaCha20-Poly1305 before it is passed to the wrapped store.
+// Each value records the ID of the key it was encrypted with, so old keys can be kept
+// for decryption after a key rotation, like cookiestore.New(key, oldKeys...), and
+// Reencrypt can rewrite the values still encrypted with them:
+//
+//	store, err := encryptstore.Wrap(redisstore.New(pool),
+//		encryptstore.Key{ID: 2, Secret: newSecret},
+//		encryptstore.Key{ID: 1, Secret: oldSecret},
+//	)
+//
+// The token is kept in the value and authenticated with it, so a value copied to
+// another token can't be decrypted, and Loads can decrypt the values without knowing
+// their tokens.
+//
+// Values which were saved before the store was wrapped are plaintext. They are not
+// found by default, as anyone who can write to the wrapped store could save such a
+// value. To migrate a store holding plaintext sessions, call AllowPlaintext(true) and
+// SetDecoder, and run Reencrypt until it reports no plaintext values left; then call
+// AllowPlaintext(false).
+package encryptstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipiao/session/stores/internal/storeutil"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Store is the interface of the wrapped store, the same as session.Store.
+type Store = storeutil.Store
+
+// Key is an encryption key. Secret must be 32 bytes long; ID identifies the key in
+// the encrypted values and must be unique.
+type Key struct {
+	ID     uint32
+	Secret []byte
+}
+
+// Decoder returns the token and expiry of the session data b, see
+// session.DecodeTokenExpiry. Only the expiry is used.
+type Decoder func(b []byte) (token string, expiry time.Time, err error)
+
+// magic starts every encrypted value. It can't start a JSON, gob or msgpack
+// encoded session.
+var magic = []byte{0xff, 'S', 'C', 'E'}
+
+const (
+	// headerSize is the size of magic, the key ID, the expiry and the size of the
+	// token. The header and the token which follows it are authenticated as
+	// additional data.
+	headerSize = 4 + 4 + 8 + 2
+	overhead   = headerSize + chacha20poly1305.NonceSizeX + chacha20poly1305.Overhead
+)
+
+var (
+	errNoKeys         = errors.New("encryptstore: at least one key is required")
+	errUnknownKey     = errors.New("encryptstore: value is encrypted with an unknown key")
+	errInvalidValue   = errors.New("encryptstore: value can't be decrypted")
+	errNotEncrypted   = errors.New("encryptstore: value is not encrypted")
+	errDuplicateKeyID = errors.New("encryptstore: duplicate key ID")
+	errTokenTooLong   = errors.New("encryptstore: token is too long")
+)
+
+type key struct {
+	id   uint32
+	aead cipher.AEAD
+}
+
+// EncryptStore encrypts the data saved to the wrapped store. The read methods return
+// the decrypted data; values which can't be decrypted are reported as not found, like
+// an invalid cookiestore token, and so are plaintext values unless AllowPlaintext.
+type EncryptStore struct {
+	storeutil.Transform
+	store     Store
+	keys      []key
+	decode    Decoder
+	plaintext atomic.Bool
+}
+
+// Wrap returns an EncryptStore which encrypts the data saved to store with the first
+// key. The other keys are only used to decrypt data saved before a key rotation.
+func Wrap(store Store, keys ...Key) (*EncryptStore, error) {
+	if len(keys) == 0 {
+		return nil, errNoKeys
+	}
+	e := &EncryptStore{store: store}
+	e.Transform = storeutil.NewTransform(store, e.encrypt, e.open)
+	for _, k := range keys {
+		if _, err := e.key(k.ID); err == nil {
+			return nil, fmt.Errorf("%w %d", errDuplicateKeyID, k.ID)
+		}
+		aead, err := chacha20poly1305.NewX(k.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("encryptstore: key %d: %w", k.ID, err)
+		}
+		e.keys = append(e.keys, key{id: k.ID, aead: aead})
+	}
+	return e, nil
+}
+
+// AllowPlaintext makes the read methods return the plaintext values saved before the
+// store was wrapped as they are. It is meant for the migration of a store, until
+// Reencrypt reports no plaintext values left; the plaintext values are not
+// authenticated. It can be called while the store is used.
+func (e *EncryptStore) AllowPlaintext(allow bool) {
+	e.plaintext.Store(allow)
+}
+
+// SetDecoder makes Reencrypt encrypt the plaintext values saved before the store was
+// wrapped too, while AllowPlaintext. The expiry of a plaintext value is only known
+// from the session data, so decode must read the codec of the session manager.
+func (e *EncryptStore) SetDecoder(decode Decoder) {
+	e.decode = decode
+}
+
+// key returns the key with id.
+func (e *EncryptStore) key(id uint32) (key, error) {
+	for _, k := range e.keys {
+		if k.id == id {
+			return k, nil
+		}
+	}
+	return key{}, errUnknownKey
+}
+
+// encrypt seals b of token with the current key. The expiry is kept in the clear, so
+// that Reencrypt can save the value again without decoding the session, and so is
+// the token.
+func (e *EncryptStore) encrypt(token string, b []byte, expiry time.Time) ([]byte, error) {
+	if len(token) > math.MaxUint16 {
+		return nil, errTokenTooLong
+	}
+	k := e.keys[0]
+	n := headerSize + len(token)
+	out := make([]byte, n+chacha20poly1305.NonceSizeX, overhead+len(token)+len(b))
+	copy(out, magic)
+	binary.BigEndian.PutUint32(out[4:], k.id)
+	binary.BigEndian.PutUint64(out[8:], uint64(expiry.UnixNano()))
+	binary.BigEndian.PutUint16(out[16:], uint16(len(token)))
+	copy(out[headerSize:], token)
+	nonce := out[n:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return k.aead.Seal(out, nonce, b, out[:n]), nil
+}
+
+// decrypt opens a value of token sealed by encrypt and returns the ID of its key. An
+// empty token accepts the token kept in the value, for Loads. A value without the
+// magic prefix is returned as is, with errNotEncrypted.
+func (e *EncryptStore) decrypt(token string, v []byte) (b []byte, id uint32, expiry time.Time, err error) {
+	if !bytes.HasPrefix(v, magic) {
+		return v, 0, time.Time{}, errNotEncrypted
+	}
+	if len(v) < overhead {
+		return nil, 0, time.Time{}, errInvalidValue
+	}
+	id = binary.BigEndian.Uint32(v[4:])
+	expiry = time.Unix(0, int64(binary.BigEndian.Uint64(v[8:])))
+	n := headerSize + int(binary.BigEndian.Uint16(v[16:]))
+	if len(v) < overhead+n-headerSize {
+		return nil, id, expiry, errInvalidValue
+	}
+	if token != "" && string(v[headerSize:n]) != token {
+		return nil, id, expiry, errInvalidValue
+	}
+	k, err := e.key(id)
+	if err != nil {
+		return nil, id, expiry, err
+	}
+	nonce := v[n : n+chacha20poly1305.NonceSizeX]
+	b, err = k.aead.Open(nil, nonce, v[n+chacha20poly1305.NonceSizeX:], v[:n])
+	if err != nil {
+		return nil, id, expiry, errInvalidValue
+	}
+	return b, id, expiry, nil
+}
+
+// open decrypts v for the read methods. Plaintext values are only accepted while
+// AllowPlaintext.
+func (e *EncryptStore) open(token string, v []byte) ([]byte, bool) {
+	b, _, _, err := e.decrypt(token, v)
+	if err == errNotEncrypted {
+		return b, e.plaintext.Load()
+	}
+	return b, err == nil
+}
+
+// Reencrypt rewrites with the current key the values encrypted with an old key, so
+// that the old key can be removed, and the plaintext values while AllowPlaintext if
+// SetDecoder was called. It needs a wrapped store which implements Scan, and returns
+// the number of values rewritten and the number of plaintext values left; once no
+// plaintext value is left, AllowPlaintext can be switched off. Run it in a goroutine
+// after adding a new key; it stops when ctx is done.
+//
+// If the wrapped store supports FindVersion and SaveIfVersion, a value saved by a
+// request while it is rewritten is left alone. Otherwise a request may rarely lose
+// a write made at the same time as the rewrite of its session.
+func (e *EncryptStore) Reencrypt(ctx context.Context) (n, plaintext int, err error) {
+	sc, ok := e.store.(storeutil.Scanner)
+	if !ok {
+		return 0, 0, storeutil.Unsupported(e.store, "Scan")
+	}
+	// the tokens are collected first, writing while scanning may skip or repeat keys
+	var tokens []string
+	err = sc.Scan(ctx, func(token string, v []byte) error {
+		if e.stale(token, v) {
+			tokens = append(tokens, token)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, token := range tokens {
+		if err = ctx.Err(); err != nil {
+			return n, plaintext, err
+		}
+		ok, left, err := e.reencrypt(ctx, token)
+		if err != nil {
+			return n, plaintext, err
+		}
+		if ok {
+			n++
+		}
+		if left {
+			plaintext++
+		}
+	}
+	return n, plaintext, nil
+}
+
+// reencrypt rewrites the value of token with the current key. left reports a
+// plaintext value which can't be rewritten.
+func (e *EncryptStore) reencrypt(ctx context.Context, token string) (ok, left bool, err error) {
+	cs, cas := e.store.(storeutil.CASStore)
+	var v []byte
+	var version int64
+	var found bool
+	if cas {
+		v, version, found, err = cs.FindVersion(ctx, token)
+	} else {
+		v, found, err = storeutil.WithContext(e.store).FindCtx(ctx, token)
+	}
+	if err != nil || !found {
+		return false, false, err
+	}
+	b, id, expiry, err := e.decrypt(token, v)
+	switch {
+	case err == errNotEncrypted:
+		if e.decode == nil || !e.plaintext.Load() {
+			return false, true, nil
+		}
+		if _, expiry, err = e.decode(b); err != nil {
+			return false, true, nil
+		}
+		if !time.Now().Before(expiry) {
+			return false, false, nil
+		}
+	case err != nil || id == e.keys[0].id:
+		// undecryptable or already rewritten by a request
+		return false, false, nil
+	}
+	nv, err := e.encrypt(token, b, expiry)
+	if err != nil {
+		return false, false, err
+	}
+	if cas {
+		_, ok, err = cs.SaveIfVersion(ctx, token, nv, expiry, version)
+		return ok, false, err
+	}
+	return true, false, storeutil.WithContext(e.store).SaveCtx(ctx, token, nv, expiry)
+}
+
+// stale reports whether the value of token must be looked at by Reencrypt: it is
+// encrypted with an old key, or it is plaintext.
+func (e *EncryptStore) stale(token string, v []byte) bool {
+	_, id, _, err := e.decrypt(token, v)
+	return err == errNotEncrypted || err == nil && id != e.keys[0].id
+}
@@ -0,0 +1,222 @@
+package encryptstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ipiao/session/stores/internal/storetest"
+	"github.com/ipiao/session/stores/memstore"
+)
+
+var (
+	key1 = Key{ID: 1, Secret: bytes.Repeat([]byte("1"), 32)}
+	key2 = Key{ID: 2, Secret: bytes.Repeat([]byte("2"), 32)}
+)
+
+func TestWrap(t *testing.T) {
+	if _, err := Wrap(memstore.New(0)); err != errNoKeys {
+		t.Fatalf("got %v: expected %v", err, errNoKeys)
+	}
+	if _, err := Wrap(memstore.New(0), Key{ID: 1, Secret: []byte("short")}); err == nil {
+		t.Fatal("expected an error for a short key")
+	}
+	if _, err := Wrap(memstore.New(0), key1, key1); !errors.Is(err, errDuplicateKeyID) {
+		t.Fatalf("got %v: expected %v", err, errDuplicateKeyID)
+	}
+}
+
+func TestSaveFind(t *testing.T) {
+	inner := storetest.NewBuntStore(t)
+	e, err := Wrap(inner, key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = e.Save("session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, _, _ := inner.Find("session_token")
+	if bytes.Contains(v, []byte("encoded_data")) {
+		t.Fatal("expected the data to be encrypted in the wrapped store")
+	}
+	b, found, err := e.Find("session_token")
+	if err != nil || !found || !bytes.Equal(b, []byte("encoded_data")) {
+		t.Fatalf("got %s %v %v: expected encoded_data", b, found, err)
+	}
+
+	// 篡改的数据按不存在处理
+	v[len(v)-1] ^= 1
+	inner.Save("session_token", v, time.Now().Add(time.Minute))
+	if _, found, err = e.Find("session_token"); err != nil || found {
+		t.Fatalf("got %v %v: expected a tampered value not to be found", found, err)
+	}
+
+	// 复制到其它token的数据无法解密
+	e.Save("session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	v, _, _ = inner.Find("session_token")
+	inner.Save("other_token", v, time.Now().Add(time.Minute))
+	if _, found, err = e.Find("other_token"); err != nil || found {
+		t.Fatalf("got %v %v: expected a value moved to another token not to be found", found, err)
+	}
+
+	// 包装之前保存的明文数据，默认不接受
+	inner.Save("plain_token", []byte("plain_data"), time.Now().Add(time.Minute))
+	if _, found, _ = e.Find("plain_token"); found {
+		t.Fatal("expected the plaintext value not to be found")
+	}
+	e.AllowPlaintext(true)
+	if b, found, _ = e.Find("plain_token"); !found || !bytes.Equal(b, []byte("plain_data")) {
+		t.Fatalf("got %s %v: expected the plaintext value", b, found)
+	}
+}
+
+func TestLoads(t *testing.T) {
+	// 隐藏memstore的Scan，只能通过Loads读取
+	inner := memstore.New(0)
+	inner.SetDumpFile(filepath.Join(t.TempDir(), "dump"))
+	e, _ := Wrap(struct{ Store }{inner}, key1)
+	e.Save("a", []byte("data_a"), time.Now().Add(time.Minute))
+	inner.Save("plain_token", []byte("plain_data"), time.Now().Add(time.Minute))
+	if err := inner.Dumps(); err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := e.Loads()
+	if err != nil || len(bs) != 1 || !bytes.Equal(bs[0], []byte("data_a")) {
+		t.Fatalf("got %s %v: expected the decrypted data without the plaintext value", bs, err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	inner := storetest.NewBuntStore(t)
+	old, _ := Wrap(inner, key1)
+	for _, token := range []string{"a", "b", "c"} {
+		if err := old.Save(token, []byte("data_"+token), time.Now().Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e, _ := Wrap(inner, key2, key1)
+	if b, found, _ := e.Find("a"); !found || !bytes.Equal(b, []byte("data_a")) {
+		t.Fatalf("got %s %v: expected the old key to decrypt", b, found)
+	}
+	if err := e.Save("b", []byte("new_b"), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	n, _, err := e.Reencrypt(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("got %d: expected the 2 values still encrypted with the old key", n)
+	}
+
+	// 移除旧的key之后仍然可以读取
+	e, _ = Wrap(inner, key2)
+	for token, data := range map[string]string{"a": "data_a", "b": "new_b", "c": "data_c"} {
+		b, found, err := e.Find(token)
+		if err != nil || !found || string(b) != data {
+			t.Fatalf("got %s %v %v: expected %s", b, found, err, data)
+		}
+	}
+	if _, found, _ := old.Find("a"); found {
+		t.Fatal("expected the removed key not to decrypt the new values")
+	}
+}
+
+func TestReencryptPlaintext(t *testing.T) {
+	inner := storetest.NewBuntStore(t)
+	expiry := time.Now().Add(time.Minute).Round(0)
+	inner.Save("a", []byte("plain_a"), expiry)
+	e, _ := Wrap(inner, key1)
+
+	// 没有Decoder时不知道明文数据的过期时间
+	e.AllowPlaintext(true)
+	if n, left, err := e.Reencrypt(context.Background()); err != nil || n != 0 || left != 1 {
+		t.Fatalf("got %d %d %v: expected the plaintext value to be left alone", n, left, err)
+	}
+
+	// 不接受明文数据时不加密明文数据
+	e.SetDecoder(func(b []byte) (string, time.Time, error) {
+		return "", expiry, nil
+	})
+	e.AllowPlaintext(false)
+	if n, left, err := e.Reencrypt(context.Background()); err != nil || n != 0 || left != 1 {
+		t.Fatalf("got %d %d %v: expected the plaintext value to be left alone", n, left, err)
+	}
+
+	e.AllowPlaintext(true)
+	n, left, err := e.Reencrypt(context.Background())
+	if err != nil || n != 1 || left != 0 {
+		t.Fatalf("got %d %d %v: expected the plaintext value to be encrypted", n, left, err)
+	}
+	v, _, _ := inner.Find("a")
+	if bytes.Contains(v, []byte("plain_a")) {
+		t.Fatal("expected the data to be encrypted in the wrapped store")
+	}
+	b, id, exp, err := e.decrypt("a", v)
+	if err != nil || id != key1.ID || !exp.Equal(expiry) || !bytes.Equal(b, []byte("plain_a")) {
+		t.Fatalf("got %s %d %v %v: expected plain_a with key 1 and the decoded expiry", b, id, exp, err)
+	}
+}
+
+func TestCAS(t *testing.T) {
+	e, _ := Wrap(storetest.NewBuntStore(t), key1)
+	ctx := context.Background()
+	expiry := time.Now().Add(time.Minute)
+
+	version, ok, err := e.SaveIfVersion(ctx, "session_token", []byte("v1"), expiry, 0)
+	if err != nil || !ok || version != 1 {
+		t.Fatalf("got %d %v %v: expected version 1", version, ok, err)
+	}
+	b, version, found, err := e.FindVersion(ctx, "session_token")
+	if err != nil || !found || version != 1 || !bytes.Equal(b, []byte("v1")) {
+		t.Fatalf("got %s %d %v %v: expected v1 at version 1", b, version, found, err)
+	}
+}
+
+func TestQueryAndScan(t *testing.T) {
+	e, _ := Wrap(storetest.NewBuntStore(t), key1)
+	now := time.Now()
+	e.Save("a", []byte("data_a"), now.Add(time.Minute))
+	e.Save("b", []byte("data_b"), now.Add(time.Hour))
+
+	tokens, bs, err := e.QuerySessions(context.Background(), time.Time{}, time.Time{}, nil, 0, 0, func(token string, b []byte) bool {
+		return bytes.Equal(b, []byte("data_b"))
+	})
+	if err != nil || len(tokens) != 1 || tokens[0] != "b" || !bytes.Equal(bs[0], []byte("data_b")) {
+		t.Fatalf("got %v %s %v: expected the match to see decrypted data", tokens, bs, err)
+	}
+
+	var n int
+	err = e.Scan(context.Background(), func(token string, b []byte) error {
+		if !bytes.Equal(b, []byte("data_"+token)) {
+			t.Fatalf("got %s: expected the decrypted data of %s", b, token)
+		}
+		n++
+		return nil
+	})
+	if err != nil || n != 2 {
+		t.Fatalf("got %d %v: expected 2 sessions", n, err)
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	// 隐藏memstore的Scan
+	e, _ := Wrap(struct{ Store }{memstore.New(0)}, key1)
+	ctx := context.Background()
+	if err := e.Scan(ctx, nil); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("got %v: expected %v", err, errors.ErrUnsupported)
+	}
+	if _, _, _, err := e.FindVersion(ctx, "token"); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("got %v: expected %v", err, errors.ErrUnsupported)
+	}
+	if _, _, err := e.Reencrypt(ctx); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("got %v: expected %v", err, errors.ErrUnsupported)
+	}
+}
@@ -0,0 +1,21 @@
+// Package storetest provides the fixtures shared by the tests of the stores.
+package storetest
+
+import (
+	"testing"
+
+	"github.com/tidwall/buntdb"
+
+	"github.com/ipiao/session/stores/buntstore"
+)
+
+// NewBuntStore returns a buntstore on an in-memory database, which is closed when the
+// test finishes. It implements Scanner, QueryableStore and CASStore.
+func NewBuntStore(t testing.TB) *buntstore.BuntStore {
+	db, err := buntdb.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return buntstore.New(db)
+}
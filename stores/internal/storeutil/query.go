@@ -0,0 +1,103 @@
+package storeutil
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"reflect"
+	"sort"
+)
+
+// MatchKeys returns a match func for the stores which can't filter the session data
+// in the database. It checks that the data b, encoded by session.JSONCodec, has the
+// keys of keyEquals with their JSON encoded values, then calls match if not nil. It
+// returns nil if keyEquals is empty and match is nil.
+func MatchKeys(keyEquals map[string]string, match func(token string, b []byte) bool) func(token string, b []byte) bool {
+	if len(keyEquals) == 0 {
+		return match
+	}
+	return func(token string, b []byte) bool {
+		return KeysEqual(b, keyEquals) && (match == nil || match(token, b))
+	}
+}
+
+// KeysEqual reports whether the data b, encoded by session.JSONCodec as
+// {"data":{...}}, has the keys of keyEquals with their JSON encoded values.
+func KeysEqual(b []byte, keyEquals map[string]string) bool {
+	var v struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if json.Unmarshal(b, &v) != nil {
+		return false
+	}
+	for key, want := range keyEquals {
+		got, ok := v.Data[key]
+		if !ok || !jsonEqual(got, []byte(want)) {
+			return false
+		}
+	}
+	return true
+}
+
+// jsonEqual compares two JSON values, numbers by value like the databases do.
+func jsonEqual(a, b []byte) bool {
+	if bytes.Equal(a, b) {
+		return true
+	}
+	var x, y interface{}
+	return json.Unmarshal(a, &x) == nil && json.Unmarshal(b, &y) == nil && reflect.DeepEqual(x, y)
+}
+
+// SortedKeys returns the keys of keyEquals in order, so that the SQL statements built
+// from them are the same for the same query.
+func SortedKeys(keyEquals map[string]string) []string {
+	keys := make([]string, 0, len(keyEquals))
+	for key := range keyEquals {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Collect reads the token and data columns of rows, filtering them by match and
+// applying offset and limit (0 means no limit) after the filter, and closes rows.
+func Collect(rows *sql.Rows, offset, limit int, match func(token string, b []byte) bool) (tokens []string, bs [][]byte, err error) {
+	defer rows.Close()
+	for rows.Next() {
+		var token string
+		var b []byte
+		if err = rows.Scan(&token, &b); err != nil {
+			return nil, nil, err
+		}
+		if match != nil && !match(token, b) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		tokens = append(tokens, token)
+		bs = append(bs, b)
+		if limit > 0 && len(bs) >= limit {
+			break
+		}
+	}
+	return tokens, bs, rows.Err()
+}
+
+// ScanRows calls fn for each token and data row, stopping at the first error
+// returned by fn, and closes rows.
+func ScanRows(rows *sql.Rows, fn func(token string, b []byte) error) error {
+	defer rows.Close()
+	for rows.Next() {
+		var token string
+		var b []byte
+		if err := rows.Scan(&token, &b); err != nil {
+			return err
+		}
+		if err := fn(token, b); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
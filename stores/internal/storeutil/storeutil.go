@@ -0,0 +1,117 @@
+// Package storeutil contains the store interfaces and helpers shared by the store
+// packages, most of all by the store decorators (encryptstore, compressstore, ...).
+// Store packages don't import the session package, so the interfaces are repeated
+// here with the same method sets.
+//
+// A decorator implements every optional interface. If the wrapped store doesn't
+// support one, the method returns an error wrapping errors.ErrUnsupported, and the
+// session package falls back as if the decorator didn't implement it.
+package storeutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Store is the same as session.Store.
+type Store interface {
+	Save(token string, b []byte, expiry time.Time) error
+	Delete(token string) error
+	Find(token string) (b []byte, found bool, err error)
+	Dumps() error
+	Loads() ([][]byte, error)
+}
+
+// StoreContext is the same as session.StoreContext.
+type StoreContext interface {
+	SaveCtx(ctx context.Context, token string, b []byte, expiry time.Time) error
+	DeleteCtx(ctx context.Context, token string) error
+	FindCtx(ctx context.Context, token string) (b []byte, found bool, err error)
+	DumpsCtx(ctx context.Context) error
+	LoadsCtx(ctx context.Context) ([][]byte, error)
+}
+
+// Scanner is the same as session.Scanner.
+type Scanner interface {
+	Scan(ctx context.Context, fn func(token string, b []byte) error) error
+}
+
+// QueryableStore is the same as session.QueryableStore.
+type QueryableStore interface {
+	QuerySessions(ctx context.Context, expiryFrom, expiryTo time.Time, keyEquals map[string]string, offset, limit int, match func(token string, b []byte) bool) (tokens []string, bs [][]byte, err error)
+}
+
+// CASStore is the same as session.CASStore.
+type CASStore interface {
+	FindVersion(ctx context.Context, token string) (b []byte, version int64, found bool, err error)
+	SaveIfVersion(ctx context.Context, token string, b []byte, expiry time.Time, version int64) (newVersion int64, ok bool, err error)
+}
+
+// Unsupported returns an error wrapping errors.ErrUnsupported for the method of store.
+func Unsupported(store Store, method string) error {
+	return fmt.Errorf("%T does not support %s: %w", store, method, errors.ErrUnsupported)
+}
+
+// WithContext returns store as a StoreContext. If store doesn't implement it, the
+// returned shim only checks ctx before each call, like session.WithContext.
+func WithContext(store Store) StoreContext {
+	if sc, ok := store.(StoreContext); ok {
+		return sc
+	}
+	return contextShim{store}
+}
+
+type contextShim struct {
+	Store
+}
+
+func (c contextShim) SaveCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Save(token, b, expiry)
+}
+
+func (c contextShim) DeleteCtx(ctx context.Context, token string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Delete(token)
+}
+
+func (c contextShim) FindCtx(ctx context.Context, token string) ([]byte, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	return c.Find(token)
+}
+
+func (c contextShim) DumpsCtx(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Dumps()
+}
+
+func (c contextShim) LoadsCtx(ctx context.Context) ([][]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Loads()
+}
+
+// Close releases store the way Manager.Shutdown does: it stops the cleanup goroutine
+// if store has one, otherwise it closes store if it is an io.Closer.
+func Close(store Store) error {
+	if sc, ok := store.(interface{ StopCleanup() }); ok {
+		sc.StopCleanup()
+		return nil
+	}
+	if c, ok := store.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
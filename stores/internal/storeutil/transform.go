@@ -0,0 +1,178 @@
+package storeutil
+
+import (
+	"context"
+	"time"
+)
+
+// Transform is the base of the decorators which change the data on its way to the
+// wrapped store, such as encryptstore and compressstore. It implements Store,
+// StoreContext and the optional interfaces with an encode func applied to the data
+// before it is saved and a decode func applied to the values read. Values which
+// decode rejects are treated as not found.
+type Transform struct {
+	store  Store
+	encode func(token string, b []byte, expiry time.Time) ([]byte, error)
+	decode func(token string, v []byte) ([]byte, bool)
+}
+
+// NewTransform returns a Transform which saves to store the data encoded by encode,
+// and reads the values decoded by decode.
+func NewTransform(store Store, encode func(token string, b []byte, expiry time.Time) ([]byte, error), decode func(token string, v []byte) ([]byte, bool)) Transform {
+	return Transform{store: store, encode: encode, decode: decode}
+}
+
+// Find returns the decoded data for a session token.
+func (t Transform) Find(token string) ([]byte, bool, error) {
+	return t.FindCtx(context.Background(), token)
+}
+
+// FindCtx is the context-aware version of Find.
+func (t Transform) FindCtx(ctx context.Context, token string) ([]byte, bool, error) {
+	v, found, err := WithContext(t.store).FindCtx(ctx, token)
+	if err != nil || !found {
+		return nil, false, err
+	}
+	b, ok := t.decode(token, v)
+	return b, ok, nil
+}
+
+// Save encodes the data and saves it to the wrapped store.
+func (t Transform) Save(token string, b []byte, expiry time.Time) error {
+	return t.SaveCtx(context.Background(), token, b, expiry)
+}
+
+// SaveCtx is the context-aware version of Save.
+func (t Transform) SaveCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	v, err := t.encode(token, b, expiry)
+	if err != nil {
+		return err
+	}
+	return WithContext(t.store).SaveCtx(ctx, token, v, expiry)
+}
+
+// Delete removes a session token from the wrapped store.
+func (t Transform) Delete(token string) error {
+	return t.store.Delete(token)
+}
+
+// DeleteCtx is the context-aware version of Delete.
+func (t Transform) DeleteCtx(ctx context.Context, token string) error {
+	return WithContext(t.store).DeleteCtx(ctx, token)
+}
+
+// Dumps calls Dumps of the wrapped store.
+func (t Transform) Dumps() error {
+	return t.store.Dumps()
+}
+
+// DumpsCtx is the context-aware version of Dumps.
+func (t Transform) DumpsCtx(ctx context.Context) error {
+	return WithContext(t.store).DumpsCtx(ctx)
+}
+
+// Loads returns the decoded data of all sessions. Values which can't be decoded are
+// skipped. Loads of the wrapped store doesn't return the tokens, so the values are
+// decoded with an empty token.
+func (t Transform) Loads() ([][]byte, error) {
+	return t.LoadsCtx(context.Background())
+}
+
+// LoadsCtx is the context-aware version of Loads.
+func (t Transform) LoadsCtx(ctx context.Context) ([][]byte, error) {
+	vs, err := WithContext(t.store).LoadsCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	bs := make([][]byte, 0, len(vs))
+	for _, v := range vs {
+		if b, ok := t.decode("", v); ok {
+			bs = append(bs, b)
+		}
+	}
+	return bs, nil
+}
+
+// Scan calls fn with the decoded data of every session of the wrapped store. Values
+// which can't be decoded are skipped.
+func (t Transform) Scan(ctx context.Context, fn func(token string, b []byte) error) error {
+	sc, ok := t.store.(Scanner)
+	if !ok {
+		return Unsupported(t.store, "Scan")
+	}
+	return sc.Scan(ctx, func(token string, v []byte) error {
+		b, ok := t.decode(token, v)
+		if !ok {
+			return nil
+		}
+		return fn(token, b)
+	})
+}
+
+// QuerySessions runs the query on the wrapped store, keyEquals, match and the returned
+// data see the decoded data.
+func (t Transform) QuerySessions(ctx context.Context, expiryFrom, expiryTo time.Time, keyEquals map[string]string, offset, limit int, match func(token string, b []byte) bool) ([]string, [][]byte, error) {
+	qs, ok := t.store.(QueryableStore)
+	if !ok {
+		return nil, nil, Unsupported(t.store, "QuerySessions")
+	}
+	// the wrapped store can't check keyEquals on the encoded data
+	match = MatchKeys(keyEquals, match)
+	// without match the wrapped store can apply offset and limit itself
+	var m func(token string, v []byte) bool
+	if match != nil {
+		m = func(token string, v []byte) bool {
+			b, ok := t.decode(token, v)
+			return ok && match(token, b)
+		}
+	}
+	tokens, vs, err := qs.QuerySessions(ctx, expiryFrom, expiryTo, nil, offset, limit, m)
+	if err != nil {
+		return nil, nil, err
+	}
+	var ts []string
+	var bs [][]byte
+	for i, v := range vs {
+		if b, ok := t.decode(tokens[i], v); ok {
+			ts = append(ts, tokens[i])
+			bs = append(bs, b)
+		}
+	}
+	return ts, bs, nil
+}
+
+// FindVersion returns the decoded data and version for a session token.
+func (t Transform) FindVersion(ctx context.Context, token string) ([]byte, int64, bool, error) {
+	cs, ok := t.store.(CASStore)
+	if !ok {
+		return nil, 0, false, Unsupported(t.store, "FindVersion")
+	}
+	v, version, found, err := cs.FindVersion(ctx, token)
+	if err != nil || !found {
+		return nil, 0, false, err
+	}
+	b, ok := t.decode(token, v)
+	if !ok {
+		return nil, 0, false, nil
+	}
+	return b, version, true, nil
+}
+
+// SaveIfVersion encodes the data and saves it if the version of the session token in
+// the wrapped store equals version.
+func (t Transform) SaveIfVersion(ctx context.Context, token string, b []byte, expiry time.Time, version int64) (int64, bool, error) {
+	cs, ok := t.store.(CASStore)
+	if !ok {
+		return 0, false, Unsupported(t.store, "SaveIfVersion")
+	}
+	v, err := t.encode(token, b, expiry)
+	if err != nil {
+		return 0, false, err
+	}
+	return cs.SaveIfVersion(ctx, token, v, expiry, version)
+}
+
+// Close stops the cleanup goroutine of the wrapped store, or closes it.
+func (t Transform) Close() error {
+	return Close(t.store)
+}
@@ -14,11 +14,15 @@
 package memstore
 
 import (
+	"context"
 	"errors"
 	"os"
+	"sort"
 	"time"
 
 	"github.com/patrickmn/go-cache"
+
+	"github.com/ipiao/session/stores/internal/storeutil"
 )
 
 var errTypeAssertionFailed = errors.New("type assertion failed: could not convert interface{} to []byte")
@@ -102,6 +106,30 @@ func (m *MemStore) Loads() (bs [][]byte, err error) {
 	return
 }
 
+// Scan calls fn for each unexpired session, stopping at the first error returned by
+// fn. Like Loads, it restores the sessions in the dump file first, if one is set.
+func (m *MemStore) Scan(ctx context.Context, fn func(token string, b []byte) error) error {
+	if m.dumpfile != "" {
+		err := m.cache.LoadFile(m.dumpfile)
+		if _, ok := err.(*os.PathError); err != nil && !ok {
+			return err
+		}
+	}
+	for token, item := range m.cache.Items() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		b, ok := item.Object.([]byte)
+		if ok == false {
+			continue
+		}
+		if err := fn(token, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Dumps 数据存储
 func (m *MemStore) Dumps() (err error) {
 	if m.dumpfile == "" {
@@ -109,3 +137,102 @@ func (m *MemStore) Dumps() (err error) {
 	}
 	return m.cache.SaveFile(m.dumpfile)
 }
+
+// FindCtx is the context-aware version of Find. The in-memory lookup can't block,
+// so ctx is only checked before the lookup is made.
+func (m *MemStore) FindCtx(ctx context.Context, token string) ([]byte, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	return m.Find(token)
+}
+
+// SaveCtx is the context-aware version of Save.
+func (m *MemStore) SaveCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.Save(token, b, expiry)
+}
+
+// DeleteCtx is the context-aware version of Delete.
+func (m *MemStore) DeleteCtx(ctx context.Context, token string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.Delete(token)
+}
+
+// LoadsCtx is the context-aware version of Loads.
+func (m *MemStore) LoadsCtx(ctx context.Context) ([][]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m.Loads()
+}
+
+// DumpsCtx is the context-aware version of Dumps.
+func (m *MemStore) DumpsCtx(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.Dumps()
+}
+
+// QuerySessions returns the unexpired sessions whose expiry time is in [expiryFrom, expiryTo),
+// ordered by expiry time. A zero expiryFrom or expiryTo means no bound. keyEquals holds
+// keys of the session data with their JSON encoded values, which are checked on the data
+// encoded by session.JSONCodec. They and the match func, if not nil, filter the sessions
+// before offset and limit (0 means no limit) are applied.
+func (m *MemStore) QuerySessions(ctx context.Context, expiryFrom, expiryTo time.Time, keyEquals map[string]string, offset, limit int, match func(token string, b []byte) bool) (tokens []string, bs [][]byte, err error) {
+	match = storeutil.MatchKeys(keyEquals, match)
+	type entry struct {
+		token  string
+		b      []byte
+		expiry int64
+	}
+	var entries []entry
+	for token, item := range m.cache.Items() {
+		b, ok := item.Object.([]byte)
+		if ok == false {
+			continue
+		}
+		if item.Expiration > 0 {
+			if !expiryFrom.IsZero() && item.Expiration < expiryFrom.UnixNano() {
+				continue
+			}
+			if !expiryTo.IsZero() && item.Expiration >= expiryTo.UnixNano() {
+				continue
+			}
+		} else if !expiryTo.IsZero() {
+			// never expires
+			continue
+		}
+		entries = append(entries, entry{token, b, item.Expiration})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].expiry == 0 || entries[j].expiry == 0 {
+			return entries[j].expiry == 0 && entries[i].expiry != 0
+		}
+		return entries[i].expiry < entries[j].expiry
+	})
+
+	for _, e := range entries {
+		if err = ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		if match != nil && !match(e.token, e.b) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		tokens = append(tokens, e.token)
+		bs = append(bs, e.b)
+		if limit > 0 && len(bs) >= limit {
+			break
+		}
+	}
+	return tokens, bs, nil
+}
@@ -2,6 +2,8 @@ package memstore
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"reflect"
 	"testing"
 	"time"
@@ -124,3 +126,82 @@ func TestDelete(t *testing.T) {
 		t.Fatalf("got %v: expected %v", found, false)
 	}
 }
+
+func TestFindCtxCancelled(t *testing.T) {
+	m := New(time.Minute)
+	m.cache.Set("session_token", []byte("encoded_data"), 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err := m.FindCtx(ctx, "session_token")
+	if err != context.Canceled {
+		t.Fatalf("got %v: expected %v", err, context.Canceled)
+	}
+	err = m.SaveCtx(ctx, "session_token", []byte("new_encoded_data"), time.Now().Add(time.Minute))
+	if err != context.Canceled {
+		t.Fatalf("got %v: expected %v", err, context.Canceled)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	m := New(time.Minute)
+	now := time.Now()
+	m.Save("token_3", []byte("data_3"), now.Add(3*time.Minute))
+	m.Save("token_1", []byte("data_1"), now.Add(time.Minute))
+	m.Save("token_2", []byte("data_2"), now.Add(2*time.Minute))
+	m.Save("token_4", []byte("data_4"), now.Add(4*time.Minute))
+
+	tokens, bs, err := m.QuerySessions(context.Background(), now.Add(90*time.Second), time.Time{}, nil, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tokens, []string{"token_2", "token_3", "token_4"}) {
+		t.Fatalf("got %v: expected %v", tokens, []string{"token_2", "token_3", "token_4"})
+	}
+	if string(bs[0]) != "data_2" {
+		t.Fatalf("got %s: expected %s", bs[0], "data_2")
+	}
+
+	match := func(token string, b []byte) bool {
+		return token != "token_2"
+	}
+	tokens, _, err = m.QuerySessions(context.Background(), time.Time{}, now.Add(4*time.Minute), nil, 1, 1, match)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tokens, []string{"token_3"}) {
+		t.Fatalf("got %v: expected %v", tokens, []string{"token_3"})
+	}
+}
+
+func TestScan(t *testing.T) {
+	m := New(time.Minute)
+	m.Save("token_1", []byte("data_1"), time.Now().Add(time.Minute))
+	m.Save("token_2", []byte("data_2"), time.Now().Add(time.Minute))
+	m.Save("token_3", []byte("data_3"), time.Now().Add(time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+
+	got := make(map[string]string)
+	err := m.Scan(context.Background(), func(token string, b []byte) error {
+		got[token] = string(b)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"token_1": "data_1", "token_2": "data_2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v: expected %v", got, want)
+	}
+
+	errStop := errors.New("stop")
+	n := 0
+	err = m.Scan(context.Background(), func(token string, b []byte) error {
+		n++
+		return errStop
+	})
+	if err != errStop || n != 1 {
+		t.Fatalf("got %v after %d calls: expected %v after 1", err, n, errStop)
+	}
+}
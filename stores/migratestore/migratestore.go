@@ -0,0 +1,404 @@
+// Package migratestore moves the sessions of the SCS session package from one store
+// to another without logging users out, for example from memstore with a dump file to
+// redisstore:
+//
+//	store, err := migratestore.New(old, redisstore.New(pool), migratestore.Config{
+//		Decode: session.DecodeTokenExpiry(session.JSONCodec{}),
+//	})
+//	m := session.NewManager(store)
+//	go store.Copy(ctx)
+//
+// Sessions are read from the new store, then from the old one, and written to the new
+// store. A session found only in the old store is copied to the new one by Find, and
+// Copy copies the others in the background; Manager.Stat reports its progress, also
+// when the MigrateStore is wrapped by session.StoreMiddlewares. With DualWrite the
+// writes also go to the old store, so that it stays usable as a rollback target.
+// Delete always deletes from both stores, so that a deleted session doesn't come back
+// from the old store.
+//
+// Once Copy is done, the MigrateStore can be replaced by the new store.
+package migratestore
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipiao/session/stores/internal/storeutil"
+)
+
+// Store is the interface of the old and new stores, the same as session.Store.
+type Store = storeutil.Store
+
+// Decoder returns the token and expiry of the session data b. The stores only know
+// the encoded data, so the expiry of a copied session and the token of the data
+// returned by Loads come from the session codec, see session.DecodeTokenExpiry.
+// The session data only holds the session id, which is the token until the token is
+// renewed, so the token of a renewed session is wrong.
+type Decoder func(b []byte) (token string, expiry time.Time, err error)
+
+// Config configures a MigrateStore.
+type Config struct {
+	// Decode decodes the token and expiry of session data, required.
+	Decode Decoder
+	// DualWrite also writes the sessions to the old store.
+	DualWrite bool
+	// IdleTimeout caps the expiry of a copied session at now+IdleTimeout. The decoded
+	// expiry is the absolute deadline of the session, which doesn't include the idle
+	// timeout, so without it an idle session copied to the new store lives until its
+	// deadline. Set it to the IdleTime of the manager, or to the longest idle timeout
+	// of the sessions if they override it.
+	IdleTimeout time.Duration
+	// OnError is called with the errors of copying a session, which have no caller
+	// to return them to. They are logged if nil.
+	OnError func(err error)
+}
+
+var (
+	errNoDecoder = errors.New("migratestore: a decoder is required")
+	errCopying   = errors.New("migratestore: copy is already running")
+)
+
+// MigrateStore reads from an old and a new store, and writes to the new store.
+type MigrateStore struct {
+	old, new Store
+	cfg      Config
+
+	copied  uint64
+	skipped uint64
+	failed  uint64
+	done    int32
+
+	mu      sync.Mutex
+	copying bool
+}
+
+// New returns a MigrateStore moving the sessions of old to new.
+func New(old, new Store, cfg Config) (*MigrateStore, error) {
+	if cfg.Decode == nil {
+		return nil, errNoDecoder
+	}
+	if cfg.OnError == nil {
+		cfg.OnError = func(err error) {
+			log.Printf("migratestore: %v", err)
+		}
+	}
+	return &MigrateStore{old: old, new: new, cfg: cfg}, nil
+}
+
+func (m *MigrateStore) oldCtx() storeutil.StoreContext {
+	return storeutil.WithContext(m.old)
+}
+
+func (m *MigrateStore) newCtx() storeutil.StoreContext {
+	return storeutil.WithContext(m.new)
+}
+
+// copy saves the session token of the old store to the new one, unless the new store
+// already has it: a session written since the migration started is newer than the
+// one of the old store. It reports whether the session was copied.
+//
+// If the new store supports SaveIfVersion, the session is created only if it doesn't
+// exist. Otherwise a request saving the session between the check and the copy may
+// rarely be overwritten.
+//
+// The session may be deleted after it was read from the old store, and before it is
+// saved to the new one. Delete deletes from the old store first, so the copy is
+// deleted again if the session is no longer in the old store once it is saved.
+func (m *MigrateStore) copy(ctx context.Context, token string, b []byte, expiry time.Time) (bool, error) {
+	now := time.Now()
+	if m.cfg.IdleTimeout > 0 && expiry.After(now.Add(m.cfg.IdleTimeout)) {
+		expiry = now.Add(m.cfg.IdleTimeout)
+	}
+	if !expiry.After(now) {
+		return false, nil
+	}
+	ok, err := m.save(ctx, token, b, expiry)
+	if err != nil || !ok {
+		return false, err
+	}
+	_, found, err := m.oldCtx().FindCtx(ctx, token)
+	if err != nil || found {
+		return err == nil, err
+	}
+	return false, m.newCtx().DeleteCtx(ctx, token)
+}
+
+// save saves the session token to the new store unless it already has it.
+func (m *MigrateStore) save(ctx context.Context, token string, b []byte, expiry time.Time) (bool, error) {
+	if cs, ok := m.new.(storeutil.CASStore); ok {
+		_, ok, err := cs.SaveIfVersion(ctx, token, b, expiry, 0)
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return ok, err
+		}
+	}
+	_, found, err := m.newCtx().FindCtx(ctx, token)
+	if err != nil || found {
+		return false, err
+	}
+	return true, m.newCtx().SaveCtx(ctx, token, b, expiry)
+}
+
+// copyOne copies a session found by Find or Copy and counts it.
+func (m *MigrateStore) copyOne(ctx context.Context, token string, b []byte) {
+	_, expiry, err := m.cfg.Decode(b)
+	var ok bool
+	if err == nil {
+		ok, err = m.copy(ctx, token, b, expiry)
+	}
+	switch {
+	case err != nil:
+		atomic.AddUint64(&m.failed, 1)
+		m.cfg.OnError(err)
+	case ok:
+		atomic.AddUint64(&m.copied, 1)
+	default:
+		atomic.AddUint64(&m.skipped, 1)
+	}
+}
+
+// Copy copies to the new store the sessions of the old store which are not in the
+// new store yet, using Scan if the old store supports it and Loads otherwise. The
+// sessions which fail to be copied are counted and passed to OnError. Run it in a
+// goroutine; it stops when ctx is done, and can be run again to resume.
+//
+// Loads doesn't return the tokens, so they come from Decode. A session whose token
+// was renewed is then copied under its id instead of its token; it is still copied
+// under its token by Find when it is used, but the copy under its id is left behind.
+// Prefer an old store which supports Scan, such as memstore.
+func (m *MigrateStore) Copy(ctx context.Context) error {
+	m.mu.Lock()
+	if m.copying {
+		m.mu.Unlock()
+		return errCopying
+	}
+	m.copying = true
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.copying = false
+		m.mu.Unlock()
+	}()
+
+	var err error
+	sc, scan := m.old.(storeutil.Scanner)
+	if scan {
+		err = sc.Scan(ctx, func(token string, b []byte) error {
+			m.copyOne(ctx, token, b)
+			return ctx.Err()
+		})
+		if errors.Is(err, errors.ErrUnsupported) {
+			scan, err = false, nil
+		}
+	}
+	if !scan {
+		var bs [][]byte
+		bs, err = m.oldCtx().LoadsCtx(ctx)
+		for _, b := range bs {
+			if err != nil {
+				break
+			}
+			// Loads only returns the data, the token comes from the codec and is
+			// the session id, which is wrong if the token was renewed
+			token, _, derr := m.cfg.Decode(b)
+			if derr != nil {
+				atomic.AddUint64(&m.failed, 1)
+				m.cfg.OnError(derr)
+				continue
+			}
+			m.copyOne(ctx, token, b)
+			err = ctx.Err()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&m.done, 1)
+	return nil
+}
+
+// MigrationProgress returns the number of sessions copied, by Find or Copy, skipped
+// because they were already in the new store or expired, and failed to be copied, and
+// whether Copy is done. Manager.Stat reports it.
+func (m *MigrateStore) MigrationProgress() (copied, skipped, failed uint64, done bool) {
+	return atomic.LoadUint64(&m.copied), atomic.LoadUint64(&m.skipped), atomic.LoadUint64(&m.failed), atomic.LoadInt32(&m.done) == 1
+}
+
+// Find returns the data for a session token from the new store, or from the old one.
+// A session found in the old store is copied to the new one.
+func (m *MigrateStore) Find(token string) ([]byte, bool, error) {
+	return m.FindCtx(context.Background(), token)
+}
+
+// FindCtx is the context-aware version of Find.
+func (m *MigrateStore) FindCtx(ctx context.Context, token string) ([]byte, bool, error) {
+	b, found, err := m.newCtx().FindCtx(ctx, token)
+	if err != nil || found {
+		return b, found, err
+	}
+	b, found, err = m.oldCtx().FindCtx(ctx, token)
+	if err != nil || !found {
+		return nil, false, err
+	}
+	m.copyOne(ctx, token, b)
+	return b, true, nil
+}
+
+// Save saves the data of a session token to the new store, and to the old one with
+// DualWrite.
+func (m *MigrateStore) Save(token string, b []byte, expiry time.Time) error {
+	return m.SaveCtx(context.Background(), token, b, expiry)
+}
+
+// SaveCtx is the context-aware version of Save.
+func (m *MigrateStore) SaveCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	if err := m.newCtx().SaveCtx(ctx, token, b, expiry); err != nil {
+		return err
+	}
+	if m.cfg.DualWrite {
+		return m.oldCtx().SaveCtx(ctx, token, b, expiry)
+	}
+	return nil
+}
+
+// Delete removes a session token from both stores, from the old store first so that
+// a copy running at the same time can't bring the session back.
+func (m *MigrateStore) Delete(token string) error {
+	return m.DeleteCtx(context.Background(), token)
+}
+
+// DeleteCtx is the context-aware version of Delete.
+func (m *MigrateStore) DeleteCtx(ctx context.Context, token string) error {
+	if err := m.oldCtx().DeleteCtx(ctx, token); err != nil {
+		return err
+	}
+	return m.newCtx().DeleteCtx(ctx, token)
+}
+
+// Dumps calls Dumps of the new store, and of the old one with DualWrite.
+func (m *MigrateStore) Dumps() error {
+	return m.DumpsCtx(context.Background())
+}
+
+// DumpsCtx is the context-aware version of Dumps.
+func (m *MigrateStore) DumpsCtx(ctx context.Context) error {
+	if err := m.newCtx().DumpsCtx(ctx); err != nil {
+		return err
+	}
+	if m.cfg.DualWrite {
+		return m.oldCtx().DumpsCtx(ctx)
+	}
+	return nil
+}
+
+// Loads returns the data of the sessions of the new store, and of the sessions of the
+// old store which are not in the new one. The data of the old store which can't be
+// decoded is skipped.
+func (m *MigrateStore) Loads() ([][]byte, error) {
+	return m.LoadsCtx(context.Background())
+}
+
+// LoadsCtx is the context-aware version of Loads.
+func (m *MigrateStore) LoadsCtx(ctx context.Context) ([][]byte, error) {
+	bs, err := m.newCtx().LoadsCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(bs))
+	for _, b := range bs {
+		if token, _, err := m.cfg.Decode(b); err == nil {
+			seen[token] = true
+		}
+	}
+	old, err := m.oldCtx().LoadsCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range old {
+		if token, _, err := m.cfg.Decode(b); err == nil && !seen[token] {
+			bs = append(bs, b)
+		}
+	}
+	return bs, nil
+}
+
+// Scan calls fn with the sessions of the new store, and then with the sessions of
+// the old store which are not in the new one. Both stores must support Scan.
+func (m *MigrateStore) Scan(ctx context.Context, fn func(token string, b []byte) error) error {
+	nsc, ok := m.new.(storeutil.Scanner)
+	if !ok {
+		return storeutil.Unsupported(m.new, "Scan")
+	}
+	osc, ok := m.old.(storeutil.Scanner)
+	if !ok {
+		return storeutil.Unsupported(m.old, "Scan")
+	}
+	seen := make(map[string]bool)
+	err := nsc.Scan(ctx, func(token string, b []byte) error {
+		seen[token] = true
+		return fn(token, b)
+	})
+	if err != nil {
+		return err
+	}
+	return osc.Scan(ctx, func(token string, b []byte) error {
+		if seen[token] {
+			return nil
+		}
+		return fn(token, b)
+	})
+}
+
+// QuerySessions runs the query on the new store once Copy is done. Before, it is
+// unsupported, and the session package filters the sessions returned by Loads.
+func (m *MigrateStore) QuerySessions(ctx context.Context, expiryFrom, expiryTo time.Time, keyEquals map[string]string, offset, limit int, match func(token string, b []byte) bool) ([]string, [][]byte, error) {
+	qs, ok := m.new.(storeutil.QueryableStore)
+	if !ok {
+		return nil, nil, storeutil.Unsupported(m.new, "QuerySessions")
+	}
+	if atomic.LoadInt32(&m.done) == 0 {
+		return nil, nil, storeutil.Unsupported(m, "QuerySessions before the copy is done")
+	}
+	return qs.QuerySessions(ctx, expiryFrom, expiryTo, keyEquals, offset, limit, match)
+}
+
+// FindVersion returns the data and version for a session token from the new store,
+// after copying the session from the old store if it is only there.
+func (m *MigrateStore) FindVersion(ctx context.Context, token string) ([]byte, int64, bool, error) {
+	cs, ok := m.new.(storeutil.CASStore)
+	if !ok {
+		return nil, 0, false, storeutil.Unsupported(m.new, "FindVersion")
+	}
+	b, version, found, err := cs.FindVersion(ctx, token)
+	if err != nil || found {
+		return b, version, found, err
+	}
+	b, found, err = m.oldCtx().FindCtx(ctx, token)
+	if err != nil || !found {
+		return nil, 0, false, err
+	}
+	m.copyOne(ctx, token, b)
+	return cs.FindVersion(ctx, token)
+}
+
+// SaveIfVersion saves the data of a session token to the new store if its version
+// equals version, and then to the old one with DualWrite.
+func (m *MigrateStore) SaveIfVersion(ctx context.Context, token string, b []byte, expiry time.Time, version int64) (int64, bool, error) {
+	cs, ok := m.new.(storeutil.CASStore)
+	if !ok {
+		return 0, false, storeutil.Unsupported(m.new, "SaveIfVersion")
+	}
+	newVersion, ok, err := cs.SaveIfVersion(ctx, token, b, expiry, version)
+	if err != nil || !ok || !m.cfg.DualWrite {
+		return newVersion, ok, err
+	}
+	return newVersion, true, m.oldCtx().SaveCtx(ctx, token, b, expiry)
+}
+
+// Close stops the cleanup goroutines of both stores, or closes them.
+func (m *MigrateStore) Close() error {
+	return errors.Join(storeutil.Close(m.new), storeutil.Close(m.old))
+}
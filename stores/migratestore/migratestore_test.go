@@ -0,0 +1,181 @@
+package migratestore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipiao/session/stores/internal/storetest"
+	"github.com/ipiao/session/stores/memstore"
+)
+
+// encode encodes the token and expiry in the session data, like the session codecs
+func encode(token string, expiry time.Time) []byte {
+	return []byte(token + "|" + strconv.FormatInt(expiry.UnixNano(), 10))
+}
+
+func decode(b []byte) (string, time.Time, error) {
+	token, expiry, ok := strings.Cut(string(b), "|")
+	if !ok {
+		return "", time.Time{}, errors.New("invalid data")
+	}
+	n, err := strconv.ParseInt(expiry, 10, 64)
+	return token, time.Unix(0, n), err
+}
+
+func save(s Store, token string, expiry time.Time) {
+	s.Save(token, encode(token, expiry), expiry)
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(memstore.New(0), memstore.New(0), Config{}); err != errNoDecoder {
+		t.Fatalf("got %v: expected %v", err, errNoDecoder)
+	}
+}
+
+func TestFind(t *testing.T) {
+	old, new := memstore.New(0), storetest.NewBuntStore(t)
+	m, _ := New(old, new, Config{Decode: decode})
+	expiry := time.Now().Add(time.Minute)
+	save(old, "a", expiry)
+
+	b, found, err := m.Find("a")
+	if err != nil || !found || !bytes.Equal(b, encode("a", expiry)) {
+		t.Fatalf("got %s %v %v: expected the session of the old store", b, found, err)
+	}
+	if _, found, _ = new.Find("a"); !found {
+		t.Fatal("expected Find to copy the session to the new store")
+	}
+	if copied, _, _, _ := m.MigrationProgress(); copied != 1 {
+		t.Fatalf("got %d: expected 1 session copied", copied)
+	}
+
+	m.Save("b", []byte("b"), expiry)
+	if _, found, _ = old.Find("b"); found {
+		t.Fatal("expected the session to be saved only to the new store")
+	}
+	m.Delete("a")
+	if _, found, _ = m.Find("a"); found {
+		t.Fatal("expected the session to be deleted from both stores")
+	}
+}
+
+func TestDualWrite(t *testing.T) {
+	old, new := memstore.New(0), memstore.New(0)
+	m, _ := New(old, new, Config{Decode: decode, DualWrite: true})
+	m.Save("a", []byte("a"), time.Now().Add(time.Minute))
+	if _, found, _ := old.Find("a"); !found {
+		t.Fatal("expected the session to be saved to the old store")
+	}
+}
+
+func TestCopyScan(t *testing.T) {
+	old, new := storetest.NewBuntStore(t), storetest.NewBuntStore(t)
+	m, _ := New(old, new, Config{Decode: decode})
+	expiry := time.Now().Add(time.Minute)
+	save(old, "a", expiry)
+	save(old, "b", expiry)
+	new.Save("b", []byte("newer"), expiry)
+
+	ctx := context.Background()
+	if _, _, err := m.QuerySessions(ctx, time.Time{}, time.Time{}, nil, 0, 0, nil); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("got %v: expected queries to be unsupported before the copy is done", err)
+	}
+	if err := m.Copy(ctx); err != nil {
+		t.Fatal(err)
+	}
+	copied, skipped, failed, done := m.MigrationProgress()
+	if copied != 1 || skipped != 1 || failed != 0 || !done {
+		t.Fatalf("got %d %d %d %v: expected 1 copied and 1 skipped", copied, skipped, failed, done)
+	}
+	if b, _, _ := new.Find("b"); !bytes.Equal(b, []byte("newer")) {
+		t.Fatalf("got %s: expected the newer session not to be overwritten", b)
+	}
+	if tokens, _, err := m.QuerySessions(ctx, time.Time{}, time.Time{}, nil, 0, 0, nil); err != nil || len(tokens) != 2 {
+		t.Fatalf("got %v %v: expected the new store to be queried", tokens, err)
+	}
+}
+
+func TestCopyLoads(t *testing.T) {
+	dumpfile := filepath.Join(t.TempDir(), "sessions.dump")
+	dumped := memstore.New(0)
+	dumped.SetDumpFile(dumpfile)
+	expiry := time.Now().Add(time.Minute)
+	save(dumped, "a", expiry)
+	save(dumped, "b", expiry)
+	dumped.Save("c", []byte("invalid"), expiry)
+	if err := dumped.Dumps(); err != nil {
+		t.Fatal(err)
+	}
+
+	old := memstore.New(0)
+	old.SetDumpFile(dumpfile)
+	new := memstore.New(0)
+	var errs []error
+	m, _ := New(old, new, Config{Decode: decode, OnError: func(err error) { errs = append(errs, err) }})
+
+	bs, err := m.Loads()
+	if err != nil || len(bs) != 2 {
+		t.Fatalf("got %d %v: expected the sessions of the dump file", len(bs), err)
+	}
+	if err = m.Copy(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"a", "b"} {
+		if _, found, _ := new.Find(token); !found {
+			t.Fatalf("expected %s to be copied", token)
+		}
+	}
+	if copied, _, failed, done := m.MigrationProgress(); copied != 2 || failed != 1 || !done || len(errs) != 1 {
+		t.Fatalf("got %d %d %v %v: expected 2 copied and 1 failed", copied, failed, done, errs)
+	}
+}
+
+// hookStore calls before before the saves
+type hookStore struct {
+	*memstore.MemStore
+	before func(token string)
+}
+
+func (s hookStore) SaveCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	s.before(token)
+	return s.MemStore.SaveCtx(ctx, token, b, expiry)
+}
+
+func TestDeleteDuringCopy(t *testing.T) {
+	old, new := memstore.New(0), memstore.New(0)
+	var m *MigrateStore
+	// 在从旧存储器读取之后、保存到新存储器之前删除session
+	m, _ = New(old, hookStore{new, func(token string) { m.Delete(token) }}, Config{Decode: decode})
+	save(old, "a", time.Now().Add(time.Minute))
+
+	if err := m.Copy(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := new.Find("a"); found {
+		t.Fatal("expected the deleted session not to be copied back")
+	}
+	if copied, skipped, _, _ := m.MigrationProgress(); copied != 0 || skipped != 1 {
+		t.Fatalf("got %d %d: expected the session to be skipped", copied, skipped)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	old, new := memstore.New(0), storetest.NewBuntStore(t)
+	m, _ := New(old, new, Config{Decode: decode, IdleTimeout: 50 * time.Millisecond})
+	save(old, "a", time.Now().Add(time.Hour))
+
+	if _, found, _ := m.Find("a"); !found {
+		t.Fatal("expected the session of the old store")
+	}
+	old.Delete("a")
+	time.Sleep(100 * time.Millisecond)
+	if _, found, _ := new.Find("a"); found {
+		t.Fatal("expected the copy to expire after the idle timeout")
+	}
+}
@@ -6,24 +6,38 @@
 //	CREATE TABLE sessions (
 //	  token CHAR(43) PRIMARY KEY,
 //	  data BLOB NOT NULL,
-//	  expiry TIMESTAMP(6) NOT NULL
+//	  expiry TIMESTAMP(6) NOT NULL,
+//	  version BIGINT NOT NULL DEFAULT 0
 //	);
 //	CREATE INDEX sessions_expiry_idx ON sessions (expiry);
 //
+// The version column is used for optimistic locking. It is incremented by every save,
+// so that FindVersion and SaveIfVersion see the changes made by Save too. Tables
+// created without it must add it with:
+//
+//	ALTER TABLE sessions ADD COLUMN version BIGINT NOT NULL DEFAULT 0;
+//
 // The mysqlstore package provides a background 'cleanup' goroutine to delete expired
 // session data. This stops the database table from holding on to invalid sessions
 // forever and growing unnecessarily large.
 package mysqlstore
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"log"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	// Register go-sql-driver/mysql with database/sql
 	_ "github.com/go-sql-driver/mysql"
+
+	"github.com/ipiao/session/stores/internal/storeutil"
 )
 
 // MySQLStore represents the currently configured session session store.
@@ -31,8 +45,27 @@ type MySQLStore struct {
 	*sql.DB
 	version     string
 	stopCleanup chan bool
+
+	lockMu sync.Mutex
+	fence  int64
+	locks  map[string]*advisoryLock
 }
 
+// advisoryLock is a lock taken by GET_LOCK, which belongs to the connection it was
+// taken on.
+type advisoryLock struct {
+	fence int64
+	conn  *sql.Conn
+	timer *time.Timer
+}
+
+// LockPrefix is prepended to the key to form the name of the lock taken by Lock.
+// MySQL limits lock names to 64 characters.
+var LockPrefix = "scs:lock:"
+
+// LockRetryInterval is how long Lock waits before trying again to take a held lock.
+var LockRetryInterval = 10 * time.Millisecond
+
 // New returns a new MySQLStore instance.
 //
 // The cleanupInterval parameter controls how frequently expired session data
@@ -55,6 +88,11 @@ func New(db *sql.DB, cleanupInterval time.Duration) *MySQLStore {
 // the session token is not found or is expired, the returned exists flag will be
 // set to false.
 func (m *MySQLStore) Find(token string) ([]byte, bool, error) {
+	return m.FindCtx(context.Background(), token)
+}
+
+// FindCtx is the context-aware version of Find. The query is cancelled when ctx is done.
+func (m *MySQLStore) FindCtx(ctx context.Context, token string) ([]byte, bool, error) {
 	var b []byte
 	var stmt string
 
@@ -64,7 +102,7 @@ func (m *MySQLStore) Find(token string) ([]byte, bool, error) {
 		stmt = "SELECT data FROM sessions WHERE token = ? AND UTC_TIMESTAMP < expiry"
 	}
 
-	row := m.DB.QueryRow(stmt, token)
+	row := m.DB.QueryRowContext(ctx, stmt, token)
 	err := row.Scan(&b)
 	if err == sql.ErrNoRows {
 		return nil, false, nil
@@ -74,7 +112,13 @@ func (m *MySQLStore) Find(token string) ([]byte, bool, error) {
 	return b, true, nil
 }
 
+// Loads 加载所有未过期的session
 func (m *MySQLStore) Loads() ([][]byte, error) {
+	return m.LoadsCtx(context.Background())
+}
+
+// LoadsCtx 加载所有未过期的session
+func (m *MySQLStore) LoadsCtx(ctx context.Context) ([][]byte, error) {
 	var bs [][]byte
 	var stmt string
 
@@ -84,19 +128,39 @@ func (m *MySQLStore) Loads() ([][]byte, error) {
 		stmt = "SELECT data FROM sessions WHERE UTC_TIMESTAMP < expiry"
 	}
 
-	rows, err := m.DB.Query(stmt)
-	defer rows.Close()
+	rows, err := m.DB.QueryContext(ctx, stmt)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	} else if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	for rows.Next() {
 		var b []byte
 		err = rows.Scan(&b)
+		if err != nil {
+			return bs, err
+		}
 		bs = append(bs, b)
 	}
-	return bs, err
+	return bs, rows.Err()
+}
+
+// Scan calls fn for every unexpired session, streaming the rows from a single query
+// instead of loading them all into memory. Scan stops and returns the error if fn
+// returns one.
+func (m *MySQLStore) Scan(ctx context.Context, fn func(token string, b []byte) error) error {
+	var stmt string
+	if compareVersion("5.6.4", m.version) >= 0 {
+		stmt = "SELECT token, data FROM sessions WHERE UTC_TIMESTAMP(6) < expiry"
+	} else {
+		stmt = "SELECT token, data FROM sessions WHERE UTC_TIMESTAMP < expiry"
+	}
+	rows, err := m.DB.QueryContext(ctx, stmt)
+	if err != nil {
+		return err
+	}
+	return storeutil.ScanRows(rows, fn)
 }
 
 // Dumps 数据存储
@@ -104,22 +168,219 @@ func (m *MySQLStore) Dumps() (err error) {
 	return nil
 }
 
+// DumpsCtx 数据存储
+func (m *MySQLStore) DumpsCtx(ctx context.Context) (err error) {
+	return nil
+}
+
 // Save adds a session token and data to the MySQLStore instance with the given expiry
 // time. If the session token already exists then the data and expiry time are updated.
 func (m *MySQLStore) Save(token string, b []byte, expiry time.Time) error {
-	_, err := m.DB.Exec("INSERT INTO sessions (token, data, expiry) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE data = VALUES(data), expiry = VALUES(expiry)", token, b, expiry.UTC())
+	return m.SaveCtx(context.Background(), token, b, expiry)
+}
+
+// SaveCtx is the context-aware version of Save.
+func (m *MySQLStore) SaveCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	_, err := m.DB.ExecContext(ctx, "INSERT INTO sessions (token, data, expiry, version) VALUES (?, ?, ?, 1) ON DUPLICATE KEY UPDATE data = VALUES(data), expiry = VALUES(expiry), version = version + 1", token, b, expiry.UTC())
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// FindVersion returns the data and version for a given session token. The version is
+// incremented by every Save and SaveIfVersion, and is 0 if the session token is not
+// found or is expired.
+func (m *MySQLStore) FindVersion(ctx context.Context, token string) (b []byte, version int64, found bool, err error) {
+	stmt := "SELECT data, version FROM sessions WHERE token = ? AND " + m.now() + " < expiry"
+	err = m.DB.QueryRowContext(ctx, stmt, token).Scan(&b, &version)
+	if err == sql.ErrNoRows {
+		return nil, 0, false, nil
+	} else if err != nil {
+		return nil, 0, false, err
+	}
+	return b, version, true, nil
+}
+
+// SaveIfVersion saves the data for a given session token only if its current version
+// equals version, and returns the new version. If the versions differ nothing is
+// saved and ok is false. A version of 0 saves a new session, replacing an expired one.
+func (m *MySQLStore) SaveIfVersion(ctx context.Context, token string, b []byte, expiry time.Time, version int64) (newVersion int64, ok bool, err error) {
+	var n int64
+	if version == 0 {
+		n, err = m.exec(ctx, "UPDATE sessions SET data = ?, expiry = ?, version = 1 WHERE token = ? AND expiry <= "+m.now(), b, expiry.UTC(), token)
+		if err == nil && n == 0 {
+			n, err = m.exec(ctx, "INSERT IGNORE INTO sessions (token, data, expiry, version) VALUES (?, ?, ?, 1)", token, b, expiry.UTC())
+		}
+	} else {
+		n, err = m.exec(ctx, "UPDATE sessions SET data = ?, expiry = ?, version = version + 1 WHERE token = ? AND version = ? AND "+m.now()+" < expiry", b, expiry.UTC(), token, version)
+	}
+	if err != nil || n == 0 {
+		return 0, false, err
+	}
+	return version + 1, true, nil
+}
+
 // Delete removes a session token and corresponding data from the MySQLStore instance.
 func (m *MySQLStore) Delete(token string) error {
-	_, err := m.DB.Exec("DELETE FROM sessions WHERE token = ?", token)
+	return m.DeleteCtx(context.Background(), token)
+}
+
+// DeleteCtx is the context-aware version of Delete.
+func (m *MySQLStore) DeleteCtx(ctx context.Context, token string) error {
+	_, err := m.DB.ExecContext(ctx, "DELETE FROM sessions WHERE token = ?", token)
+	return err
+}
+
+// QuerySessions returns the unexpired sessions whose expiry time is in [expiryFrom, expiryTo),
+// ordered by expiry time. A zero expiryFrom or expiryTo means no bound. keyEquals holds
+// keys of the session data with their JSON encoded values, which are compared with
+// JSON_EXTRACT on the data encoded by session.JSONCodec (in Go before MySQL 5.7.8). They
+// and the match func, if not nil, filter the sessions before offset and limit (0 means no
+// limit) are applied; without match everything is executed by the database.
+func (m *MySQLStore) QuerySessions(ctx context.Context, expiryFrom, expiryTo time.Time, keyEquals map[string]string, offset, limit int, match func(token string, b []byte) bool) ([]string, [][]byte, error) {
+	var stmt string
+	if compareVersion("5.6.4", m.version) >= 0 {
+		stmt = "SELECT token, data FROM sessions WHERE UTC_TIMESTAMP(6) < expiry"
+	} else {
+		stmt = "SELECT token, data FROM sessions WHERE UTC_TIMESTAMP < expiry"
+	}
+	var args []interface{}
+	if !expiryFrom.IsZero() {
+		stmt += " AND expiry >= ?"
+		args = append(args, expiryFrom.UTC())
+	}
+	if !expiryTo.IsZero() {
+		stmt += " AND expiry < ?"
+		args = append(args, expiryTo.UTC())
+	}
+	if compareVersion("5.7.8", m.version) >= 0 {
+		for _, key := range storeutil.SortedKeys(keyEquals) {
+			stmt += " AND JSON_EXTRACT(CONVERT(data USING utf8mb4), ?) = CAST(? AS JSON)"
+			args = append(args, jsonPath(key), keyEquals[key])
+		}
+	} else {
+		match = storeutil.MatchKeys(keyEquals, match)
+	}
+	stmt += " ORDER BY expiry"
+	if match == nil && limit > 0 {
+		stmt += " LIMIT ? OFFSET ?"
+		args = append(args, limit, offset)
+		offset = 0
+	}
+
+	rows, err := m.DB.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return storeutil.Collect(rows, offset, limit, match)
+}
+
+// Lock takes the advisory lock on key with GET_LOCK. If the lock is held, Lock polls
+// every LockRetryInterval until it gets the lock or ctx is done, without holding a
+// connection while waiting. Once taken, the lock is held by a connection reserved from
+// the pool until Unlock, so it is released by the server if the process dies; it is
+// also released after ttl. The returned fence is only increasing within this
+// MySQLStore instance.
+func (m *MySQLStore) Lock(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	var conn *sql.Conn
+	for {
+		var err error
+		conn, err = m.tryLock(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		if conn != nil {
+			break
+		}
+
+		t := time.NewTimer(LockRetryInterval)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return 0, ctx.Err()
+		}
+	}
+
+	m.lockMu.Lock()
+	defer m.lockMu.Unlock()
+	if m.locks == nil {
+		m.locks = make(map[string]*advisoryLock)
+	}
+	m.fence++
+	l := &advisoryLock{fence: m.fence, conn: conn}
+	if ttl > 0 {
+		fence := l.fence
+		l.timer = time.AfterFunc(ttl, func() {
+			if err := m.Unlock(context.Background(), key, fence); err != nil {
+				log.Println(err)
+			}
+		})
+	}
+	m.locks[key] = l
+	return l.fence, nil
+}
+
+// Unlock releases the advisory lock on key if it is still held with the fence, and
+// returns its connection to the pool.
+func (m *MySQLStore) Unlock(ctx context.Context, key string, fence int64) error {
+	m.lockMu.Lock()
+	l, ok := m.locks[key]
+	if !ok || l.fence != fence {
+		m.lockMu.Unlock()
+		return nil
+	}
+	delete(m.locks, key)
+	m.lockMu.Unlock()
+
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+	defer l.conn.Close()
+	_, err := l.conn.ExecContext(ctx, "DO RELEASE_LOCK(?)", LockPrefix+key)
+	if err != nil {
+		// the lock may still be held, the connection must not go back to the pool
+		discard(l.conn)
+	}
 	return err
 }
 
+// tryLock takes the advisory lock on key with GET_LOCK without waiting, and returns the
+// connection holding it. If the lock is held by another connection, it returns a nil
+// connection, and the one it used goes back to the pool.
+func (m *MySQLStore) tryLock(ctx context.Context, key string) (*sql.Conn, error) {
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var ok sql.NullInt64
+	err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 0)", LockPrefix+key).Scan(&ok)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		// the lock may have been granted before the error
+		discard(conn)
+		conn.Close()
+		return nil, err
+	}
+	if !ok.Valid {
+		conn.Close()
+		return nil, errors.New("mysqlstore: GET_LOCK failed")
+	}
+	if ok.Int64 != 1 {
+		conn.Close()
+		return nil, nil
+	}
+	return conn, nil
+}
+
+// discard marks conn as broken, so that it is closed instead of returned to the pool.
+func discard(conn *sql.Conn) {
+	conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+}
+
 func (m *MySQLStore) startCleanup(interval time.Duration) {
 	m.stopCleanup = make(chan bool)
 	ticker := time.NewTicker(interval)
@@ -166,6 +427,30 @@ func (m *MySQLStore) deleteExpired() error {
 	return err
 }
 
+// now returns the SQL expression for the current UTC time, with fractional seconds
+// on servers which support them.
+func (m *MySQLStore) now() string {
+	if compareVersion("5.6.4", m.version) >= 0 {
+		return "UTC_TIMESTAMP(6)"
+	}
+	return "UTC_TIMESTAMP"
+}
+
+// exec executes stmt and returns the number of affected rows.
+func (m *MySQLStore) exec(ctx context.Context, stmt string, args ...interface{}) (int64, error) {
+	res, err := m.DB.ExecContext(ctx, stmt, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// jsonPath returns the JSON path of key in the data encoded by session.JSONCodec.
+func jsonPath(key string) string {
+	quoted, _ := json.Marshal(key)
+	return "$.data." + string(quoted)
+}
+
 func getVersion(db *sql.DB) string {
 	var version string
 	row := db.QueryRow("SELECT VERSION()")
@@ -2,6 +2,7 @@ package mysqlstore
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"os"
 	"reflect"
@@ -23,7 +24,7 @@ func TestFind(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = db.Exec("INSERT INTO sessions VALUES('session_token', 'encoded_data', UTC_TIMESTAMP(6) + INTERVAL 1 MINUTE)")
+	_, err = db.Exec("INSERT INTO sessions (token, data, expiry) VALUES('session_token', 'encoded_data', UTC_TIMESTAMP(6) + INTERVAL 1 MINUTE)")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -115,7 +116,7 @@ func TestSaveUpdated(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = db.Exec("INSERT INTO sessions VALUES('session_token', 'encoded_data', UTC_TIMESTAMP(6) + INTERVAL 1 MINUTE)")
+	_, err = db.Exec("INSERT INTO sessions (token, data, expiry) VALUES('session_token', 'encoded_data', UTC_TIMESTAMP(6) + INTERVAL 1 MINUTE)")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -186,7 +187,7 @@ func TestDelete(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = db.Exec("INSERT INTO sessions VALUES('session_token', 'encoded_data', UTC_TIMESTAMP(6) + INTERVAL 1 MINUTE)")
+	_, err = db.Exec("INSERT INTO sessions (token, data, expiry) VALUES('session_token', 'encoded_data', UTC_TIMESTAMP(6) + INTERVAL 1 MINUTE)")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -269,3 +270,161 @@ func TestStopNilCleanup(t *testing.T) {
 	// A send to a nil channel will block forever
 	m.StopCleanup()
 }
+
+func TestSaveIfVersion(t *testing.T) {
+	dsn := os.Getenv("SESSION_MYSQL_TEST_DSN")
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("TRUNCATE TABLE sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := New(db, 0)
+
+	ctx := context.Background()
+	expiry := time.Now().Add(time.Minute)
+
+	version, ok, err := p.SaveIfVersion(ctx, "session_token", []byte("v1"), expiry, 0)
+	if err != nil || !ok || version != 1 {
+		t.Fatalf("got %d %v %v: expected version 1", version, ok, err)
+	}
+	_, ok, err = p.SaveIfVersion(ctx, "session_token", []byte("stale"), expiry, 0)
+	if err != nil || ok {
+		t.Fatalf("got %v %v: expected a conflict", ok, err)
+	}
+	version, ok, err = p.SaveIfVersion(ctx, "session_token", []byte("v2"), expiry, 1)
+	if err != nil || !ok || version != 2 {
+		t.Fatalf("got %d %v %v: expected version 2", version, ok, err)
+	}
+	b, version, found, err := p.FindVersion(ctx, "session_token")
+	if err != nil || !found || version != 2 || !bytes.Equal(b, []byte("v2")) {
+		t.Fatalf("got %s %d %v %v: expected v2 at version 2", b, version, found, err)
+	}
+
+	// Save increments the version too, so a stale SaveIfVersion conflicts
+	err = p.Save("session_token", []byte("saved"), expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, version, _, err = p.FindVersion(ctx, "session_token")
+	if err != nil || version != 3 {
+		t.Fatalf("got %d %v: expected version 3", version, err)
+	}
+	_, ok, err = p.SaveIfVersion(ctx, "session_token", []byte("stale"), expiry, 2)
+	if err != nil || ok {
+		t.Fatalf("got %v %v: expected a conflict after Save", ok, err)
+	}
+
+	err = p.Delete("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok, err = p.SaveIfVersion(ctx, "session_token", []byte("v3"), expiry, 3)
+	if err != nil || ok {
+		t.Fatalf("got %v %v: expected a conflict on a deleted session", ok, err)
+	}
+
+	// an expired session is replaced by a new one
+	err = p.Save("expired_token", []byte("expired"), time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, ok, err = p.SaveIfVersion(ctx, "expired_token", []byte("v1"), expiry, 0)
+	if err != nil || !ok || version != 1 {
+		t.Fatalf("got %d %v %v: expected version 1", version, ok, err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	dsn := os.Getenv("SESSION_MYSQL_TEST_DSN")
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	p := New(db, 0)
+
+	ctx := context.Background()
+
+	fence, err := p.Lock(ctx, "session_token", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wctx, cancel := context.WithTimeout(ctx, time.Second)
+	_, err = p.Lock(wctx, "session_token", time.Minute)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v: expected %v", err, context.DeadlineExceeded)
+	}
+
+	err = p.Unlock(ctx, "session_token", fence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := p.Lock(ctx, "session_token", 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next <= fence {
+		t.Fatalf("got fence %d: expected more than %d", next, fence)
+	}
+
+	// the lock is released after ttl
+	_, err = p.Lock(ctx, "session_token", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// a waiting Lock doesn't hold a connection, so the pool stays usable
+func TestLockWaitPool(t *testing.T) {
+	dsn := os.Getenv("SESSION_MYSQL_TEST_DSN")
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(2)
+
+	p := New(db, 0)
+
+	ctx := context.Background()
+
+	fence, err := p.Lock(ctx, "wait_token", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Unlock(ctx, "wait_token", fence)
+
+	done := make(chan error, 1)
+	go func() {
+		wctx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		_, err := p.Lock(wctx, "wait_token", time.Minute)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	fctx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	if _, _, err = p.FindCtx(fctx, "wait_token"); err != nil {
+		t.Fatalf("got %v: expected a connection while Lock waits", err)
+	}
+	if err = <-done; err != context.DeadlineExceeded {
+		t.Fatalf("got %v: expected %v", err, context.DeadlineExceeded)
+	}
+}
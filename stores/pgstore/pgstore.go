@@ -6,30 +6,63 @@
 //	CREATE TABLE sessions (
 //	  token TEXT PRIMARY KEY,
 //	  data BYTEA NOT NULL,
-//	  expiry TIMESTAMPTZ NOT NULL
+//	  expiry TIMESTAMPTZ NOT NULL,
+//	  version BIGINT NOT NULL DEFAULT 0
 //	);
 //	CREATE INDEX sessions_expiry_idx ON sessions (expiry);
 //
+// The version column is used for optimistic locking. It is incremented by every save,
+// so that FindVersion and SaveIfVersion see the changes made by Save too. Tables
+// created without it must add it with:
+//
+//	ALTER TABLE sessions ADD COLUMN version BIGINT NOT NULL DEFAULT 0;
+//
 // The pgstore package provides a background 'cleanup' goroutine to delete expired
 // session data. This stops the database table from holding on to invalid sessions
 // indefinitely and growing unnecessarily large.
 package pgstore
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"hash/fnv"
 	"log"
+	"strconv"
+	"sync"
 	"time"
 
 	// Register lib/pq with database/sql
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+
+	"github.com/ipiao/session/stores/internal/storeutil"
 )
 
 // PGStore represents the currently configured session session store.
 type PGStore struct {
 	db          *sql.DB
 	stopCleanup chan bool
+
+	lockMu sync.Mutex
+	fence  int64
+	locks  map[string]*advisoryLock
 }
 
+// advisoryLock is a session level advisory lock, which belongs to the connection it
+// was taken on.
+type advisoryLock struct {
+	fence int64
+	conn  *sql.Conn
+	timer *time.Timer
+}
+
+// LockPrefix is prepended to the key before it is hashed to the bigint id of the
+// advisory lock taken by Lock.
+var LockPrefix = "scs:lock:"
+
+// LockRetryInterval is how long Lock waits before trying again to take a held lock.
+var LockRetryInterval = 10 * time.Millisecond
+
 // New returns a new PGStore instance.
 //
 // The cleanupInterval parameter controls how frequently expired session data
@@ -47,7 +80,12 @@ func New(db *sql.DB, cleanupInterval time.Duration) *PGStore {
 // the session token is not found or is expired, the returned exists flag will
 // be set to false.
 func (p *PGStore) Find(token string) (b []byte, exists bool, err error) {
-	row := p.db.QueryRow("SELECT data FROM sessions WHERE token = $1 AND current_timestamp < expiry", token)
+	return p.FindCtx(context.Background(), token)
+}
+
+// FindCtx is the context-aware version of Find. The query is cancelled when ctx is done.
+func (p *PGStore) FindCtx(ctx context.Context, token string) (b []byte, exists bool, err error) {
+	row := p.db.QueryRowContext(ctx, "SELECT data FROM sessions WHERE token = $1 AND current_timestamp < expiry", token)
 	err = row.Scan(&b)
 	if err == sql.ErrNoRows {
 		return nil, false, nil
@@ -60,19 +98,148 @@ func (p *PGStore) Find(token string) (b []byte, exists bool, err error) {
 // Save adds a session token and data to the PGStore instance with the given expiry time.
 // If the session token already exists then the data and expiry time are updated.
 func (p *PGStore) Save(token string, b []byte, expiry time.Time) error {
-	_, err := p.db.Exec("INSERT INTO sessions (token, data, expiry) VALUES ($1, $2, $3) ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry", token, b, expiry)
+	return p.SaveCtx(context.Background(), token, b, expiry)
+}
+
+// SaveCtx is the context-aware version of Save.
+func (p *PGStore) SaveCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	_, err := p.db.ExecContext(ctx, "INSERT INTO sessions (token, data, expiry, version) VALUES ($1, $2, $3, 1) ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry, version = sessions.version + 1", token, b, expiry)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// FindVersion returns the data and version for a given session token. The version is
+// incremented by every Save and SaveIfVersion, and is 0 if the session token is not
+// found or is expired.
+func (p *PGStore) FindVersion(ctx context.Context, token string) (b []byte, version int64, found bool, err error) {
+	row := p.db.QueryRowContext(ctx, "SELECT data, version FROM sessions WHERE token = $1 AND current_timestamp < expiry", token)
+	err = row.Scan(&b, &version)
+	if err == sql.ErrNoRows {
+		return nil, 0, false, nil
+	} else if err != nil {
+		return nil, 0, false, err
+	}
+	return b, version, true, nil
+}
+
+// SaveIfVersion saves the data for a given session token only if its current version
+// equals version, and returns the new version. If the versions differ nothing is
+// saved and ok is false. A version of 0 saves a new session, replacing an expired one.
+func (p *PGStore) SaveIfVersion(ctx context.Context, token string, b []byte, expiry time.Time, version int64) (newVersion int64, ok bool, err error) {
+	var res sql.Result
+	if version == 0 {
+		res, err = p.db.ExecContext(ctx, "INSERT INTO sessions (token, data, expiry, version) VALUES ($1, $2, $3, 1) ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry, version = 1 WHERE sessions.expiry <= current_timestamp", token, b, expiry)
+	} else {
+		res, err = p.db.ExecContext(ctx, "UPDATE sessions SET data = $2, expiry = $3, version = version + 1 WHERE token = $1 AND version = $4 AND current_timestamp < expiry", token, b, expiry, version)
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return 0, false, err
+	}
+	return version + 1, true, nil
+}
+
 // Delete removes a session token and corresponding data from the PGStore instance.
 func (p *PGStore) Delete(token string) error {
-	_, err := p.db.Exec("DELETE FROM sessions WHERE token = $1", token)
+	return p.DeleteCtx(context.Background(), token)
+}
+
+// DeleteCtx is the context-aware version of Delete.
+func (p *PGStore) DeleteCtx(ctx context.Context, token string) error {
+	_, err := p.db.ExecContext(ctx, "DELETE FROM sessions WHERE token = $1", token)
 	return err
 }
 
+// Loads 加载所有未过期的session
+func (p *PGStore) Loads() ([][]byte, error) {
+	return p.LoadsCtx(context.Background())
+}
+
+// LoadsCtx 加载所有未过期的session
+func (p *PGStore) LoadsCtx(ctx context.Context) ([][]byte, error) {
+	rows, err := p.db.QueryContext(ctx, "SELECT data FROM sessions WHERE current_timestamp < expiry")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var bs [][]byte
+	for rows.Next() {
+		var b []byte
+		if err = rows.Scan(&b); err != nil {
+			return bs, err
+		}
+		bs = append(bs, b)
+	}
+	return bs, rows.Err()
+}
+
+// Scan calls fn for every unexpired session, streaming the rows from a single query
+// instead of loading them all into memory. Scan stops and returns the error if fn
+// returns one.
+func (p *PGStore) Scan(ctx context.Context, fn func(token string, b []byte) error) error {
+	rows, err := p.db.QueryContext(ctx, "SELECT token, data FROM sessions WHERE current_timestamp < expiry")
+	if err != nil {
+		return err
+	}
+	return storeutil.ScanRows(rows, fn)
+}
+
+// Dumps 数据存储
+func (p *PGStore) Dumps() error {
+	return nil
+}
+
+// DumpsCtx 数据存储
+func (p *PGStore) DumpsCtx(ctx context.Context) error {
+	return nil
+}
+
+// QuerySessions returns the unexpired sessions whose expiry time is in [expiryFrom, expiryTo),
+// ordered by expiry time. A zero expiryFrom or expiryTo means no bound. keyEquals holds
+// keys of the session data with their JSON encoded values, which are compared as jsonb
+// on the data encoded by session.JSONCodec. They and the match func, if not nil, filter
+// the sessions before offset and limit (0 means no limit) are applied; without match
+// everything is executed by the database.
+func (p *PGStore) QuerySessions(ctx context.Context, expiryFrom, expiryTo time.Time, keyEquals map[string]string, offset, limit int, match func(token string, b []byte) bool) ([]string, [][]byte, error) {
+	stmt := "SELECT token, data FROM sessions WHERE current_timestamp < expiry"
+	var args []interface{}
+	if !expiryFrom.IsZero() {
+		args = append(args, expiryFrom)
+		stmt += " AND expiry >= $" + strconv.Itoa(len(args))
+	}
+	if !expiryTo.IsZero() {
+		args = append(args, expiryTo)
+		stmt += " AND expiry < $" + strconv.Itoa(len(args))
+	}
+	for _, key := range storeutil.SortedKeys(keyEquals) {
+		args = append(args, key, keyEquals[key])
+		stmt += " AND convert_from(data, 'UTF8')::jsonb -> 'data' -> $" + strconv.Itoa(len(args)-1) + "::text = $" + strconv.Itoa(len(args)) + "::jsonb"
+	}
+	stmt += " ORDER BY expiry"
+	if match == nil {
+		if limit > 0 {
+			args = append(args, limit)
+			stmt += " LIMIT $" + strconv.Itoa(len(args))
+		}
+		if offset > 0 {
+			args = append(args, offset)
+			stmt += " OFFSET $" + strconv.Itoa(len(args))
+			offset = 0
+		}
+	}
+
+	rows, err := p.db.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return storeutil.Collect(rows, offset, limit, match)
+}
+
 func (p *PGStore) startCleanup(interval time.Duration) {
 	p.stopCleanup = make(chan bool)
 	ticker := time.NewTicker(interval)
@@ -106,7 +273,162 @@ func (p *PGStore) StopCleanup() {
 	}
 }
 
+// Lock takes the advisory lock on key with pg_try_advisory_lock. If the lock is held,
+// Lock polls every LockRetryInterval until it gets the lock or ctx is done, without
+// holding a connection while waiting. Once taken, the lock is held by a connection
+// reserved from the pool until Unlock, so it is released by the server if the process
+// dies; it is also released after ttl. The returned fence is only increasing within
+// this PGStore instance.
+func (p *PGStore) Lock(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	var conn *sql.Conn
+	for {
+		var err error
+		conn, err = p.tryLock(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		if conn != nil {
+			break
+		}
+
+		t := time.NewTimer(LockRetryInterval)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return 0, ctx.Err()
+		}
+	}
+
+	p.lockMu.Lock()
+	defer p.lockMu.Unlock()
+	if p.locks == nil {
+		p.locks = make(map[string]*advisoryLock)
+	}
+	p.fence++
+	l := &advisoryLock{fence: p.fence, conn: conn}
+	if ttl > 0 {
+		fence := l.fence
+		l.timer = time.AfterFunc(ttl, func() {
+			if err := p.Unlock(context.Background(), key, fence); err != nil {
+				log.Println(err)
+			}
+		})
+	}
+	p.locks[key] = l
+	return l.fence, nil
+}
+
+// tryLock takes the advisory lock on key with pg_try_advisory_lock, and returns the
+// connection holding it. If the lock is held by another connection, it returns a nil
+// connection, and the one it used goes back to the pool.
+func (p *PGStore) tryLock(ctx context.Context, key string) (*sql.Conn, error) {
+	conn, err := p.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var ok bool
+	err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", lockID(key)).Scan(&ok)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		// the lock may have been granted before the error
+		discard(conn)
+		conn.Close()
+		return nil, err
+	}
+	if !ok {
+		conn.Close()
+		return nil, nil
+	}
+	return conn, nil
+}
+
+// Unlock releases the advisory lock on key if it is still held with the fence, and
+// returns its connection to the pool.
+func (p *PGStore) Unlock(ctx context.Context, key string, fence int64) error {
+	p.lockMu.Lock()
+	l, ok := p.locks[key]
+	if !ok || l.fence != fence {
+		p.lockMu.Unlock()
+		return nil
+	}
+	delete(p.locks, key)
+	p.lockMu.Unlock()
+
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+	defer l.conn.Close()
+	_, err := l.conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", lockID(key))
+	if err != nil {
+		// the lock may still be held, the connection must not go back to the pool
+		discard(l.conn)
+	}
+	return err
+}
+
+// lockID hashes key to the id of its advisory lock.
+func lockID(key string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(LockPrefix + key))
+	return int64(h.Sum64())
+}
+
+// discard marks conn as broken, so that it is closed instead of returned to the pool.
+func discard(conn *sql.Conn) {
+	conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+}
+
 func (p *PGStore) deleteExpired() error {
 	_, err := p.db.Exec("DELETE FROM sessions WHERE expiry < current_timestamp")
 	return err
 }
+
+// Invalidator publishes and receives messages on a PostgreSQL notification channel
+// with NOTIFY and LISTEN. It is used by tieredstore to drop the sessions changed by
+// other instances from their local tier.
+type Invalidator struct {
+	db      *sql.DB
+	dsn     string
+	channel string
+}
+
+// NewInvalidator returns an Invalidator using channel. Messages are published with
+// db. LISTEN needs a dedicated connection, which each subscription opens with dsn,
+// the connection string db was opened with.
+func NewInvalidator(db *sql.DB, dsn, channel string) *Invalidator {
+	return &Invalidator{db: db, dsn: dsn, channel: channel}
+}
+
+// Publish sends msg to the channel with pg_notify.
+func (i *Invalidator) Publish(ctx context.Context, msg string) error {
+	_, err := i.db.ExecContext(ctx, "SELECT pg_notify($1, $2)", i.channel, msg)
+	return err
+}
+
+// Subscribe calls fn in a goroutine with every message sent to the channel, until
+// cancel is called. The listener reconnects if its connection fails; the messages
+// sent in between are lost.
+func (i *Invalidator) Subscribe(fn func(msg string)) (cancel func(), err error) {
+	l := pq.NewListener(i.dsn, 10*time.Millisecond, time.Minute, nil)
+	if err = l.Listen(i.channel); err != nil {
+		l.Close()
+		return nil, err
+	}
+	go func() {
+		// Notify is closed by Close, a nil notification follows a reconnection
+		for n := range l.Notify {
+			if n != nil {
+				fn(n.Extra)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.Close()
+		})
+	}, nil
+}
@@ -6,22 +6,33 @@
 //	CREATE TABLE sessions (
 //		token string,
 //		data blob,
-//		expiry time
+//		expiry time,
+//		version int64
 //	)
 //	CREATE INDEX sessions_expiry_idx ON sessions (expiry);
 //
+// The version column is used for optimistic locking. It is incremented by every save,
+// so that FindVersion and SaveIfVersion see the changes made by Save too. Tables
+// created without it must add it with:
+//
+//	ALTER TABLE sessions ADD version int64;
+//
 // The qlstore package provides a background 'cleanup' goroutine to delete expired
 // session data. This stops the database table from holding on to invalid sessions
 // indefinitely and growing unnecessarily large.
 package qlstore
 
 import (
+	"context"
 	"database/sql"
 	"log"
+	"strconv"
 	"time"
 
 	// Register ql driver with database/sql
 	_ "github.com/cznic/ql/driver"
+
+	"github.com/ipiao/session/stores/internal/storeutil"
 )
 
 // QLStore represents the currently configured session session store.
@@ -62,7 +73,12 @@ func (q *QLStore) startCleanup(interval time.Duration) {
 
 // Delete removes a session token and corresponding data from the QLStore instance.
 func (q *QLStore) Delete(token string) error {
-	_, err := execTx(q.DB, "DELETE FROM sessions where token=$1", token)
+	return q.DeleteCtx(context.Background(), token)
+}
+
+// DeleteCtx is the context-aware version of Delete.
+func (q *QLStore) DeleteCtx(ctx context.Context, token string) error {
+	_, err := execTxCtx(ctx, q.DB, "DELETE FROM sessions where token=$1", token)
 	return err
 }
 
@@ -75,9 +91,14 @@ func (q *QLStore) deleteExpired() error {
 // the session token is not found or is expired, the returned exists flag will
 // be set to false.
 func (q *QLStore) Find(token string) ([]byte, bool, error) {
+	return q.FindCtx(context.Background(), token)
+}
+
+// FindCtx is the context-aware version of Find.
+func (q *QLStore) FindCtx(ctx context.Context, token string) ([]byte, bool, error) {
 	var data []byte
 	query := "SELECT data FROM sessions WHERE token=$1 AND now()<expiry"
-	err := q.QueryRow(query, token).Scan(&data)
+	err := q.QueryRowContext(ctx, query, token).Scan(&data)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, false, nil
@@ -90,28 +111,191 @@ func (q *QLStore) Find(token string) ([]byte, bool, error) {
 // Save adds a session token and data to the QLStore instance with the given expiry time.
 // If the session token already exists then the data and expiry time are updated.
 func (q *QLStore) Save(token string, b []byte, expiry time.Time) error {
-	_, ok, _ := q.Find(token)
-	if ok {
-		_, err := execTx(q.DB, `
-		UPDATE sessions data=$2,expiry=$3 WHERE token=$1
-		`, token, b, expiry)
+	return q.SaveCtx(context.Background(), token, b, expiry)
+}
+
+// SaveCtx is the context-aware version of Save. It increments the version, treating
+// a missing one as 0.
+func (q *QLStore) SaveCtx(ctx context.Context, token string, b []byte, expiry time.Time) (err error) {
+	tx, err := q.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var current sql.NullInt64
+	err = tx.QueryRowContext(ctx, "SELECT version FROM sessions WHERE token=$1", token).Scan(&current)
+	if err == sql.ErrNoRows {
+		_, err = tx.ExecContext(ctx, "INSERT INTO sessions (token, data, expiry, version) VALUES ($1,$2,$3,$4)", token, b, expiry, int64(1))
+		return err
+	} else if err != nil {
 		return err
 	}
-	_, err := execTx(q.DB, `
-	INSERT INTO sessions (token , data, expiry) VALUES ($1,$2,$3)
-	`, token, b, expiry)
+	_, err = tx.ExecContext(ctx, "UPDATE sessions data=$2,expiry=$3,version=$4 WHERE token=$1", token, b, expiry, current.Int64+1)
 	return err
 }
 
+// FindVersion returns the data and version for a given session token. The version is
+// incremented by every Save and SaveIfVersion, and is 0 if the session token is not
+// found or is expired.
+func (q *QLStore) FindVersion(ctx context.Context, token string) (b []byte, version int64, found bool, err error) {
+	var v sql.NullInt64
+	query := "SELECT data, version FROM sessions WHERE token=$1 AND now()<expiry"
+	err = q.QueryRowContext(ctx, query, token).Scan(&b, &v)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, 0, false, nil
+		}
+		return nil, 0, false, err
+	}
+	return b, v.Int64, true, nil
+}
+
+// SaveIfVersion saves the data for a given session token only if its current version
+// equals version, and returns the new version. If the versions differ nothing is
+// saved and ok is false. The check and the write run in a single transaction.
+func (q *QLStore) SaveIfVersion(ctx context.Context, token string, b []byte, expiry time.Time, version int64) (newVersion int64, ok bool, err error) {
+	tx, err := q.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	defer func() {
+		if ok {
+			err = tx.Commit()
+			ok = err == nil
+		} else {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var current sql.NullInt64
+	var exp time.Time
+	exists := true
+	err = tx.QueryRowContext(ctx, "SELECT version, expiry FROM sessions WHERE token=$1", token).Scan(&current, &exp)
+	if err == sql.ErrNoRows {
+		exists = false
+	} else if err != nil {
+		return 0, false, err
+	}
+	if !exists || !time.Now().Before(exp) {
+		current.Int64 = 0
+	}
+	if current.Int64 != version {
+		return 0, false, nil
+	}
+
+	if exists {
+		_, err = tx.ExecContext(ctx, "UPDATE sessions data=$2,expiry=$3,version=$4 WHERE token=$1", token, b, expiry, version+1)
+	} else {
+		_, err = tx.ExecContext(ctx, "INSERT INTO sessions (token, data, expiry, version) VALUES ($1,$2,$3,$4)", token, b, expiry, version+1)
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return version + 1, true, nil
+}
+
+// Loads 加载所有未过期的session
+func (q *QLStore) Loads() ([][]byte, error) {
+	return q.LoadsCtx(context.Background())
+}
+
+// LoadsCtx 加载所有未过期的session
+func (q *QLStore) LoadsCtx(ctx context.Context) ([][]byte, error) {
+	rows, err := q.QueryContext(ctx, "SELECT data FROM sessions WHERE now()<expiry")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var bs [][]byte
+	for rows.Next() {
+		var b []byte
+		if err = rows.Scan(&b); err != nil {
+			return bs, err
+		}
+		bs = append(bs, b)
+	}
+	return bs, rows.Err()
+}
+
+// Scan calls fn for every unexpired session, streaming the rows from a single query
+// instead of loading them all into memory. Scan stops and returns the error if fn
+// returns one.
+func (q *QLStore) Scan(ctx context.Context, fn func(token string, b []byte) error) error {
+	rows, err := q.QueryContext(ctx, "SELECT token, data FROM sessions WHERE now()<expiry")
+	if err != nil {
+		return err
+	}
+	return storeutil.ScanRows(rows, fn)
+}
+
+// QuerySessions returns the unexpired sessions whose expiry time is in [expiryFrom, expiryTo),
+// ordered by expiry time. A zero expiryFrom or expiryTo means no bound. keyEquals holds
+// keys of the session data with their JSON encoded values; ql has no JSON functions, so
+// they are checked in Go on the data encoded by session.JSONCodec. They and the match
+// func, if not nil, filter the sessions before offset and limit (0 means no limit) are
+// applied; without them everything is executed by the database.
+func (q *QLStore) QuerySessions(ctx context.Context, expiryFrom, expiryTo time.Time, keyEquals map[string]string, offset, limit int, match func(token string, b []byte) bool) ([]string, [][]byte, error) {
+	match = storeutil.MatchKeys(keyEquals, match)
+	stmt := "SELECT token, data FROM sessions WHERE now()<expiry"
+	var args []interface{}
+	if !expiryFrom.IsZero() {
+		args = append(args, expiryFrom)
+		stmt += " AND expiry>=$" + strconv.Itoa(len(args))
+	}
+	if !expiryTo.IsZero() {
+		args = append(args, expiryTo)
+		stmt += " AND expiry<$" + strconv.Itoa(len(args))
+	}
+	stmt += " ORDER BY expiry"
+	if match == nil {
+		if limit > 0 {
+			args = append(args, limit)
+			stmt += " LIMIT $" + strconv.Itoa(len(args))
+		}
+		if offset > 0 {
+			args = append(args, offset)
+			stmt += " OFFSET $" + strconv.Itoa(len(args))
+			offset = 0
+		}
+	}
+
+	rows, err := q.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return storeutil.Collect(rows, offset, limit, match)
+}
+
+// Dumps 数据存储
+func (q *QLStore) Dumps() error {
+	return nil
+}
+
+// DumpsCtx 数据存储
+func (q *QLStore) DumpsCtx(ctx context.Context) error {
+	return nil
+}
+
 func execTx(db *sql.DB, query string, args ...interface{}) (sql.Result, error) {
-	tx, err := db.Begin()
+	return execTxCtx(context.Background(), db, query, args...)
+}
+
+func execTxCtx(ctx context.Context, db *sql.DB, query string, args ...interface{}) (sql.Result, error) {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
 	defer func() {
 		_ = tx.Commit()
 	}()
-	r, err := tx.Exec(query, args...)
+	r, err := tx.ExecContext(ctx, query, args...)
 	return r, err
 }
 
@@ -137,7 +321,8 @@ func Table() string {
 	CREATE TABLE sessions (
 		token string,
 		data blob,
-		expiry time
+		expiry time,
+		version int64
 	)
 	`
 }
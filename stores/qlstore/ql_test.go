@@ -2,6 +2,7 @@ package qlstore
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"os"
 	"reflect"
@@ -31,7 +32,7 @@ func TestFind(t *testing.T) {
 	}
 	ex := time.Now().Add(time.Minute)
 	_, err = execTx(db,
-		`INSERT INTO sessions VALUES("session_token", $1,$2 )`,
+		`INSERT INTO sessions (token, data, expiry) VALUES("session_token", $1,$2 )`,
 		[]byte("encoded_data"), ex)
 	if err != nil {
 		t.Fatal(err)
@@ -132,7 +133,7 @@ func TestSaveUpdated(t *testing.T) {
 
 	ex := time.Now().Add(time.Minute)
 	_, err = execTx(db,
-		`INSERT INTO sessions VALUES("session_token", $1,$2 )`,
+		`INSERT INTO sessions (token, data, expiry) VALUES("session_token", $1,$2 )`,
 		[]byte("encoded_data"), ex)
 	if err != nil {
 		t.Fatal(err)
@@ -210,7 +211,7 @@ func TestDelete(t *testing.T) {
 
 	ex := time.Now().Add(time.Minute)
 	_, err = execTx(db,
-		`INSERT INTO sessions VALUES("session_token", $1,$2 )`,
+		`INSERT INTO sessions (token, data, expiry) VALUES("session_token", $1,$2 )`,
 		[]byte("encoded_data"), ex)
 	if err != nil {
 		t.Fatal(err)
@@ -313,3 +314,66 @@ func migrate(t *testing.T, db *sql.DB) {
 		t.Error(err)
 	}
 }
+
+func TestSaveIfVersion(t *testing.T) {
+	dsn := os.Getenv("SESSION_QL_TEST_DSN")
+	if dsn == "" {
+		dsn = "test.db"
+	}
+	db, err := sql.Open("ql-mem", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	migrate(t, db)
+	_, err = execTx(db, "TRUNCATE TABLE sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := New(db, 0)
+
+	ctx := context.Background()
+	expiry := time.Now().Add(time.Minute)
+
+	version, ok, err := p.SaveIfVersion(ctx, "session_token", []byte("v1"), expiry, 0)
+	if err != nil || !ok || version != 1 {
+		t.Fatalf("got %d %v %v: expected version 1", version, ok, err)
+	}
+	_, ok, err = p.SaveIfVersion(ctx, "session_token", []byte("stale"), expiry, 0)
+	if err != nil || ok {
+		t.Fatalf("got %v %v: expected a conflict", ok, err)
+	}
+	version, ok, err = p.SaveIfVersion(ctx, "session_token", []byte("v2"), expiry, 1)
+	if err != nil || !ok || version != 2 {
+		t.Fatalf("got %d %v %v: expected version 2", version, ok, err)
+	}
+	b, version, found, err := p.FindVersion(ctx, "session_token")
+	if err != nil || !found || version != 2 || !bytes.Equal(b, []byte("v2")) {
+		t.Fatalf("got %s %d %v %v: expected v2 at version 2", b, version, found, err)
+	}
+
+	err = p.Delete("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok, err = p.SaveIfVersion(ctx, "session_token", []byte("v3"), expiry, 2)
+	if err != nil || ok {
+		t.Fatalf("got %v %v: expected a conflict on a deleted session", ok, err)
+	}
+
+	// an expired session is replaced by a new one
+	err = p.Save("expired_token", []byte("expired"), time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, ok, err = p.SaveIfVersion(ctx, "expired_token", []byte("v1"), expiry, 0)
+	if err != nil || !ok || version != 1 {
+		t.Fatalf("got %d %v %v: expected version 1", version, ok, err)
+	}
+}
@@ -9,6 +9,9 @@
 package redisstore
 
 import (
+	"context"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
@@ -18,6 +21,20 @@ import (
 // a naming clash.
 var Prefix = "scs:session:"
 
+// VersionPrefix controls the Redis key prefix of the session versions used by
+// FindVersion and SaveIfVersion. It must not start with Prefix, or Scan would
+// return the versions as sessions.
+var VersionPrefix = "scs:version:"
+
+// LockPrefix controls the Redis key prefix of the locks taken by Lock.
+var LockPrefix = "scs:lock:"
+
+// FenceKey is the Redis key of the counter the fencing tokens returned by Lock are taken from.
+var FenceKey = "scs:fence"
+
+// LockRetryInterval is how long Lock waits before trying again to take a held lock.
+var LockRetryInterval = 10 * time.Millisecond
+
 // RedisStore represents the currently configured session session store. It is essentially
 // a wrapper around a Redigo connection pool.
 type RedisStore struct {
@@ -33,10 +50,19 @@ func New(pool *redis.Pool) *RedisStore {
 // Find returns the data for a given session token from the RedisStore instance. If the session
 // token is not found or is expired, the returned exists flag will be set to false.
 func (r *RedisStore) Find(token string) (b []byte, exists bool, err error) {
-	conn := r.pool.Get()
+	return r.FindCtx(context.Background(), token)
+}
+
+// FindCtx is the context-aware version of Find. If ctx carries a deadline, it is used
+// as the timeout of the Redis command.
+func (r *RedisStore) FindCtx(ctx context.Context, token string) (b []byte, exists bool, err error) {
+	conn, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return nil, false, err
+	}
 	defer conn.Close()
 
-	b, err = redis.Bytes(conn.Do("GET", Prefix+token))
+	b, err = redis.Bytes(do(ctx, conn, "GET", Prefix+token))
 	if err == redis.ErrNil {
 		return nil, false, nil
 	} else if err != nil {
@@ -47,18 +73,29 @@ func (r *RedisStore) Find(token string) (b []byte, exists bool, err error) {
 
 // Loads 加载所有
 func (r *RedisStore) Loads() (bs [][]byte, err error) {
-	conn := r.pool.Get()
+	return r.LoadsCtx(context.Background())
+}
+
+// LoadsCtx 加载所有,ctx结束后停止加载
+func (r *RedisStore) LoadsCtx(ctx context.Context) (bs [][]byte, err error) {
+	conn, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
 	defer conn.Close()
 	var ss []string
-	ss, err = redis.Strings(conn.Do("KEYS", Prefix+"*"))
+	ss, err = redis.Strings(do(ctx, conn, "KEYS", Prefix+"*"))
 	if err == redis.ErrNil {
 		return nil, nil
 	} else if err != nil {
 		return nil, err
 	}
 	for _, s := range ss {
+		if err = ctx.Err(); err != nil {
+			return bs, err
+		}
 		var b []byte
-		b, err = redis.Bytes(conn.Do("GET", s))
+		b, err = redis.Bytes(do(ctx, conn, "GET", s))
 		if err != nil {
 			continue
 		}
@@ -67,21 +104,85 @@ func (r *RedisStore) Loads() (bs [][]byte, err error) {
 	return
 }
 
+// ScanCount is the COUNT hint passed to each SCAN call made by Scan.
+var ScanCount = 100
+
+// Scan calls fn for every session in the RedisStore instance. Unlike Loads it walks the
+// keyspace with SCAN and fetches each page with a single MGET, so it doesn't block Redis
+// on large deployments. Scan stops and returns the error if fn returns one.
+func (r *RedisStore) Scan(ctx context.Context, fn func(token string, b []byte) error) error {
+	conn, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	cursor := 0
+	for {
+		values, err := redis.Values(do(ctx, conn, "SCAN", cursor, "MATCH", Prefix+"*", "COUNT", ScanCount))
+		if err != nil {
+			return err
+		}
+		var keys []string
+		if _, err = redis.Scan(values, &cursor, &keys); err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			args := make([]interface{}, len(keys))
+			for i, k := range keys {
+				args[i] = k
+			}
+			bs, err := redis.ByteSlices(do(ctx, conn, "MGET", args...))
+			if err != nil {
+				return err
+			}
+			for i, b := range bs {
+				// expired between SCAN and MGET
+				if b == nil {
+					continue
+				}
+				if err = fn(keys[i][len(Prefix):], b); err != nil {
+					return err
+				}
+			}
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
 // Dumps 数据存储
 func (r *RedisStore) Dumps() (err error) {
-	conn := r.pool.Get()
+	return r.DumpsCtx(context.Background())
+}
+
+// DumpsCtx 数据存储
+func (r *RedisStore) DumpsCtx(ctx context.Context) (err error) {
+	conn, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
 	defer conn.Close()
-	_, err = conn.Do("BGSAVE")
+	_, err = do(ctx, conn, "BGSAVE")
 	return
 }
 
 // Save adds a session token and data to the RedisStore instance with the given expiry time.
 // If the session token already exists then the data and expiry time are updated.
 func (r *RedisStore) Save(token string, b []byte, expiry time.Time) error {
-	conn := r.pool.Get()
+	return r.SaveCtx(context.Background(), token, b, expiry)
+}
+
+// SaveCtx is the context-aware version of Save.
+func (r *RedisStore) SaveCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	conn, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
 	defer conn.Close()
 
-	err := conn.Send("MULTI")
+	err = conn.Send("MULTI")
 	if err != nil {
 		return err
 	}
@@ -93,19 +194,324 @@ func (r *RedisStore) Save(token string, b []byte, expiry time.Time) error {
 	if err != nil {
 		return err
 	}
-	_, err = conn.Do("EXEC")
+	err = conn.Send("INCR", VersionPrefix+token)
+	if err != nil {
+		return err
+	}
+	err = conn.Send("PEXPIREAT", VersionPrefix+token, makeMillisecondTimestamp(expiry))
+	if err != nil {
+		return err
+	}
+	_, err = do(ctx, conn, "EXEC")
 	return err
 }
 
+// FindVersion returns the data and version for a given session token. The version is
+// incremented by every save, and is 0 if the session token is not found or is expired.
+func (r *RedisStore) FindVersion(ctx context.Context, token string) (b []byte, version int64, found bool, err error) {
+	conn, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	defer conn.Close()
+
+	values, err := redis.Values(do(ctx, conn, "MGET", Prefix+token, VersionPrefix+token))
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if values[0] == nil {
+		return nil, 0, false, nil
+	}
+	b, err = redis.Bytes(values[0], nil)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if values[1] != nil {
+		version, err = redis.Int64(values[1], nil)
+		if err != nil {
+			return nil, 0, false, err
+		}
+	}
+	return b, version, true, nil
+}
+
+// saveIfVersionSrc checks and increments the version atomically. It returns -1 if
+// the version in KEYS[2] doesn't match ARGV[2]. A missing session is at version 0.
+const saveIfVersionSrc = `
+local current = 0
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	current = tonumber(redis.call("GET", KEYS[2]) or "0")
+end
+if current ~= tonumber(ARGV[2]) then
+	return -1
+end
+redis.call("SET", KEYS[1], ARGV[1])
+redis.call("PEXPIREAT", KEYS[1], ARGV[3])
+redis.call("SET", KEYS[2], current + 1)
+redis.call("PEXPIREAT", KEYS[2], ARGV[3])
+return current + 1
+`
+
+var saveIfVersionScript = redis.NewScript(2, saveIfVersionSrc)
+
+// SaveIfVersion saves the data for a given session token only if its current version
+// equals version, and returns the new version. If the versions differ nothing is
+// saved and ok is false.
+func (r *RedisStore) SaveIfVersion(ctx context.Context, token string, b []byte, expiry time.Time, version int64) (newVersion int64, ok bool, err error) {
+	conn, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	defer conn.Close()
+
+	newVersion, err = redis.Int64(eval(ctx, conn, saveIfVersionScript, saveIfVersionSrc, 2, Prefix+token, VersionPrefix+token, b, version, makeMillisecondTimestamp(expiry)))
+	if err != nil {
+		return 0, false, err
+	}
+	if newVersion < 0 {
+		return 0, false, nil
+	}
+	return newVersion, true, nil
+}
+
 // Delete removes a session token and corresponding data from the ResisStore instance.
 func (r *RedisStore) Delete(token string) error {
-	conn := r.pool.Get()
+	return r.DeleteCtx(context.Background(), token)
+}
+
+// DeleteCtx is the context-aware version of Delete.
+func (r *RedisStore) DeleteCtx(ctx context.Context, token string) error {
+	conn, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = do(ctx, conn, "DEL", Prefix+token, VersionPrefix+token)
+	return err
+}
+
+// do runs a command on conn. The deadline of ctx, if any, is used as the command timeout.
+func do(ctx context.Context, conn redis.Conn, cmd string, args ...interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		return redis.DoWithTimeout(conn, time.Until(deadline), cmd, args...)
+	}
+	return conn.Do(cmd, args...)
+}
+
+// lockSrc takes the lock in KEYS[1] for ARGV[1] milliseconds if it is free, with a
+// fencing token from an INCR on KEYS[2]. It returns the fencing token, or 0 if the
+// lock is held.
+const lockSrc = `
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+local fence = redis.call("INCR", KEYS[2])
+redis.call("SET", KEYS[1], fence, "PX", ARGV[1])
+return fence
+`
+
+var lockScript = redis.NewScript(2, lockSrc)
+
+// Lock takes the lock on key with a PX expiry, so it is released automatically after
+// ttl. The value of the lock is a fencing token taken from an INCR on FenceKey once
+// the lock is free, so it is greater than the token of every previous holder. If the
+// lock is held, Lock polls every LockRetryInterval until it gets the lock or ctx is
+// done; the waiters don't take fencing tokens.
+func (r *RedisStore) Lock(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	conn, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	px := int64(ttl / time.Millisecond)
+	if px < 1 {
+		px = 1
+	}
+	for {
+		fence, err := redis.Int64(eval(ctx, conn, lockScript, lockSrc, 2, LockPrefix+key, FenceKey, px))
+		if err != nil {
+			return 0, err
+		}
+		if fence > 0 {
+			return fence, nil
+		}
+
+		t := time.NewTimer(LockRetryInterval)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// unlockSrc deletes the lock in KEYS[1] only if it still holds the fencing token ARGV[1].
+const unlockSrc = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`
+
+var unlockScript = redis.NewScript(1, unlockSrc)
+
+// Unlock releases the lock on key if it is still held with the fencing token fence.
+// A lock which has expired and been taken by another holder is left alone.
+func (r *RedisStore) Unlock(ctx context.Context, key string, fence int64) error {
+	conn, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = eval(ctx, conn, unlockScript, unlockSrc, 1, LockPrefix+key, fence)
+	return err
+}
+
+// eval runs script, whose source is src and which takes keyCount keys, on conn like
+// Script.Do, using the deadline of ctx as the command timeout.
+func eval(ctx context.Context, conn redis.Conn, script *redis.Script, src string, keyCount int, keysAndArgs ...interface{}) (interface{}, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return script.Do(conn, keysAndArgs...)
+	}
+	args := append([]interface{}{script.Hash(), keyCount}, keysAndArgs...)
+	reply, err := do(ctx, conn, "EVALSHA", args...)
+	if e, ok := err.(redis.Error); ok && strings.HasPrefix(string(e), "NOSCRIPT ") {
+		// the script source is sent once, Redis caches it for the next EVALSHA
+		args[0] = src
+		reply, err = do(ctx, conn, "EVAL", args...)
+	}
+	return reply, err
+}
+
+// InvalidatorRetryInterval is how long an Invalidator waits before subscribing again
+// after its connection failed.
+var InvalidatorRetryInterval = time.Second
+
+// Invalidator publishes and receives messages on a Redis pub/sub channel. It is used
+// by tieredstore to drop the sessions changed by other instances from their local tier.
+type Invalidator struct {
+	pool    *redis.Pool
+	channel string
+}
+
+// NewInvalidator returns an Invalidator using channel. Each subscription holds a
+// connection of pool.
+func NewInvalidator(pool *redis.Pool, channel string) *Invalidator {
+	return &Invalidator{pool: pool, channel: channel}
+}
+
+// Publish sends msg to the channel with PUBLISH.
+func (i *Invalidator) Publish(ctx context.Context, msg string) error {
+	conn, err := i.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
 	defer conn.Close()
 
-	_, err := conn.Do("DEL", Prefix+token)
+	_, err = do(ctx, conn, "PUBLISH", i.channel, msg)
 	return err
 }
 
+// Subscribe calls fn in a goroutine with every message sent to the channel, until
+// cancel is called. If the connection fails, it subscribes again after
+// InvalidatorRetryInterval; the messages sent in between are lost.
+func (i *Invalidator) Subscribe(fn func(msg string)) (cancel func(), err error) {
+	psc, err := i.subscribe()
+	if err != nil {
+		return nil, err
+	}
+	s := &subscription{psc: psc, stop: make(chan struct{})}
+	go s.run(i, fn)
+	return s.cancel, nil
+}
+
+// subscription is a subscription of an Invalidator.
+type subscription struct {
+	mu   sync.Mutex
+	psc  redis.PubSubConn
+	stop chan struct{}
+	once sync.Once
+}
+
+func (s *subscription) run(i *Invalidator, fn func(msg string)) {
+	for {
+		s.mu.Lock()
+		psc := s.psc
+		s.mu.Unlock()
+		receive(psc, fn)
+		psc.Close()
+
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(InvalidatorRetryInterval):
+			}
+			psc, err := i.subscribe()
+			if err != nil {
+				continue
+			}
+			s.mu.Lock()
+			select {
+			case <-s.stop:
+				// canceled while subscribing
+				s.mu.Unlock()
+				psc.Close()
+				return
+			default:
+			}
+			s.psc = psc
+			s.mu.Unlock()
+			break
+		}
+	}
+}
+
+// receive calls fn with the messages received on psc, until it is unsubscribed or
+// fails.
+func receive(psc redis.PubSubConn, fn func(msg string)) {
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			fn(string(v.Data))
+		case redis.Subscription:
+			if v.Count == 0 {
+				return
+			}
+		case error:
+			return
+		}
+	}
+}
+
+func (s *subscription) cancel() {
+	s.once.Do(func() {
+		close(s.stop)
+		s.mu.Lock()
+		s.psc.Unsubscribe()
+		s.mu.Unlock()
+	})
+}
+
+func (i *Invalidator) subscribe() (redis.PubSubConn, error) {
+	psc := redis.PubSubConn{Conn: i.pool.Get()}
+	if err := psc.Subscribe(i.channel); err != nil {
+		psc.Close()
+		return redis.PubSubConn{}, err
+	}
+	return psc, nil
+}
+
 func makeMillisecondTimestamp(t time.Time) int64 {
 	return t.UnixNano() / (int64(time.Millisecond) / int64(time.Nanosecond))
 }
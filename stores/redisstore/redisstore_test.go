@@ -2,6 +2,7 @@ package redisstore
 
 import (
 	"bytes"
+	"context"
 	"os"
 	"reflect"
 	"testing"
@@ -223,3 +224,149 @@ func TestDelete(t *testing.T) {
 		t.Fatalf("got %v: expected %v", data, nil)
 	}
 }
+
+func TestSaveIfVersion(t *testing.T) {
+	redisPool := redis.NewPool(func() (redis.Conn, error) {
+		addr := os.Getenv("SESSION_REDIS_TEST_ADDR")
+		conn, err := redis.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return conn, err
+	}, 1)
+	defer redisPool.Close()
+
+	conn := redisPool.Get()
+	defer conn.Close()
+	_, err := conn.Do("FLUSHDB")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := New(redisPool)
+	ctx := context.Background()
+	expiry := time.Now().Add(time.Minute)
+
+	version, ok, err := r.SaveIfVersion(ctx, "session_token", []byte("v1"), expiry, 0)
+	if err != nil || !ok || version != 1 {
+		t.Fatalf("got %d %v %v: expected version 1", version, ok, err)
+	}
+	_, ok, err = r.SaveIfVersion(ctx, "session_token", []byte("stale"), expiry, 0)
+	if err != nil || ok {
+		t.Fatalf("got %v %v: expected a conflict", ok, err)
+	}
+	err = r.Save("session_token", []byte("v2"), expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, version, found, err := r.FindVersion(ctx, "session_token")
+	if err != nil || !found || version != 2 || !bytes.Equal(b, []byte("v2")) {
+		t.Fatalf("got %s %d %v %v: expected v2 at version 2", b, version, found, err)
+	}
+
+	err = r.Delete("session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok, err = r.SaveIfVersion(ctx, "session_token", []byte("v3"), expiry, 2)
+	if err != nil || ok {
+		t.Fatalf("got %v %v: expected a conflict on a deleted session", ok, err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	redisPool := redis.NewPool(func() (redis.Conn, error) {
+		addr := os.Getenv("SESSION_REDIS_TEST_ADDR")
+		conn, err := redis.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return conn, err
+	}, 2)
+	defer redisPool.Close()
+
+	conn := redisPool.Get()
+	_, err := conn.Do("FLUSHDB")
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := New(redisPool)
+	ctx := context.Background()
+
+	fence, err := r.Lock(ctx, "session_token", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	_, err = r.Lock(wctx, "session_token", time.Minute)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v: expected %v", err, context.DeadlineExceeded)
+	}
+
+	// a stale holder can't release the lock
+	err = r.Unlock(ctx, "session_token", fence-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wctx, cancel = context.WithTimeout(ctx, 50*time.Millisecond)
+	_, err = r.Lock(wctx, "session_token", time.Minute)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v: expected the lock to be still held", err)
+	}
+
+	err = r.Unlock(ctx, "session_token", fence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := r.Lock(ctx, "session_token", 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the waiters didn't take fencing tokens
+	if next != fence+1 {
+		t.Fatalf("got fence %d: expected %d", next, fence+1)
+	}
+
+	// the lock expires after ttl
+	_, err = r.Lock(ctx, "session_token", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInvalidator(t *testing.T) {
+	redisPool := redis.NewPool(func() (redis.Conn, error) {
+		addr := os.Getenv("SESSION_REDIS_TEST_ADDR")
+		conn, err := redis.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return conn, err
+	}, 2)
+	defer redisPool.Close()
+
+	inv := NewInvalidator(redisPool, "scs:test:invalidate")
+	msgs := make(chan string, 1)
+	cancel, err := inv.Subscribe(func(msg string) { msgs <- msg })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	err = inv.Publish(context.Background(), "session_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-msgs:
+		if msg != "session_token" {
+			t.Fatalf("got %q: expected %q", msg, "session_token")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the message to be received")
+	}
+}
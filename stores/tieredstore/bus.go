@@ -0,0 +1,63 @@
+package tieredstore
+
+import (
+	"context"
+	"sync"
+)
+
+// Invalidator broadcasts the session tokens changed by an instance, so that the other
+// instances drop them from their local tier. redisstore.NewInvalidator (pub/sub) and
+// pgstore.NewInvalidator (LISTEN/NOTIFY) implement it between processes, Bus within
+// a process.
+//
+// Delivery is best effort: a message lost while an instance reconnects leaves its
+// local copy stale until the local TTL expires.
+type Invalidator interface {
+	// Publish sends msg to the subscribers of every instance, including this one.
+	Publish(ctx context.Context, msg string) error
+	// Subscribe calls fn with every message published until cancel is called.
+	Subscribe(fn func(msg string)) (cancel func(), err error)
+}
+
+// Bus is an in-process Invalidator, for tests and for several stores in one process.
+type Bus struct {
+	mu   sync.Mutex
+	next int
+	subs map[int]func(msg string)
+}
+
+// NewBus returns an empty Bus.
+func NewBus() *Bus {
+	return &Bus{subs: make(map[int]func(msg string))}
+}
+
+// Publish calls the subscribers with msg before it returns.
+func (b *Bus) Publish(ctx context.Context, msg string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	fns := make([]func(msg string), 0, len(b.subs))
+	for _, fn := range b.subs {
+		fns = append(fns, fn)
+	}
+	b.mu.Unlock()
+	for _, fn := range fns {
+		fn(msg)
+	}
+	return nil
+}
+
+// Subscribe adds fn to the subscribers.
+func (b *Bus) Subscribe(fn func(msg string)) (func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.next
+	b.next++
+	b.subs[id] = fn
+	return func() {
+		b.mu.Lock()
+		delete(b.subs, id)
+		b.mu.Unlock()
+	}, nil
+}
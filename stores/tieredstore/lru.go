@@ -0,0 +1,125 @@
+package tieredstore
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// LRU is a bounded in-memory store for the local tier. When it is full, saving a new
+// session token evicts the least recently used one.
+type LRU struct {
+	mu      sync.Mutex
+	size    int
+	ll      *list.List
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	token  string
+	b      []byte
+	expiry time.Time
+}
+
+// NewLRU returns an LRU holding at most size session tokens.
+func NewLRU(size int) *LRU {
+	return &LRU{
+		size:    size,
+		ll:      list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Find returns the data for a session token. Expired data is removed and not found.
+func (l *LRU) Find(token string) ([]byte, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	el, ok := l.entries[token]
+	if !ok {
+		return nil, false, nil
+	}
+	e := el.Value.(*lruEntry)
+	if !e.expiry.After(time.Now()) {
+		l.remove(el)
+		return nil, false, nil
+	}
+	l.ll.MoveToFront(el)
+	return e.b, true, nil
+}
+
+// Save adds or updates the data of a session token, evicting the least recently
+// used token if the LRU is full.
+func (l *LRU) Save(token string, b []byte, expiry time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if el, ok := l.entries[token]; ok {
+		e := el.Value.(*lruEntry)
+		e.b, e.expiry = b, expiry
+		l.ll.MoveToFront(el)
+		return nil
+	}
+	l.entries[token] = l.ll.PushFront(&lruEntry{token: token, b: b, expiry: expiry})
+	for l.size > 0 && l.ll.Len() > l.size {
+		l.remove(l.ll.Back())
+	}
+	return nil
+}
+
+// Delete removes a session token.
+func (l *LRU) Delete(token string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if el, ok := l.entries[token]; ok {
+		l.remove(el)
+	}
+	return nil
+}
+
+func (l *LRU) remove(el *list.Element) {
+	l.ll.Remove(el)
+	delete(l.entries, el.Value.(*lruEntry).token)
+}
+
+// Len returns the number of session tokens held, including expired ones not yet
+// removed.
+func (l *LRU) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ll.Len()
+}
+
+// Dumps is a no-op, the local tier is only a cache.
+func (l *LRU) Dumps() error {
+	return nil
+}
+
+// Loads returns nothing, the local tier is only a cache.
+func (l *LRU) Loads() ([][]byte, error) {
+	return nil, nil
+}
+
+// FindCtx is the context-aware version of Find.
+func (l *LRU) FindCtx(ctx context.Context, token string) ([]byte, bool, error) {
+	return l.Find(token)
+}
+
+// SaveCtx is the context-aware version of Save.
+func (l *LRU) SaveCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	return l.Save(token, b, expiry)
+}
+
+// DeleteCtx is the context-aware version of Delete.
+func (l *LRU) DeleteCtx(ctx context.Context, token string) error {
+	return l.Delete(token)
+}
+
+// DumpsCtx is the context-aware version of Dumps.
+func (l *LRU) DumpsCtx(ctx context.Context) error {
+	return nil
+}
+
+// LoadsCtx is the context-aware version of Loads.
+func (l *LRU) LoadsCtx(ctx context.Context) ([][]byte, error) {
+	return nil, nil
+}
@@ -0,0 +1,497 @@
+// Package tieredstore is a two-tier session store for the SCS session package. A local
+// in-memory store (an LRU, memstore, ...) caches the sessions of a remote store
+// (redisstore, mysqlstore, ...), so that hot sessions are read without a round trip:
+//
+//	store, err := tieredstore.New(tieredstore.NewLRU(10000), redisstore.New(pool), tieredstore.Config{
+//		TTL:         5 * time.Second,
+//		Invalidator: redisstore.NewInvalidator(pool, "scs:invalidate"),
+//	})
+//
+// Sessions are kept in the local tier for at most TTL, which bounds how long an
+// instance may read a session changed by another instance. With an Invalidator, the
+// tokens saved or deleted by an instance are published, and the other instances drop
+// them from their local tier at once. The stores don't return the expiry of the
+// sessions they find, so a session read from the remote store is kept for TTL even if
+// it expires sooner there: it may still be found locally for up to TTL after it
+// expired.
+//
+// In WriteThrough mode Save writes the remote store before it returns. In WriteBehind
+// mode Save only writes the local tier, and the writes are flushed to the remote store
+// in the background every FlushInterval, coalescing the writes of a token; the writes
+// not flushed yet are lost if the process crashes. Delete always writes through.
+//
+// FindVersion and SaveIfVersion, used by optimistic locking, always read and write
+// the remote store.
+package tieredstore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipiao/session/stores/internal/storeutil"
+)
+
+// Store is the interface of the local and remote stores, the same as session.Store.
+type Store = storeutil.Store
+
+// Mode is how Save writes the remote store.
+type Mode int
+
+const (
+	// WriteThrough saves to the remote store before Save returns.
+	WriteThrough Mode = iota
+	// WriteBehind saves to the remote store in the background.
+	WriteBehind
+)
+
+const (
+	// DefaultTTL is the TTL of the local tier when Config.TTL is 0.
+	DefaultTTL = 5 * time.Second
+	// DefaultFlushInterval is the flush interval of WriteBehind when
+	// Config.FlushInterval is 0.
+	DefaultFlushInterval = time.Second
+	// DefaultSize is the size of the LRU used when the local store is nil.
+	DefaultSize = 10000
+)
+
+// Config configures a TieredStore.
+type Config struct {
+	// TTL is how long a session is kept in the local tier, DefaultTTL if 0. It is
+	// also how long a session read from the remote store may outlive its expiry.
+	TTL time.Duration
+	// Mode is how Save writes the remote store, WriteThrough by default.
+	Mode Mode
+	// FlushInterval is how often the writes are flushed in WriteBehind mode,
+	// DefaultFlushInterval if 0.
+	FlushInterval time.Duration
+	// Invalidator broadcasts the tokens saved and deleted to the other instances.
+	// Without it, they see the changes after at most TTL.
+	Invalidator Invalidator
+	// OnError is called with the errors of the background writes and of publishing
+	// the invalidations, which have no caller to return them to. They are logged if nil.
+	OnError func(err error)
+}
+
+type pendingWrite struct {
+	b      []byte
+	expiry time.Time
+}
+
+// fill counts the fills of the local tier in progress for a token, and the writes of
+// the token since they started.
+type fill struct {
+	n   int
+	gen uint64
+}
+
+// TieredStore caches the sessions of a remote store in a local store.
+type TieredStore struct {
+	local  Store
+	remote Store
+	cfg    Config
+	id     string // identifies the messages published by this instance
+
+	mu      sync.Mutex
+	pending map[string]pendingWrite
+	// fills has the tokens being read from the remote store to fill the local tier,
+	// see startFill
+	fills map[string]*fill
+	// flushMu is held while flushing, so that a Delete can't be overwritten by
+	// the flush of an older write
+	flushMu sync.Mutex
+
+	unsubscribe func()
+	stop        chan struct{}
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+// New returns a TieredStore caching the sessions of remote in local. If local is nil,
+// an LRU of DefaultSize is used.
+func New(local, remote Store, cfg Config) (*TieredStore, error) {
+	if local == nil {
+		local = NewLRU(DefaultSize)
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = DefaultTTL
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultFlushInterval
+	}
+	if cfg.OnError == nil {
+		cfg.OnError = func(err error) {
+			log.Printf("tieredstore: %v", err)
+		}
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	t := &TieredStore{
+		local:   local,
+		remote:  remote,
+		cfg:     cfg,
+		id:      hex.EncodeToString(id),
+		pending: make(map[string]pendingWrite),
+		fills:   make(map[string]*fill),
+	}
+	if cfg.Invalidator != nil {
+		unsubscribe, err := cfg.Invalidator.Subscribe(t.invalidated)
+		if err != nil {
+			return nil, err
+		}
+		t.unsubscribe = unsubscribe
+	}
+	if cfg.Mode == WriteBehind {
+		t.stop = make(chan struct{})
+		t.done = make(chan struct{})
+		go t.flushLoop()
+	}
+	return t, nil
+}
+
+func (t *TieredStore) localCtx() storeutil.StoreContext {
+	return storeutil.WithContext(t.local)
+}
+
+func (t *TieredStore) remoteCtx() storeutil.StoreContext {
+	return storeutil.WithContext(t.remote)
+}
+
+// localExpiry returns the expiry of a session in the local tier.
+func (t *TieredStore) localExpiry(expiry time.Time) time.Time {
+	if e := time.Now().Add(t.cfg.TTL); expiry.IsZero() || e.Before(expiry) {
+		return e
+	}
+	return expiry
+}
+
+// startFill is called before reading token from the remote store to fill the local
+// tier. It returns the generation of token to pass to endFill.
+func (t *TieredStore) startFill(token string) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f := t.fills[token]
+	if f == nil {
+		f = &fill{}
+		t.fills[token] = f
+	}
+	f.n++
+	return f.gen
+}
+
+// endFill saves b to the local tier, unless token was written or deleted since
+// startFill returned gen: b may then be older than the remote store. A nil b only
+// ends the fill.
+func (t *TieredStore) endFill(ctx context.Context, token string, gen uint64, b []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f := t.fills[token]
+	if f.n--; f.n == 0 {
+		delete(t.fills, token)
+	}
+	if b == nil || f.gen != gen {
+		return
+	}
+	if err := t.localCtx().SaveCtx(ctx, token, b, t.localExpiry(time.Time{})); err != nil {
+		t.cfg.OnError(err)
+	}
+}
+
+// written makes the fills of token in progress skip the local tier. It is called
+// after token is written or deleted in the remote store, and before the local tier.
+// t.mu must be held.
+func (t *TieredStore) written(token string) {
+	if f := t.fills[token]; f != nil {
+		f.gen++
+	}
+}
+
+// publish tells the other instances to drop token from their local tier.
+func (t *TieredStore) publish(ctx context.Context, token string) {
+	if t.cfg.Invalidator == nil {
+		return
+	}
+	err := t.cfg.Invalidator.Publish(context.WithoutCancel(ctx), t.id+" "+token)
+	if err != nil {
+		t.cfg.OnError(err)
+	}
+}
+
+// invalidated drops from the local tier the token of a message published by another
+// instance.
+func (t *TieredStore) invalidated(msg string) {
+	id, token, ok := strings.Cut(msg, " ")
+	if !ok || id == t.id {
+		return
+	}
+	t.mu.Lock()
+	t.written(token)
+	t.mu.Unlock()
+	if err := t.localCtx().DeleteCtx(context.Background(), token); err != nil {
+		t.cfg.OnError(err)
+	}
+}
+
+// Find returns the data for a session token, from the local tier if it is there.
+func (t *TieredStore) Find(token string) ([]byte, bool, error) {
+	return t.FindCtx(context.Background(), token)
+}
+
+// FindCtx is the context-aware version of Find.
+func (t *TieredStore) FindCtx(ctx context.Context, token string) ([]byte, bool, error) {
+	t.mu.Lock()
+	p, ok := t.pending[token]
+	t.mu.Unlock()
+	if ok && p.expiry.After(time.Now()) {
+		return p.b, true, nil
+	}
+	b, found, err := t.localCtx().FindCtx(ctx, token)
+	if err != nil || found {
+		return b, found, err
+	}
+	gen := t.startFill(token)
+	b, found, err = t.remoteCtx().FindCtx(ctx, token)
+	if err != nil || !found {
+		t.endFill(ctx, token, gen, nil)
+		return nil, false, err
+	}
+	t.endFill(ctx, token, gen, b)
+	return b, true, nil
+}
+
+// Save saves the data of a session token to both tiers, to the remote one in the
+// background in WriteBehind mode.
+func (t *TieredStore) Save(token string, b []byte, expiry time.Time) error {
+	return t.SaveCtx(context.Background(), token, b, expiry)
+}
+
+// SaveCtx is the context-aware version of Save.
+func (t *TieredStore) SaveCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	if t.cfg.Mode == WriteBehind {
+		t.mu.Lock()
+		t.pending[token] = pendingWrite{b: b, expiry: expiry}
+		t.written(token)
+		t.mu.Unlock()
+		return t.localCtx().SaveCtx(ctx, token, b, t.localExpiry(expiry))
+	}
+	if err := t.remoteCtx().SaveCtx(ctx, token, b, expiry); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.written(token)
+	t.mu.Unlock()
+	t.publish(ctx, token)
+	return t.localCtx().SaveCtx(ctx, token, b, t.localExpiry(expiry))
+}
+
+// Delete removes a session token from both tiers, from the remote one first, and from
+// the local tier of the other instances.
+func (t *TieredStore) Delete(token string) error {
+	return t.DeleteCtx(context.Background(), token)
+}
+
+// DeleteCtx is the context-aware version of Delete.
+func (t *TieredStore) DeleteCtx(ctx context.Context, token string) error {
+	t.flushMu.Lock()
+	defer t.flushMu.Unlock()
+	t.mu.Lock()
+	delete(t.pending, token)
+	t.mu.Unlock()
+	if err := t.remoteCtx().DeleteCtx(ctx, token); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.written(token)
+	t.mu.Unlock()
+	t.publish(ctx, token)
+	return t.localCtx().DeleteCtx(ctx, token)
+}
+
+// Flush saves to the remote store the writes not flushed yet in WriteBehind mode.
+// The writes which fail are kept to be flushed again.
+func (t *TieredStore) Flush(ctx context.Context) error {
+	t.flushMu.Lock()
+	defer t.flushMu.Unlock()
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = make(map[string]pendingWrite)
+	t.mu.Unlock()
+
+	var errs []error
+	for token, p := range pending {
+		if err := t.flushWrite(ctx, token, p); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// flushToken saves to the remote store the write of a token not flushed yet.
+func (t *TieredStore) flushToken(ctx context.Context, token string) error {
+	t.flushMu.Lock()
+	defer t.flushMu.Unlock()
+	t.mu.Lock()
+	p, ok := t.pending[token]
+	delete(t.pending, token)
+	t.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return t.flushWrite(ctx, token, p)
+}
+
+// flushWrite saves a pending write to the remote store. A write which fails is put
+// back unless the token was written again meanwhile. flushMu must be held.
+func (t *TieredStore) flushWrite(ctx context.Context, token string, p pendingWrite) error {
+	if err := t.remoteCtx().SaveCtx(ctx, token, p.b, p.expiry); err != nil {
+		t.mu.Lock()
+		if _, ok := t.pending[token]; !ok {
+			t.pending[token] = p
+		}
+		t.mu.Unlock()
+		return err
+	}
+	t.mu.Lock()
+	t.written(token)
+	t.mu.Unlock()
+	t.publish(ctx, token)
+	return nil
+}
+
+func (t *TieredStore) flushLoop() {
+	defer close(t.done)
+	ticker := time.NewTicker(t.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.Flush(context.Background()); err != nil {
+				t.cfg.OnError(err)
+			}
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// Dumps flushes the pending writes and calls Dumps of the remote store.
+func (t *TieredStore) Dumps() error {
+	return t.DumpsCtx(context.Background())
+}
+
+// DumpsCtx is the context-aware version of Dumps.
+func (t *TieredStore) DumpsCtx(ctx context.Context) error {
+	if err := t.Flush(ctx); err != nil {
+		return err
+	}
+	return t.remoteCtx().DumpsCtx(ctx)
+}
+
+// Loads flushes the pending writes and returns the data of all sessions of the
+// remote store.
+func (t *TieredStore) Loads() ([][]byte, error) {
+	return t.LoadsCtx(context.Background())
+}
+
+// LoadsCtx is the context-aware version of Loads.
+func (t *TieredStore) LoadsCtx(ctx context.Context) ([][]byte, error) {
+	if err := t.Flush(ctx); err != nil {
+		return nil, err
+	}
+	return t.remoteCtx().LoadsCtx(ctx)
+}
+
+// Scan flushes the pending writes and scans the remote store.
+func (t *TieredStore) Scan(ctx context.Context, fn func(token string, b []byte) error) error {
+	sc, ok := t.remote.(storeutil.Scanner)
+	if !ok {
+		return storeutil.Unsupported(t.remote, "Scan")
+	}
+	if err := t.Flush(ctx); err != nil {
+		return err
+	}
+	return sc.Scan(ctx, fn)
+}
+
+// QuerySessions flushes the pending writes and runs the query on the remote store.
+func (t *TieredStore) QuerySessions(ctx context.Context, expiryFrom, expiryTo time.Time, keyEquals map[string]string, offset, limit int, match func(token string, b []byte) bool) ([]string, [][]byte, error) {
+	qs, ok := t.remote.(storeutil.QueryableStore)
+	if !ok {
+		return nil, nil, storeutil.Unsupported(t.remote, "QuerySessions")
+	}
+	if err := t.Flush(ctx); err != nil {
+		return nil, nil, err
+	}
+	return qs.QuerySessions(ctx, expiryFrom, expiryTo, keyEquals, offset, limit, match)
+}
+
+// FindVersion flushes the pending write of a session token, and returns its data and
+// version from the remote store. The data is cached in the local tier.
+func (t *TieredStore) FindVersion(ctx context.Context, token string) ([]byte, int64, bool, error) {
+	cs, ok := t.remote.(storeutil.CASStore)
+	if !ok {
+		return nil, 0, false, storeutil.Unsupported(t.remote, "FindVersion")
+	}
+	if err := t.flushToken(ctx, token); err != nil {
+		return nil, 0, false, err
+	}
+	gen := t.startFill(token)
+	b, version, found, err := cs.FindVersion(ctx, token)
+	if err != nil || !found {
+		t.endFill(ctx, token, gen, nil)
+		return nil, 0, false, err
+	}
+	t.endFill(ctx, token, gen, b)
+	return b, version, true, nil
+}
+
+// SaveIfVersion saves the data of a session token to the remote store if its version
+// equals version, and then to the local tier. It writes through in both modes.
+func (t *TieredStore) SaveIfVersion(ctx context.Context, token string, b []byte, expiry time.Time, version int64) (int64, bool, error) {
+	cs, ok := t.remote.(storeutil.CASStore)
+	if !ok {
+		return 0, false, storeutil.Unsupported(t.remote, "SaveIfVersion")
+	}
+	t.flushMu.Lock()
+	defer t.flushMu.Unlock()
+	t.mu.Lock()
+	delete(t.pending, token)
+	t.mu.Unlock()
+	newVersion, ok, err := cs.SaveIfVersion(ctx, token, b, expiry, version)
+	t.mu.Lock()
+	t.written(token)
+	t.mu.Unlock()
+	if err != nil || !ok {
+		// the local copy may be the one which is out of date
+		t.localCtx().DeleteCtx(ctx, token)
+		return newVersion, ok, err
+	}
+	t.publish(ctx, token)
+	return newVersion, true, t.localCtx().SaveCtx(ctx, token, b, t.localExpiry(expiry))
+}
+
+// Close stops the background writes after flushing them, unsubscribes from the
+// invalidations, and closes the remote and local stores.
+func (t *TieredStore) Close() error {
+	var errs []error
+	t.closeOnce.Do(func() {
+		if t.stop != nil {
+			close(t.stop)
+			<-t.done
+		}
+		if t.unsubscribe != nil {
+			t.unsubscribe()
+		}
+		errs = append(errs, t.Flush(context.Background()))
+		errs = append(errs, storeutil.Close(t.remote))
+		errs = append(errs, storeutil.Close(t.local))
+	})
+	return errors.Join(errs...)
+}
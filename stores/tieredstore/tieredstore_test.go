@@ -0,0 +1,201 @@
+package tieredstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ipiao/session/stores/internal/storetest"
+	"github.com/ipiao/session/stores/memstore"
+)
+
+func TestLRU(t *testing.T) {
+	l := NewLRU(2)
+	expiry := time.Now().Add(time.Minute)
+	l.Save("a", []byte("a"), expiry)
+	l.Save("b", []byte("b"), expiry)
+	l.Find("a")
+	l.Save("c", []byte("c"), expiry)
+	if _, found, _ := l.Find("b"); found {
+		t.Fatal("expected the least recently used token to be evicted")
+	}
+	if _, found, _ := l.Find("a"); !found || l.Len() != 2 {
+		t.Fatal("expected the recently used token to be kept")
+	}
+
+	l.Save("d", []byte("d"), time.Now().Add(-time.Second))
+	if _, found, _ := l.Find("d"); found {
+		t.Fatal("expected an expired token not to be found")
+	}
+}
+
+func TestFindCaches(t *testing.T) {
+	remote := memstore.New(0)
+	remote.Save("session_token", []byte("encoded_data"), time.Now().Add(time.Minute))
+	ts, err := New(NewLRU(10), remote, Config{TTL: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	b, found, err := ts.Find("session_token")
+	if err != nil || !found || !bytes.Equal(b, []byte("encoded_data")) {
+		t.Fatalf("got %s %v %v: expected the remote data", b, found, err)
+	}
+	remote.Delete("session_token")
+	if _, found, _ = ts.Find("session_token"); !found {
+		t.Fatal("expected the data to be cached")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, found, _ = ts.Find("session_token"); found {
+		t.Fatal("expected the cached data to expire after the TTL")
+	}
+}
+
+// hookStore calls after once after a session is read
+type hookStore struct {
+	*memstore.MemStore
+	after func()
+}
+
+func (s *hookStore) FindCtx(ctx context.Context, token string) ([]byte, bool, error) {
+	b, found, err := s.MemStore.FindCtx(ctx, token)
+	if after := s.after; after != nil {
+		s.after = nil
+		after()
+	}
+	return b, found, err
+}
+
+func TestFindRace(t *testing.T) {
+	remote := &hookStore{MemStore: memstore.New(0)}
+	ts, _ := New(NewLRU(10), remote, Config{TTL: time.Minute})
+	defer ts.Close()
+	expiry := time.Now().Add(time.Minute)
+
+	// 从远程存储器读取之后、写入本地之前删除
+	remote.Save("a", []byte("a1"), expiry)
+	remote.after = func() { ts.Delete("a") }
+	ts.Find("a")
+	if _, found, _ := ts.Find("a"); found {
+		t.Fatal("expected the deleted session not to be cached")
+	}
+
+	// 从远程存储器读取之后、写入本地之前保存
+	remote.Save("b", []byte("b1"), expiry)
+	remote.after = func() { ts.Save("b", []byte("b2"), expiry) }
+	ts.Find("b")
+	if b, _, _ := ts.Find("b"); !bytes.Equal(b, []byte("b2")) {
+		t.Fatalf("got %s: expected the older data not to overwrite the save", b)
+	}
+	if len(ts.fills) != 0 {
+		t.Fatalf("got %d: expected no fills left", len(ts.fills))
+	}
+}
+
+func TestInvalidation(t *testing.T) {
+	remote := memstore.New(0)
+	bus := NewBus()
+	a, _ := New(NewLRU(10), remote, Config{TTL: time.Minute, Invalidator: bus})
+	b, _ := New(memstore.New(0), remote, Config{TTL: time.Minute, Invalidator: bus})
+	defer a.Close()
+	defer b.Close()
+	expiry := time.Now().Add(time.Minute)
+
+	a.Save("session_token", []byte("v1"), expiry)
+	if v, _, _ := b.Find("session_token"); !bytes.Equal(v, []byte("v1")) {
+		t.Fatalf("got %s: expected v1", v)
+	}
+	a.Save("session_token", []byte("v2"), expiry)
+	if v, _, _ := b.Find("session_token"); !bytes.Equal(v, []byte("v2")) {
+		t.Fatalf("got %s: expected the save to invalidate the other instance", v)
+	}
+	if v, _, _ := a.Find("session_token"); !bytes.Equal(v, []byte("v2")) {
+		t.Fatalf("got %s: expected the own message to be ignored", v)
+	}
+	a.Delete("session_token")
+	if _, found, _ := b.Find("session_token"); found {
+		t.Fatal("expected the delete to invalidate the other instance")
+	}
+}
+
+func TestWriteBehind(t *testing.T) {
+	remote := memstore.New(0)
+	var errs []error
+	ts, _ := New(NewLRU(10), remote, Config{
+		Mode:          WriteBehind,
+		FlushInterval: time.Hour,
+		OnError:       func(err error) { errs = append(errs, err) },
+	})
+	expiry := time.Now().Add(time.Minute)
+
+	ts.Save("a", []byte("a1"), expiry)
+	ts.Save("a", []byte("a2"), expiry)
+	ts.Save("b", []byte("b"), expiry)
+	if _, found, _ := remote.Find("a"); found {
+		t.Fatal("expected the write not to be flushed yet")
+	}
+	if v, _, _ := ts.Find("a"); !bytes.Equal(v, []byte("a2")) {
+		t.Fatalf("got %s: expected the pending write", v)
+	}
+	ts.Delete("b")
+	if err := ts.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := remote.Find("a"); !bytes.Equal(v, []byte("a2")) {
+		t.Fatalf("got %s: expected the last write to be flushed", v)
+	}
+	if _, found, _ := remote.Find("b"); found {
+		t.Fatal("expected the deleted token not to be flushed")
+	}
+
+	ts.Save("c", []byte("c"), expiry)
+	if err := ts.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := remote.Find("c"); !found {
+		t.Fatal("expected Close to flush the pending writes")
+	}
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+}
+
+func TestCAS(t *testing.T) {
+	remote := storetest.NewBuntStore(t)
+	ts, _ := New(nil, remote, Config{})
+	ctx := context.Background()
+	expiry := time.Now().Add(time.Minute)
+
+	version, ok, err := ts.SaveIfVersion(ctx, "session_token", []byte("v1"), expiry, 0)
+	if err != nil || !ok || version != 1 {
+		t.Fatalf("got %d %v %v: expected version 1", version, ok, err)
+	}
+	remote.Save("session_token", []byte("v2"), expiry)
+	if _, ok, _ = ts.SaveIfVersion(ctx, "session_token", []byte("v3"), expiry, 1); ok {
+		t.Fatal("expected a conflict")
+	}
+	if v, _, _ := ts.Find("session_token"); !bytes.Equal(v, []byte("v2")) {
+		t.Fatalf("got %s: expected the conflict to drop the local copy", v)
+	}
+
+	// FindVersion只刷新该token的写入
+	wb, _ := New(nil, remote, Config{Mode: WriteBehind, FlushInterval: time.Hour})
+	defer wb.Close()
+	wb.Save("session_token", []byte("v4"), expiry)
+	wb.Save("other_token", []byte("o"), expiry)
+	b, _, found, err := wb.FindVersion(ctx, "session_token")
+	if err != nil || !found || !bytes.Equal(b, []byte("v4")) {
+		t.Fatalf("got %s %v %v: expected the pending write to be flushed", b, found, err)
+	}
+	if _, found, _ = remote.Find("other_token"); found {
+		t.Fatal("expected the other pending writes not to be flushed")
+	}
+
+	m, _ := New(nil, memstore.New(0), Config{})
+	if _, _, _, err = m.FindVersion(ctx, "session_token"); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("got %v: expected %v", err, errors.ErrUnsupported)
+	}
+}
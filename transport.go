@@ -0,0 +1,164 @@
+package session
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultTokenHeader HeaderTransport默认使用的header
+const DefaultTokenHeader = "X-Session-Token"
+
+// TokenTransport token在请求和返回中的传递方式
+// 一个Manager可以设置多个，Load时按顺序读取，返回时使用读取到token的方式写回
+type TokenTransport interface {
+	// ReadToken 从请求中读取token，没有时返回空字符串
+	ReadToken(r *http.Request) string
+	// WriteToken 将token写入返回，expiry为session的过期时间
+	WriteToken(w http.ResponseWriter, token string, expiry time.Time) error
+}
+
+// CookieTransport 使用cookie传递token，cookie的属性使用Manager的设置，默认方式
+// 不通过Manager单独使用时，cookie的属性使用NewOptions的默认设置
+func CookieTransport() TokenTransport {
+	return cookieTransport{}
+}
+
+// HeaderTransport 使用自定义的header传递token，返回时写入相同的header
+// name为空时使用DefaultTokenHeader
+func HeaderTransport(name string) TokenTransport {
+	if name == "" {
+		name = DefaultTokenHeader
+	}
+	return headerTransport{name: http.CanonicalHeaderKey(name)}
+}
+
+// BearerTransport 使用Authorization: Bearer传递token，返回时写入相同格式的Authorization header
+func BearerTransport() TokenTransport {
+	return bearerTransport{}
+}
+
+// QueryTransport 使用url参数传递token
+// 返回时无法修改url，写入DefaultTokenHeader
+func QueryTransport(param string) TokenTransport {
+	return queryTransport{param: param}
+}
+
+// cookieTransport opts在使用时由bindTransport设置，为nil时使用默认设置
+type cookieTransport struct {
+	opts *Options
+}
+
+// options 返回cookie的设置
+func (t cookieTransport) options() *Options {
+	if t.opts == nil {
+		o := NewOptions()
+		return &o
+	}
+	return t.opts
+}
+
+func (t cookieTransport) ReadToken(r *http.Request) string {
+	cookie, err := r.Cookie(t.options().name)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+func (t cookieTransport) WriteToken(w http.ResponseWriter, token string, expiry time.Time) error {
+	opts := t.options()
+	// 浏览器会丢弃不符合规则的cookie
+	if opts.err != nil {
+		return opts.err
+	}
+	// 设置cookie
+	cookie := &http.Cookie{
+		Name:        opts.name,
+		Value:       token,
+		Path:        opts.path,
+		Domain:      opts.domain,
+		Secure:      opts.secure,
+		HttpOnly:    opts.httpOnly,
+		SameSite:    opts.sameSite,
+		Partitioned: opts.partitioned,
+	}
+	if opts.persist == true {
+		// Round up expiry time to the nearest second.
+		cookie.Expires = time.Unix(expiry.Unix()+1, 0)
+		cookie.MaxAge = int(expiry.Sub(time.Now()).Seconds() + 1)
+	}
+
+	// 重写存在的cookie
+	for i, h := range w.Header()["Set-Cookie"] {
+		if strings.HasPrefix(h, fmt.Sprintf("%s=", opts.name)) {
+			w.Header()["Set-Cookie"][i] = cookie.String()
+			return nil
+		}
+	}
+	// 如果不存在，则新生成一个
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+type headerTransport struct {
+	name string
+}
+
+func (t headerTransport) ReadToken(r *http.Request) string {
+	return r.Header.Get(t.name)
+}
+
+func (t headerTransport) WriteToken(w http.ResponseWriter, token string, expiry time.Time) error {
+	w.Header().Set(t.name, token)
+	return nil
+}
+
+type bearerTransport struct{}
+
+func (bearerTransport) ReadToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(auth[len(prefix):])
+}
+
+func (bearerTransport) WriteToken(w http.ResponseWriter, token string, expiry time.Time) error {
+	w.Header().Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+type queryTransport struct {
+	param string
+}
+
+func (t queryTransport) ReadToken(r *http.Request) string {
+	return r.URL.Query().Get(t.param)
+}
+
+func (t queryTransport) WriteToken(w http.ResponseWriter, token string, expiry time.Time) error {
+	w.Header().Set(DefaultTokenHeader, token)
+	return nil
+}
+
+// bindTransport cookieTransport使用当前的Options
+func (o *Options) bindTransport(t TokenTransport) TokenTransport {
+	if _, ok := t.(cookieTransport); ok {
+		return cookieTransport{opts: o}
+	}
+	return t
+}
+
+// readToken 按顺序从请求中读取token，返回token和读取到token的方式
+func (o *Options) readToken(r *http.Request) (string, TokenTransport) {
+	for _, t := range o.transports {
+		token := o.bindTransport(t).ReadToken(r)
+		if token != "" {
+			return token, t
+		}
+	}
+	return "", nil
+}
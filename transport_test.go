@@ -0,0 +1,93 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ipiao/session/stores/memstore"
+)
+
+func TestTransports(t *testing.T) {
+	m := NewManager(memstore.New(0), Transports(
+		CookieTransport(),
+		HeaderTransport(""),
+		BearerTransport(),
+		QueryTransport("token"),
+	))
+
+	// 新建的session使用所有方式写回
+	rr := httptest.NewRecorder()
+	s, err := m.Load(httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutToResponseWriter(rr, "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	token := s.GetToken()
+	if c := rr.Result().Cookies(); len(c) != 1 || c[0].Value != token {
+		t.Fatalf("got %v: expected a cookie with %q", c, token)
+	}
+	if v := rr.Header().Get(DefaultTokenHeader); v != token {
+		t.Fatalf("got %q: expected %q", v, token)
+	}
+	if v := rr.Header().Get("Authorization"); v != "Bearer "+token {
+		t.Fatalf("got %q: expected %q", v, "Bearer "+token)
+	}
+
+	requests := map[string]func(r *http.Request){
+		"cookie": func(r *http.Request) { r.AddCookie(&http.Cookie{Name: defaultName, Value: token}) },
+		"header": func(r *http.Request) { r.Header.Set("X-Session-Token", token) },
+		"bearer": func(r *http.Request) { r.Header.Set("Authorization", "bearer "+token) },
+		"query":  func(r *http.Request) { r.URL.RawQuery = "token=" + token },
+	}
+	for name, setup := range requests {
+		r := httptest.NewRequest("GET", "/", nil)
+		setup(r)
+		s, err := m.Load(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := s.GetString("key"); v != "value" {
+			t.Fatalf("%s: got %q: expected %q", name, v, "value")
+		}
+		// 只使用读取到token的方式写回
+		rr := httptest.NewRecorder()
+		if err := s.WriteToResponseWriter(rr); err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		if len(rr.Result().Cookies()) > 0 {
+			n++
+		}
+		if rr.Header().Get(DefaultTokenHeader) != "" {
+			n++
+		}
+		if rr.Header().Get("Authorization") != "" {
+			n++
+		}
+		if n != 1 {
+			t.Fatalf("%s: got %v: expected the token echoed through one channel", name, rr.Header())
+		}
+	}
+}
+
+// TestCookieTransportStandalone 不通过Manager使用时cookie使用默认设置
+func TestCookieTransportStandalone(t *testing.T) {
+	ct := CookieTransport()
+	rr := httptest.NewRecorder()
+	if err := ct.WriteToken(rr, "token", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	c := rr.Result().Cookies()
+	if len(c) != 1 || c[0].Name != defaultName || c[0].Value != "token" || c[0].Path != "/" || !c[0].HttpOnly {
+		t.Fatalf("got %v: expected the default cookie", c)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(c[0])
+	if token := ct.ReadToken(r); token != "token" {
+		t.Fatalf("got %q: expected %q", token, "token")
+	}
+}
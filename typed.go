@@ -0,0 +1,287 @@
+package session
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+)
+
+// TypeError 值无法转换为目标类型
+// errors.Is(err, ErrTypeAssertionFailed) 为true
+type TypeError struct {
+	Key   string       // 键
+	Value interface{}  // session中存储的值
+	Type  reflect.Type // 目标类型
+	Err   error        // 转换过程中的错误，可能为nil
+}
+
+func (e *TypeError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("scs: can not convert %T to %s for key %q: %v", e.Value, e.Type, e.Key, e.Err)
+	}
+	return fmt.Sprintf("scs: can not convert %T to %s for key %q", e.Value, e.Type, e.Key)
+}
+
+// Unwrap 返回转换过程中的错误
+func (e *TypeError) Unwrap() error {
+	return e.Err
+}
+
+// Is 兼容ErrTypeAssertionFailed
+func (e *TypeError) Is(target error) bool {
+	return target == ErrTypeAssertionFailed
+}
+
+// Get 获取key对应的值并转换为T
+// key不存在时返回T的零值；编解码造成的类型变化(json.Number、RFC3339字符串、base64字符串等)会被还原
+func Get[T any](s *Session, key string) (T, error) {
+	v, exists, err := s.Get(key)
+	if err != nil || !exists {
+		var zero T
+		return zero, err
+	}
+	return convert[T](key, v)
+}
+
+// GetOr 获取key对应的值，不存在或者无法转换时返回def
+func GetOr[T any](s *Session, key string, def T) T {
+	v, exists, err := s.Get(key)
+	if err != nil || !exists {
+		return def
+	}
+	t, err := convert[T](key, v)
+	if err != nil {
+		return def
+	}
+	return t
+}
+
+// Put 存入，存在则替换
+func Put[T any](s *Session, key string, val T) error {
+	return s.Put(key, val)
+}
+
+// Pop 移除并返回key对应的值
+func Pop[T any](s *Session, key string) (T, error) {
+	v, exists, err := s.Pop(key)
+	if err != nil || !exists {
+		var zero T
+		return zero, err
+	}
+	return convert[T](key, v)
+}
+
+// PopFromResponseWriter 移除并返回key对应的值，同时将session写入到返回中
+func PopFromResponseWriter[T any](s *Session, w http.ResponseWriter, key string) (T, error) {
+	v, exists, err := s.PopFromResponseWriter(w, key)
+	if err != nil || !exists {
+		var zero T
+		return zero, err
+	}
+	return convert[T](key, v)
+}
+
+// convert 将session中的值转换为T
+func convert[T any](key string, v interface{}) (T, error) {
+	var t T
+	if tv, ok := v.(T); ok {
+		return tv, nil
+	}
+	rv := reflect.ValueOf(&t).Elem()
+	if err := convertValue(rv, v); err != nil {
+		var zero T
+		te := &TypeError{Key: key, Value: v, Type: rv.Type()}
+		if err != ErrTypeAssertionFailed {
+			te.Err = err
+		}
+		return zero, te
+	}
+	return t, nil
+}
+
+// convertValue 将v转换后赋值给dst
+func convertValue(dst reflect.Value, v interface{}) error {
+	if v == nil {
+		return ErrTypeAssertionFailed
+	}
+	src := reflect.ValueOf(v)
+	if src.Type().ConvertibleTo(dst.Type()) && src.Kind() == dst.Kind() {
+		dst.Set(src.Convert(dst.Type()))
+		return nil
+	}
+
+	switch dst.Type() {
+	case timeType:
+		switch v := v.(type) {
+		case *time.Time:
+			dst.Set(reflect.ValueOf(*v))
+			return nil
+		case string:
+			tm, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return err
+			}
+			dst.Set(reflect.ValueOf(tm))
+			return nil
+		}
+		return ErrTypeAssertionFailed
+	}
+
+	// []byte以及自定义的[]byte类型直接转换，JSON编码后是base64字符串，不走gob解码
+	if dst.Kind() == reflect.Slice && dst.Type().Elem().Kind() == reflect.Uint8 {
+		switch v := v.(type) {
+		case []byte:
+			dst.SetBytes(v)
+			return nil
+		case string:
+			b, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				return err
+			}
+			dst.SetBytes(b)
+			return nil
+		}
+		return ErrTypeAssertionFailed
+	}
+
+	switch dst.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := toInt64(v)
+		if err != nil {
+			return err
+		}
+		if dst.OverflowInt(n) {
+			return strconv.ErrRange
+		}
+		dst.SetInt(n)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := toUint64(v)
+		if err != nil {
+			return err
+		}
+		if dst.OverflowUint(n) {
+			return strconv.ErrRange
+		}
+		dst.SetUint(n)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		f, err := toFloat64(v)
+		if err != nil {
+			return err
+		}
+		if dst.OverflowFloat(f) {
+			return strconv.ErrRange
+		}
+		dst.SetFloat(f)
+		return nil
+	case reflect.Bool, reflect.String:
+		return ErrTypeAssertionFailed
+	}
+
+	// 自定义类型: PutObject存入的gob数据，或者JSON解码后的map/slice
+	switch v := v.(type) {
+	case []byte:
+		return gobDecode(v, dst.Addr().Interface())
+	case string:
+		b, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return err
+		}
+		return gobDecode(b, dst.Addr().Interface())
+	case map[string]interface{}, []interface{}:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(b, dst.Addr().Interface())
+	}
+	return ErrTypeAssertionFailed
+}
+
+func toInt64(v interface{}) (int64, error) {
+	switch v := v.(type) {
+	case json.Number:
+		return v.Int64()
+	case int:
+		return int64(v), nil
+	case int8:
+		return int64(v), nil
+	case int16:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case uint, uint8, uint16, uint32, uint64:
+		n, err := toUint64(v)
+		if err != nil {
+			return 0, err
+		}
+		if n > math.MaxInt64 {
+			return 0, strconv.ErrRange
+		}
+		return int64(n), nil
+	case float32, float64:
+		f, _ := toFloat64(v)
+		if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+			return 0, strconv.ErrRange
+		}
+		return int64(f), nil
+	}
+	return 0, ErrTypeAssertionFailed
+}
+
+func toUint64(v interface{}) (uint64, error) {
+	switch v := v.(type) {
+	case json.Number:
+		return strconv.ParseUint(v.String(), 10, 64)
+	case uint:
+		return uint64(v), nil
+	case uint8:
+		return uint64(v), nil
+	case uint16:
+		return uint64(v), nil
+	case uint32:
+		return uint64(v), nil
+	case uint64:
+		return v, nil
+	case int, int8, int16, int32, int64, float32, float64:
+		n, err := toInt64(v)
+		if err != nil {
+			return 0, err
+		}
+		if n < 0 {
+			return 0, strconv.ErrRange
+		}
+		return uint64(n), nil
+	}
+	return 0, ErrTypeAssertionFailed
+}
+
+func toFloat64(v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case json.Number:
+		return v.Float64()
+	case float32:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case int, int8, int16, int32, int64:
+		n, _ := toInt64(v)
+		return float64(n), nil
+	case uint, uint8, uint16, uint32, uint64:
+		n, _ := toUint64(v)
+		return float64(n), nil
+	}
+	return 0, ErrTypeAssertionFailed
+}
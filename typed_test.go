@@ -0,0 +1,95 @@
+package session
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ipiao/session/stores/memstore"
+)
+
+type testUser struct {
+	Name string
+	Age  int
+}
+
+type testBytes []byte
+
+func TestGetAfterJSONRoundTrip(t *testing.T) {
+	now := time.Now().Round(0)
+	b, err := JSONCodec{}.Encode("session_id", map[string]interface{}{
+		"int":   42,
+		"int64": int64(1) << 40,
+		"float": 3.14,
+		"time":  now,
+		"bytes": []byte("encoded_data"),
+		"user":  testUser{Name: "alice", Age: 30},
+	}, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, data, deadline, err := JSONCodec{}.Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Session{sessionState: &sessionState{id: "session_id", token: "session_id", data: data, deadline: deadline, opts: NewOptions(), store: memstore.New(0)}}
+
+	if n, err := Get[int](s, "int"); err != nil || n != 42 {
+		t.Fatalf("got %v %v: expected %v", n, err, 42)
+	}
+	if n, err := Get[int64](s, "int64"); err != nil || n != int64(1)<<40 {
+		t.Fatalf("got %v %v: expected %v", n, err, int64(1)<<40)
+	}
+	if f, err := Get[float64](s, "float"); err != nil || f != 3.14 {
+		t.Fatalf("got %v %v: expected %v", f, err, 3.14)
+	}
+	if tm, err := Get[time.Time](s, "time"); err != nil || !tm.Equal(now) {
+		t.Fatalf("got %v %v: expected %v", tm, err, now)
+	}
+	if bs, err := Get[[]byte](s, "bytes"); err != nil || !bytes.Equal(bs, []byte("encoded_data")) {
+		t.Fatalf("got %v %v: expected %v", bs, err, []byte("encoded_data"))
+	}
+	if bs, err := Get[testBytes](s, "bytes"); err != nil || !bytes.Equal(bs, []byte("encoded_data")) {
+		t.Fatalf("got %v %v: expected %v", bs, err, testBytes("encoded_data"))
+	}
+	if u, err := Get[testUser](s, "user"); err != nil || u != (testUser{Name: "alice", Age: 30}) {
+		t.Fatalf("got %v %v: expected %v", u, err, testUser{Name: "alice", Age: 30})
+	}
+	if n, err := Get[int](s, "missing"); err != nil || n != 0 {
+		t.Fatalf("got %v %v: expected %v", n, err, 0)
+	}
+	if n := GetOr(s, "missing", 7); n != 7 {
+		t.Fatalf("got %v: expected %v", n, 7)
+	}
+
+	_, err = Get[int8](s, "int64")
+	var te *TypeError
+	if !errors.As(err, &te) || te.Key != "int64" {
+		t.Fatalf("got %v: expected a *TypeError for key %q", err, "int64")
+	}
+	if !errors.Is(err, ErrTypeAssertionFailed) {
+		t.Fatalf("got %v: expected errors.Is(err, ErrTypeAssertionFailed)", err)
+	}
+	if n := GetOr[int8](s, "int64", 7); n != 7 {
+		t.Fatalf("got %v: expected %v", n, 7)
+	}
+}
+
+func TestPutPop(t *testing.T) {
+	s, err := newSession(memstore.New(0), NewOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Put(s, "user", testUser{Name: "alice", Age: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := Pop[testUser](s, "user")
+	if err != nil || u.Name != "alice" {
+		t.Fatalf("got %v %v: expected %v", u, err, testUser{Name: "alice", Age: 30})
+	}
+	if ok, _ := s.Exists("user"); ok {
+		t.Fatal("expected key to be removed")
+	}
+}
@@ -0,0 +1,212 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// UserToken 用户的一个session登录记录
+type UserToken struct {
+	Token     string    `json:"token"`
+	LoginTime time.Time `json:"login_time"`
+	Expiry    time.Time `json:"expiry"`
+}
+
+// UserIndex 用户与session token的索引，用于限制单用户的session数量
+// List返回未过期的记录，按登录时间升序排列
+type UserIndex interface {
+	Add(ctx context.Context, userID string, ut UserToken) error
+	Remove(ctx context.Context, userID string, token string) error
+	List(ctx context.Context, userID string) ([]UserToken, error)
+}
+
+// memUserIndex 进程内的用户索引
+type memUserIndex struct {
+	users map[string][]UserToken
+	mu    sync.Mutex
+}
+
+// NewMemUserIndex 返回进程内的用户索引，多实例部署时各实例的索引互不可见
+func NewMemUserIndex() UserIndex {
+	return &memUserIndex{
+		users: make(map[string][]UserToken),
+	}
+}
+
+func (idx *memUserIndex) Add(ctx context.Context, userID string, ut UserToken) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.users[userID] = addUserToken(idx.users[userID], ut)
+	return nil
+}
+
+func (idx *memUserIndex) Remove(ctx context.Context, userID string, token string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	uts := removeUserToken(idx.users[userID], token)
+	if len(uts) == 0 {
+		delete(idx.users, userID)
+	} else {
+		idx.users[userID] = uts
+	}
+	return nil
+}
+
+func (idx *memUserIndex) List(ctx context.Context, userID string) ([]UserToken, error) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	uts := liveUserTokens(idx.users[userID])
+	if len(uts) == 0 {
+		delete(idx.users, userID)
+		return nil, nil
+	}
+	idx.users[userID] = uts
+	return append([]UserToken(nil), uts...), nil
+}
+
+// storeUserIndexPrefix 用户索引在存储器中的token前缀
+const storeUserIndexPrefix = "__scs_user:"
+
+// storeUserIndex 保存在存储器中的用户索引
+type storeUserIndex struct {
+	raw   Store
+	store StoreContext
+	mu    sync.Mutex
+}
+
+// NewStoreUserIndex 返回保存在存储器中的用户索引，多实例部署时共享
+// 每个用户的记录以JSON保存在"__scs_user:"+userID下，读改写不是原子操作
+// store必须是与session数据不同的存储器(不同的表、库或者实例)，否则索引数据会被Loads、Scan和查询当作session读出，
+// 与Manager的存储器相同时，Manager.Err返回配置错误
+func NewStoreUserIndex(store Store) UserIndex {
+	return &storeUserIndex{
+		raw:   store,
+		store: WithContext(store),
+	}
+}
+
+// errUserIndexStore 用户索引和session使用同一个存储器
+var errUserIndexStore = errors.New("scs: user index must not use the session store")
+
+// checkUserIndex 检查用户索引是否保存在session的存储器中，包括被存储器中间件包装的存储器
+func (o *Options) checkUserIndex(store Store) error {
+	idx, ok := o.userIndex.(*storeUserIndex)
+	if !ok {
+		return nil
+	}
+	for store != nil {
+		if sameStore(idx.raw, store) {
+			return errUserIndexStore
+		}
+		u, ok := store.(unwrapper)
+		if !ok {
+			return nil
+		}
+		store = u.Unwrap()
+	}
+	return nil
+}
+
+// sameStore a和b是否为同一个存储器，不可比较的类型不会相同
+func sameStore(a, b Store) bool {
+	ta := reflect.TypeOf(a)
+	return ta == reflect.TypeOf(b) && ta.Comparable() && a == b
+}
+
+// removeUserToken 从用户索引中删除session的记录，调用时需要持有s.mu
+func (s *Session) removeUserToken(ctx context.Context) error {
+	uid, _ := s.data[userIDKey].(string)
+	if uid == "" || s.opts.userIndex == nil {
+		return nil
+	}
+	return s.opts.userIndex.Remove(ctx, uid, s.token)
+}
+
+func (idx *storeUserIndex) load(ctx context.Context, userID string) ([]UserToken, error) {
+	b, found, err := idx.store.FindCtx(ctx, storeUserIndexPrefix+userID)
+	if err != nil || !found {
+		return nil, err
+	}
+	var uts []UserToken
+	err = json.Unmarshal(b, &uts)
+	if err != nil {
+		return nil, err
+	}
+	return liveUserTokens(uts), nil
+}
+
+func (idx *storeUserIndex) save(ctx context.Context, userID string, uts []UserToken) error {
+	if len(uts) == 0 {
+		return idx.store.DeleteCtx(ctx, storeUserIndexPrefix+userID)
+	}
+	var expiry time.Time
+	for _, ut := range uts {
+		if ut.Expiry.After(expiry) {
+			expiry = ut.Expiry
+		}
+	}
+	b, err := json.Marshal(uts)
+	if err != nil {
+		return err
+	}
+	return idx.store.SaveCtx(ctx, storeUserIndexPrefix+userID, b, expiry)
+}
+
+func (idx *storeUserIndex) Add(ctx context.Context, userID string, ut UserToken) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	uts, err := idx.load(ctx, userID)
+	if err != nil {
+		return err
+	}
+	return idx.save(ctx, userID, addUserToken(uts, ut))
+}
+
+func (idx *storeUserIndex) Remove(ctx context.Context, userID string, token string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	uts, err := idx.load(ctx, userID)
+	if err != nil {
+		return err
+	}
+	return idx.save(ctx, userID, removeUserToken(uts, token))
+}
+
+func (idx *storeUserIndex) List(ctx context.Context, userID string) ([]UserToken, error) {
+	return idx.load(ctx, userID)
+}
+
+// addUserToken 添加或者替换token的记录，保持按登录时间升序
+func addUserToken(uts []UserToken, ut UserToken) []UserToken {
+	uts = append(removeUserToken(uts, ut.Token), ut)
+	sort.SliceStable(uts, func(i, j int) bool {
+		return uts[i].LoginTime.Before(uts[j].LoginTime)
+	})
+	return uts
+}
+
+func removeUserToken(uts []UserToken, token string) []UserToken {
+	ret := uts[:0]
+	for _, ut := range uts {
+		if ut.Token != token {
+			ret = append(ret, ut)
+		}
+	}
+	return ret
+}
+
+func liveUserTokens(uts []UserToken) []UserToken {
+	now := time.Now()
+	ret := uts[:0]
+	for _, ut := range uts {
+		if ut.Expiry.After(now) {
+			ret = append(ret, ut)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,178 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipiao/session/stores/memstore"
+)
+
+func TestLoginEvictOldest(t *testing.T) {
+	store := memstore.New(0)
+	m := NewManager(store, MaxSessionsPerUser(2, LoginEvictOldest))
+
+	var ss []*Session
+	for i := 0; i < 3; i++ {
+		s, err := m.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = m.Login(s, "alice"); err != nil {
+			t.Fatal(err)
+		}
+		ss = append(ss, s)
+		time.Sleep(time.Millisecond)
+	}
+
+	if ss[0].GetToken() != "" {
+		t.Fatalf("got %q: expected the oldest session to be evicted", ss[0].GetToken())
+	}
+	for _, s := range ss[1:] {
+		if _, found, _ := store.Find(s.GetToken()); !found {
+			t.Fatalf("expected session %q to be kept", s.GetToken())
+		}
+	}
+	if n := len(m.FindSeesion(FindByUserID("alice"))); n != 2 {
+		t.Fatalf("got %d: expected %d", n, 2)
+	}
+}
+
+func TestLoginReject(t *testing.T) {
+	m := NewManager(memstore.New(0), MaxSessionsPerUser(1, LoginReject))
+
+	s1, _ := m.NewSession()
+	if err := m.Login(s1, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	// 重复登录同一个session不计数
+	if err := m.Login(s1, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	s2, _ := m.NewSession()
+	if err := m.Login(s2, "alice"); err != ErrTooManySessions {
+		t.Fatalf("got %v: expected %v", err, ErrTooManySessions)
+	}
+	if err := s1.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Login(s2, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if uid := s2.GetUserID(); uid != "alice" {
+		t.Fatalf("got %q: expected %q", uid, "alice")
+	}
+}
+
+// slowUserIndex 读取较慢的用户索引，使并发的登录交错执行
+type slowUserIndex struct {
+	UserIndex
+}
+
+func (idx slowUserIndex) List(ctx context.Context, userID string) ([]UserToken, error) {
+	uts, err := idx.UserIndex.List(ctx, userID)
+	time.Sleep(time.Millisecond)
+	return uts, err
+}
+
+func TestLoginConcurrent(t *testing.T) {
+	m := NewManager(memstore.New(0), MaxSessionsPerUser(2, LoginReject), UseUserIndex(slowUserIndex{NewMemUserIndex()}))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var ok int
+	for i := 0; i < 10; i++ {
+		s, err := m.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if m.Login(s, "alice") == nil {
+				mu.Lock()
+				ok++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	uts, _ := m.opts.userIndex.List(context.Background(), "alice")
+	if ok != 2 || len(uts) != 2 {
+		t.Fatalf("got %d logins and %d sessions: expected the limit of 2", ok, len(uts))
+	}
+}
+
+func TestLoginOtherUser(t *testing.T) {
+	m := NewManager(memstore.New(0))
+	s, _ := m.NewSession()
+	m.Login(s, "alice")
+	if err := m.Login(s, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if uts, _ := m.opts.userIndex.List(ctx, "alice"); len(uts) != 0 {
+		t.Fatalf("got %v: expected the session to be removed from the previous user", uts)
+	}
+	if uts, _ := m.opts.userIndex.List(ctx, "bob"); len(uts) != 1 {
+		t.Fatalf("got %v: expected the session of the new user", uts)
+	}
+}
+
+func TestStoreUserIndex(t *testing.T) {
+	idx := NewStoreUserIndex(memstore.New(0))
+	ctx := context.Background()
+	now := time.Now()
+	idx.Add(ctx, "alice", UserToken{Token: "b", LoginTime: now.Add(time.Second), Expiry: now.Add(time.Hour)})
+	idx.Add(ctx, "alice", UserToken{Token: "a", LoginTime: now, Expiry: now.Add(time.Hour)})
+	idx.Add(ctx, "alice", UserToken{Token: "c", LoginTime: now, Expiry: now.Add(-time.Hour)})
+
+	uts, err := idx.List(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uts) != 2 || uts[0].Token != "a" || uts[1].Token != "b" {
+		t.Fatalf("got %v: expected tokens %v", uts, []string{"a", "b"})
+	}
+	idx.Remove(ctx, "alice", "a")
+	uts, _ = idx.List(ctx, "alice")
+	if len(uts) != 1 || uts[0].Token != "b" {
+		t.Fatalf("got %v: expected tokens %v", uts, []string{"b"})
+	}
+}
+
+func TestUserIndexCleanup(t *testing.T) {
+	idx := NewMemUserIndex()
+	m := NewManager(memstore.New(0), UseUserIndex(idx))
+	ctx := context.Background()
+
+	s1, _ := m.NewSession()
+	s2, _ := m.NewSession()
+	for _, s := range []*Session{s1, s2} {
+		if err := m.Login(s, "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s1.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if uts, _ := idx.List(ctx, "alice"); len(uts) != 1 || uts[0].Token != s2.GetToken() {
+		t.Fatalf("got %v: expected Destroy to remove the session from the index", uts)
+	}
+	s2.deadline = time.Now().Add(-time.Second)
+	m.gc()
+	if uts, _ := idx.List(ctx, "alice"); len(uts) != 0 {
+		t.Fatalf("got %v: expected gc to remove the expired session from the index", uts)
+	}
+}
+
+func TestUserIndexStore(t *testing.T) {
+	store := memstore.New(0)
+	if m := NewManager(store, UseUserIndex(NewStoreUserIndex(store))); !errors.Is(m.Err(), errUserIndexStore) {
+		t.Fatalf("got %v: expected %v", m.Err(), errUserIndexStore)
+	}
+	if m := NewManager(store, UseUserIndex(NewStoreUserIndex(memstore.New(0)))); m.Err() != nil {
+		t.Fatal(m.Err())
+	}
+}
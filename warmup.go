@@ -0,0 +1,158 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Scanner 支持流式遍历的存储器
+// 对每个未过期的session调用fn，fn返回错误时停止遍历并返回该错误
+// 与Loads不同，不需要一次把所有session读到内存中
+type Scanner interface {
+	Scan(ctx context.Context, fn func(token string, b []byte) error) error
+}
+
+// WarmUpMode 启动时从存储器预热session到manager的方式
+type WarmUpMode int
+
+const (
+	// WarmUpSync 在NewManager中同步预热，默认方式
+	WarmUpSync WarmUpMode = iota
+	// WarmUpAsync 在后台预热，不阻塞NewManager
+	WarmUpAsync
+	// WarmUpLazy 启动时不预热，Load从存储器中加载到session时再放入manager
+	WarmUpLazy
+	// WarmUpOff 不预热，可以手动调用Manager.WarmUp
+	WarmUpOff
+)
+
+// startWarmUp 按照WarmUp选项在NewManager中预热
+func (m *Manager) startWarmUp() {
+	switch m.opts.warmUpMode {
+	case WarmUpSync:
+		err := m.WarmUp(context.Background())
+		if err != nil {
+			log.Printf("can not load sessions from store, error occur:%v", err)
+		}
+	case WarmUpAsync:
+		ctx, cancel := context.WithCancel(context.Background())
+		m.warmUpCancel = cancel
+		go func() {
+			defer cancel()
+			err := m.WarmUp(ctx)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				log.Printf("can not load sessions from store, error occur:%v", err)
+			}
+		}()
+	}
+}
+
+// WarmUp 从存储器中加载session到manager
+// 存储器实现了Scanner时流式遍历，否则使用Loads(memstore在Scan和Loads中恢复落地文件)
+// 按WarmUp选项并发解码，加载的数量达到上限时停止遍历
+func (m *Manager) WarmUp(ctx context.Context) error {
+	limit, workers := int64(m.opts.warmUpLimit), m.opts.warmUpConcurrency
+	if workers <= 0 {
+		workers = 1
+	}
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type item struct {
+		token string
+		b     []byte
+	}
+	ch := make(chan item, workers)
+	var loaded int64
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for it := range ch {
+				s, err := m.decodeSession(context.Background(), it.token, it.b)
+				if err != nil {
+					log.Printf("can not decode session:%v", err)
+					continue
+				}
+				if s.TimeOut() {
+					continue
+				}
+				// Loads只返回数据，以id作为token
+				if s.token == "" {
+					s.token = s.id
+				}
+				if limit > 0 && atomic.AddInt64(&loaded, 1) > limit {
+					cancel()
+					continue
+				}
+				m.sessions.add(s.token, s)
+			}
+		}()
+	}
+
+	send := func(token string, b []byte) error {
+		select {
+		case ch <- item{token, b}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	var err error
+	start := time.Now()
+	sc, scan := m.store.(Scanner)
+	if scan {
+		err = sc.Scan(ctx, send)
+		// 装饰器包装的存储器不支持Scan
+		if errors.Is(err, errors.ErrUnsupported) {
+			scan, err = false, nil
+		}
+	}
+	if !scan {
+		var bs [][]byte
+		bs, err = m.storeCtx().LoadsCtx(ctx)
+		for _, b := range bs {
+			if err != nil {
+				break
+			}
+			err = send("", b)
+		}
+	}
+	close(ch)
+	wg.Wait()
+
+	// 达到上限时主动停止的遍历不是错误
+	if err != nil && parent.Err() == nil && limit > 0 && atomic.LoadInt64(&loaded) > limit {
+		err = nil
+	}
+	if scan {
+		m.stats.observe(OpScan, start, err)
+	}
+	return err
+}
+
+// hydrate WarmUpLazy时将从存储器中加载的session放入manager，返回与manager中的session共享数据的session
+func (m *Manager) hydrate(s *Session) *Session {
+	if m.opts.warmUpMode != WarmUpLazy {
+		return s
+	}
+	if _, ok := m.store.(clientStore); ok {
+		return s
+	}
+	if m.opts.warmUpLimit > 0 && m.sessions.len() >= m.opts.warmUpLimit {
+		return s
+	}
+	if !m.sessions.add(s.GetToken(), s.withRequest(nil, nil)) {
+		// 并发的请求已经放入
+		if ms, ok := m.sessions.get(s.GetToken()); ok {
+			return ms.withRequest(s.req, s.transport)
+		}
+	}
+	return s
+}
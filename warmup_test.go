@@ -0,0 +1,121 @@
+package session
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ipiao/session/stores/memstore"
+)
+
+// scanStore 在memstore上实现Scanner
+type scanStore struct {
+	*memstore.MemStore
+	tokens  []string
+	scanned int
+}
+
+func (s *scanStore) Scan(ctx context.Context, fn func(token string, b []byte) error) error {
+	for _, token := range s.tokens {
+		b, found, err := s.FindCtx(ctx, token)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+		s.scanned++
+		if err = fn(token, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newScanStore(t *testing.T, n int) *scanStore {
+	store := &scanStore{MemStore: memstore.New(0)}
+	m := NewManager(store, WarmUp(WarmUpOff, 0, 0))
+	for i := 0; i < n; i++ {
+		s, _ := m.NewSession()
+		if err := s.Put("n", i); err != nil {
+			t.Fatal(err)
+		}
+		store.tokens = append(store.tokens, s.GetToken())
+	}
+	return store
+}
+
+func TestWarmUp(t *testing.T) {
+	store := newScanStore(t, 20)
+
+	m := NewManager(store, WarmUp(WarmUpSync, 5, 4))
+	if st := m.Stat(); st.Active != 5 || st.StoreOps[OpScan].Count != 1 || st.StoreOps[OpScan].Errors != 0 {
+		t.Fatalf("got %d active, %+v: expected 5 sessions from one scan", st.Active, st.StoreOps[OpScan])
+	}
+	if store.scanned >= 20 {
+		t.Fatalf("got %d scanned: expected the scan to stop at the limit", store.scanned)
+	}
+	if _, ok := m.sessions.get(store.tokens[0]); !ok {
+		t.Fatal("expected sessions to be registered under their store token")
+	}
+
+	store.scanned = 0
+	m = NewManager(store, WarmUp(WarmUpAsync, 0, 2))
+	for i := 0; i < 100 && m.Stat().Active < 20; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if n := m.Stat().Active; n != 20 {
+		t.Fatalf("got %d active: expected %d", n, 20)
+	}
+	m.Close()
+}
+
+func TestWarmUpLazy(t *testing.T) {
+	store := newScanStore(t, 3)
+
+	m := NewManager(store, WarmUp(WarmUpLazy, 2, 0))
+	if n := m.Stat().Active; n != 0 {
+		t.Fatalf("got %d active: expected no warm-up", n)
+	}
+	for i, token := range store.tokens {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: defaultName, Value: token})
+		s, err := m.Load(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := s.GetInt("n"); v != i {
+			t.Fatalf("got %d: expected %d", v, i)
+		}
+	}
+	if n := m.Stat().Active; n != 2 {
+		t.Fatalf("got %d active: expected the hydration limit %d", n, 2)
+	}
+	if store.scanned != 0 {
+		t.Fatalf("got %d scanned: expected no scan", store.scanned)
+	}
+}
+
+// TestWarmUpDumpFile memstore在预热时从落地文件中恢复
+func TestWarmUpDumpFile(t *testing.T) {
+	dumpfile := filepath.Join(t.TempDir(), "sessions.dump")
+	store := memstore.New(0)
+	store.SetDumpFile(dumpfile)
+	m := NewManager(store)
+	s, _ := m.NewSession()
+	s.Put("key", "value")
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store = memstore.New(0)
+	store.SetDumpFile(dumpfile)
+	m = NewManager(store)
+	ss := m.FindSeesion(FindByID(s.GetID()))
+	if len(ss) != 1 || ss[0].GetToken() != s.GetToken() {
+		t.Fatalf("got %v: expected the session restored from the dump file", ss)
+	}
+}